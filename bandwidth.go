@@ -0,0 +1,161 @@
+package bitswap
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// tokenBucket limits a flow of bytes to a rate, allowing bursts of up to a
+// second's worth of data
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		if tb.tokens > tb.rate {
+			tb.tokens = tb.rate
+		}
+	}
+	tb.last = now
+}
+
+// reserve takes n bytes worth of tokens from the bucket, going into debt if
+// there aren't enough, and returns how long to wait before sending them
+func (tb *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	tb.refill(now)
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) setRate(rate int64, now time.Time) {
+	tb.refill(now)
+	tb.rate = float64(rate)
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+}
+
+// bandwidthLimiter limits the rate at which blocks are sent out, both overall
+// and to each peer. A limit of zero means unlimited.
+type bandwidthLimiter struct {
+	lk sync.Mutex
+
+	global   *tokenBucket
+	peerRate int64
+	peers    map[peer.ID]*tokenBucket
+
+	clock clock.Clock
+}
+
+func newBandwidthLimiter(clk clock.Clock, globalRate, peerRate int64) *bandwidthLimiter {
+	bl := &bandwidthLimiter{
+		peers: make(map[peer.ID]*tokenBucket),
+		clock: clk,
+	}
+	bl.setGlobalRate(globalRate)
+	bl.setPeerRate(peerRate)
+	return bl
+}
+
+func (bl *bandwidthLimiter) setGlobalRate(rate int64) {
+	bl.lk.Lock()
+	defer bl.lk.Unlock()
+
+	switch {
+	case rate <= 0:
+		bl.global = nil
+	case bl.global == nil:
+		bl.global = newTokenBucket(rate, bl.clock.Now())
+	default:
+		bl.global.setRate(rate, bl.clock.Now())
+	}
+}
+
+func (bl *bandwidthLimiter) setPeerRate(rate int64) {
+	bl.lk.Lock()
+	defer bl.lk.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	bl.peerRate = rate
+	now := bl.clock.Now()
+	for p, tb := range bl.peers {
+		if rate == 0 {
+			delete(bl.peers, p)
+		} else {
+			tb.setRate(rate, now)
+		}
+	}
+}
+
+// reserve reserves bandwidth for sending n bytes to the given peer, and
+// returns how long to wait before sending them on account of the global limit
+// and of the peer's own limit
+func (bl *bandwidthLimiter) reserve(p peer.ID, n int, now time.Time) (global, perPeer time.Duration) {
+	bl.lk.Lock()
+	defer bl.lk.Unlock()
+
+	if bl.global != nil {
+		global = bl.global.reserve(n, now)
+	}
+	if bl.peerRate > 0 {
+		tb, ok := bl.peers[p]
+		if !ok {
+			tb = newTokenBucket(bl.peerRate, now)
+			bl.peers[p] = tb
+		}
+		perPeer = tb.reserve(n, now)
+	}
+	return global, perPeer
+}
+
+// throttle reserves bandwidth for sending n bytes to the given peer. It blocks
+// while the global limit holds the send back, returning how long it did, and
+// how much longer the peer's own limit holds it back for. Waiting that out is
+// left to the caller, so that sends to other peers aren't held up by it.
+func (bl *bandwidthLimiter) throttle(ctx context.Context, p peer.ID, n int) (waited, peerWait time.Duration, err error) {
+	global, perPeer := bl.reserve(p, n, bl.clock.Now())
+	if perPeer > global {
+		peerWait = perPeer - global
+	}
+	if global <= 0 {
+		return 0, peerWait, nil
+	}
+
+	t := bl.clock.NewTimer(global)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return global, peerWait, nil
+	case <-ctx.Done():
+		return global, peerWait, ctx.Err()
+	}
+}
+
+// removePeer forgets the given peer's bucket
+func (bl *bandwidthLimiter) removePeer(p peer.ID) {
+	bl.lk.Lock()
+	defer bl.lk.Unlock()
+	delete(bl.peers, p)
+}
@@ -0,0 +1,156 @@
+package bitswap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+	tn "github.com/ipfs/go-bitswap/testnet"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	delay "github.com/ipfs/go-ipfs-delay"
+	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestBandwidthLimiterReserve(t *testing.T) {
+	now := time.Now()
+	a := peer.ID("a")
+	b := peer.ID("b")
+	bl := newBandwidthLimiter(clock.New(), 1000, 500)
+
+	// the first second's worth of data is sent right away
+	if global, perPeer := bl.reserve(a, 500, now); global != 0 || perPeer != 0 {
+		t.Fatal("expected no wait within the burst, got", global, perPeer)
+	}
+	// a is over its own limit now
+	if global, perPeer := bl.reserve(a, 250, now); global != 0 || perPeer != 500*time.Millisecond {
+		t.Fatal("expected to wait on the peer limit, got", global, perPeer)
+	}
+	// and b is held back by the global limit, as a used most of it
+	if global, perPeer := bl.reserve(b, 500, now); global != 250*time.Millisecond || perPeer != 0 {
+		t.Fatal("expected to wait on the global limit, got", global, perPeer)
+	}
+
+	// the buckets refill over time
+	now = now.Add(2 * time.Second)
+	if global, perPeer := bl.reserve(a, 500, now); global != 0 || perPeer != 0 {
+		t.Fatal("expected the buckets to have refilled, got", global, perPeer)
+	}
+
+	// and lifting the limits stops the throttling
+	bl.setGlobalRate(0)
+	bl.setPeerRate(0)
+	if global, perPeer := bl.reserve(a, 1<<20, now); global != 0 || perPeer != 0 {
+		t.Fatal("expected no wait without limits, got", global, perPeer)
+	}
+}
+
+func TestPeerBandwidthLimitThrottlesSends(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, PeerBandwidthLimit(4000))
+	defer sg.Close()
+
+	instances := sg.Instances(2)
+	sender := instances[0]
+	receiver := instances[1]
+
+	var blks []blocks.Block
+	var ks []cid.Cid
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 1000)
+		copy(data, fmt.Sprint("block ", i))
+		blk := blocks.NewBlock(data)
+		blks = append(blks, blk)
+		ks = append(ks, blk.Cid())
+	}
+	if err := sender.Blockstore().PutMany(blks); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	out, err := receiver.Exchange.GetBlocks(ctx, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []blocks.Block
+	for blk := range out {
+		got = append(got, blk)
+	}
+	if err := assertBlockLists(got, blks); err != nil {
+		t.Fatal(err)
+	}
+
+	// 8000 bytes at 4000 bytes/sec, the first 4000 of which are a burst
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatal("expected the transfer to be throttled, took", elapsed)
+	}
+	st, err := sender.Exchange.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ThrottleTime == 0 {
+		t.Fatal("expected throttle time to show up in the stats")
+	}
+}
+
+func TestThrottledPeerDoesNotHoldUpOthers(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, PeerBandwidthLimit(2000), TaskWorkerCount(1))
+	defer sg.Close()
+
+	instances := sg.Instances(3)
+	sender := instances[0]
+	throttled := instances[1]
+	other := instances[2]
+
+	var blks []blocks.Block
+	var ks []cid.Cid
+	for i := 0; i < 9; i++ {
+		data := make([]byte, 1000)
+		copy(data, fmt.Sprint("block ", i))
+		blk := blocks.NewBlock(data)
+		blks = append(blks, blk)
+		ks = append(ks, blk.Cid())
+	}
+	if err := sender.Blockstore().PutMany(blks); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the first peer uses up its burst, then asks for far more than its
+	// limit lets through for a while
+	out, err := throttled.Exchange.GetBlocks(ctx, ks[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range out {
+	}
+	if _, err := throttled.Exchange.GetBlocks(ctx, ks[2:8]); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(sender.Exchange.WantlistForPeer(throttled.Peer)) == 6 })
+	time.Sleep(100 * time.Millisecond)
+
+	// which doesn't hold up the only task worker for the other peer
+	start := time.Now()
+	if _, err := other.Exchange.GetBlock(ctx, ks[8]); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("expected the other peer to be served while the first is throttled, took", elapsed)
+	}
+
+	// the blocks held back aren't in the ledger until they're sent
+	if n := len(sender.Exchange.WantlistForPeer(throttled.Peer)); n != 6 {
+		t.Fatal("expected the throttled blocks to still be wanted, got", n)
+	}
+}
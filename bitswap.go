@@ -10,13 +10,16 @@ import (
 	"sync/atomic"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
 	decision "github.com/ipfs/go-bitswap/decision"
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	bsnet "github.com/ipfs/go-bitswap/network"
 	notifications "github.com/ipfs/go-bitswap/notifications"
 
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	delay "github.com/ipfs/go-ipfs-delay"
 	exchange "github.com/ipfs/go-ipfs-exchange-interface"
@@ -33,44 +36,303 @@ var log = logging.Logger("bitswap")
 var _ exchange.SessionExchange = (*Bitswap)(nil)
 
 const (
-	// maxProvidersPerRequest specifies the maximum number of providers desired
-	// from the network. This value is specified because the network streams
-	// results.
+	// defaultMaxProvidersPerRequest specifies the maximum number of providers
+	// desired from the network. This value is specified because the network
+	// streams results.
 	// TODO: if a 'non-nice' strategy is implemented, consider increasing this value
-	maxProvidersPerRequest = 3
-	findProviderDelay      = 1 * time.Second
-	providerRequestTimeout = time.Second * 10
-	provideTimeout         = time.Second * 15
-	sizeBatchRequestChan   = 32
+	defaultMaxProvidersPerRequest = 3
+	defaultFindProviderDelay      = 1 * time.Second
+	defaultProvSearchDelay        = time.Second * 10
+	defaultOrderedWindow          = 64
+	defaultRebroadcastDelay       = time.Minute
+	scoreSweepInterval            = time.Minute
+	providerRequestTimeout        = time.Second * 10
+	provideTimeout                = time.Second * 15
+	provideBatchTimeout           = time.Minute * 5
+	sizeBatchRequestChan          = 32
 	// kMaxPriority is the max priority as defined by the bitswap protocol
 	kMaxPriority = math.MaxInt32
+
+	defaultTaskWorkerCount       = 8
+	defaultHasBlockBufferSize    = 256
+	defaultProvideKeysBufferSize = 2048
+	defaultProvideWorkerMax      = 512
+	defaultProvideBatchSize      = 1024
+	defaultProvideBatchWindow    = time.Second
+
+	lowMemHasBlockBufferSize    = 64
+	lowMemProvideKeysBufferSize = 512
+	lowMemProvideWorkerMax      = 16
 )
 
-var (
-	HasBlockBufferSize    = 256
-	provideKeysBufferSize = 2048
-	provideWorkerMax      = 512
+// DefaultPriority is the priority the first key of a GetBlocks call is asked
+// for with, the keys after it counting down from it. Priorities given to
+// GetBlocksWithPriority and UpdatePriority are on the same scale, so keys
+// given one above DefaultPriority are served before the keys of GetBlocks
+// calls, and keys given one below it after most of them.
+const DefaultPriority = 1 << 30
 
+var (
 	// the 1<<18+15 is to observe old file chunks that are 1<<18 + 14 in size
 	metricsBuckets = []float64{1 << 6, 1 << 10, 1 << 14, 1 << 18, 1<<18 + 15, 1 << 22}
 )
 
-func init() {
-	if flags.LowMemMode {
-		HasBlockBufferSize = 64
-		provideKeysBufferSize = 512
-		provideWorkerMax = 16
+// Option defines the functional option type that can be used to configure
+// bitswap instances
+type Option func(*Bitswap)
+
+// TaskWorkerCount sets the number of workers sending blocks to other peers.
+func TaskWorkerCount(count int) Option {
+	return func(bs *Bitswap) {
+		bs.taskWorkerCount = count
+	}
+}
+
+// HasBlockBufferSize sets the size of the buffer holding newly added blocks
+// until they are picked up by the provide collector.
+func HasBlockBufferSize(size int) Option {
+	return func(bs *Bitswap) {
+		bs.hasBlockBufferSize = size
+	}
+}
+
+// ProvideKeysBufferSize sets the size of the buffer feeding keys to the
+// provide workers.
+func ProvideKeysBufferSize(size int) Option {
+	return func(bs *Bitswap) {
+		bs.provideKeysBufferSize = size
+	}
+}
+
+// ProvideWorkerMax sets the maximum number of concurrent provide calls.
+func ProvideWorkerMax(max int) Option {
+	return func(bs *Bitswap) {
+		bs.provideWorkerMax = max
+	}
+}
+
+// ProvideBatching sets how many keys are provided together, and how long to
+// wait for a batch to fill up, when the network can provide in batches. Sizes
+// below two provide keys one by one.
+func ProvideBatching(size int, window time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.provideBatchSize = size
+		bs.provideBatchWindow = window
+	}
+}
+
+// RebroadcastDelay sets the interval at which a provider search is started
+// for a key in the wantlist.
+func RebroadcastDelay(d delay.D) Option {
+	return func(bs *Bitswap) {
+		bs.rebroadcastDelay = d
+	}
+}
+
+// RebroadcastBudget sets the number of provider searches started for stale
+// wants every rebroadcast interval.
+func RebroadcastBudget(n int) Option {
+	return func(bs *Bitswap) {
+		bs.rebroadcastBudget = n
+	}
+}
+
+// ProviderSearchDelay sets how long GetBlocks waits for a block to arrive
+// before it searches for providers.
+func ProviderSearchDelay(d time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.findProviderDelay = d
+	}
+}
+
+// SessionProviderSearchDelay sets how long a session waits without receiving
+// any block before it searches for providers.
+func SessionProviderSearchDelay(d time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.provSearchDelay = d
+	}
+}
+
+// SessionOrderedWindow sets how many blocks past the next one to return a
+// session's GetBlocksOrdered asks for, and so holds at most.
+func SessionOrderedWindow(n int) Option {
+	return func(bs *Bitswap) {
+		bs.orderedWindow = n
 	}
 }
 
-var rebroadcastDelay = delay.Fixed(time.Minute)
+// MaxProvidersPerRequest sets the maximum number of providers desired from
+// the network for a single provider search.
+func MaxProvidersPerRequest(max int) Option {
+	return func(bs *Bitswap) {
+		bs.maxProvidersPerRequest = max
+	}
+}
+
+// ProviderQueryLimits bounds the number of searches for providers running at
+// once, and how long each search runs for. Limits that aren't positive leave
+// the defaults in place.
+func ProviderQueryLimits(maxQueries int, timeout time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.maxProviderQueries = maxQueries
+		bs.providerQueryTimeout = timeout
+	}
+}
+
+// ProviderCacheTTL sets how long the providers found for a cid are handed out
+// to later requests for it, rather than searching for them again.
+func ProviderCacheTTL(ttl time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.providerCacheTTL = ttl
+	}
+}
+
+// ProvideEnabled is an option for enabling/disabling provide announcements
+func ProvideEnabled(enabled bool) Option {
+	return func(bs *Bitswap) {
+		bs.provideEnabled = enabled
+	}
+}
+
+// ProvideQueueDatastore makes bitswap keep the blocks waiting to be provided
+// in the given datastore, so that they are still provided after a restart.
+// By default they are only kept in memory.
+func ProvideQueueDatastore(d ds.Datastore) Option {
+	return func(bs *Bitswap) {
+		bs.provideQueueDs = d
+	}
+}
+
+// Reprovide makes bitswap provide the keys returned by the given key source
+// again every interval, so that the provider records don't expire. Zero
+// intervals default to twelve hours. Nothing is reprovided by default.
+func Reprovide(keys KeyChanFunc, interval time.Duration) Option {
+	return func(bs *Bitswap) {
+		if interval <= 0 {
+			interval = defaultReprovideInterval
+		}
+		bs.reprovider = &reprovider{
+			keys:     keys,
+			interval: interval,
+			reqs:     make(chan chan error),
+		}
+	}
+}
+
+// EngineStrategy sets the strategy the decision engine uses to decide which
+// peers to serve first. Defaults to the nice strategy.
+func EngineStrategy(strategy decision.Strategy) Option {
+	return func(bs *Bitswap) {
+		bs.engineStrategy = strategy
+	}
+}
+
+// LedgerDatastore makes bitswap persist its ledgers with other peers to the
+// given datastore, so that they survive disconnects and restarts.
+func LedgerDatastore(d ds.Datastore) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.LedgerDatastore(d))
+	}
+}
+
+// LedgerRetention sets how long after the last exchange with a peer its
+// persisted ledger is kept. Zero, the default, keeps ledgers forever.
+func LedgerRetention(retention time.Duration) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.LedgerRetention(retention))
+	}
+}
+
+// PeerRequestLimits bounds what a single peer can ask of us: the size of its
+// wantlist, the rate of its wants, and the bytes of blocks queued up for it.
+// Wants exceeding the limits are dropped. Zero values mean unlimited.
+func PeerRequestLimits(limits decision.RequestLimits) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.PeerRequestLimits(limits))
+	}
+}
+
+// OnRequestLimitExceeded sets a function to be called with the wants dropped
+// from a peer for exceeding the request limits.
+func OnRequestLimitExceeded(f func(decision.LimitEvent)) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.OnLimitExceeded(f))
+	}
+}
+
+// PeerFilter restricts the peers bitswap exchanges blocks with to the ones the
+// given filter allows. Other peers are neither served blocks nor sent wants.
+func PeerFilter(f decision.PeerFilter) Option {
+	return func(bs *Bitswap) {
+		bs.peerFilter = f
+		bs.engineOptions = append(bs.engineOptions, decision.FilterPeers(f))
+	}
+}
+
+// ServePolicy makes bitswap consult the given policy before serving each
+// block to a peer.
+func ServePolicy(policy decision.ServePolicy) Option {
+	return func(bs *Bitswap) {
+		bs.engineOptions = append(bs.engineOptions, decision.FilterContent(policy))
+	}
+}
+
+// EventTracer makes bitswap emit events for its protocol-level decisions to
+// the given tracer.
+func EventTracer(t Tracer) Option {
+	return func(bs *Bitswap) {
+		bs.tracer = t
+	}
+}
+
+// GlobalBandwidthLimit caps the rate at which blocks are sent to all peers
+// combined, in bytes per second. Zero, the default, means unlimited.
+func GlobalBandwidthLimit(bytesPerSec int64) Option {
+	return func(bs *Bitswap) {
+		bs.globalBandwidthLimit = bytesPerSec
+	}
+}
+
+// PeerBandwidthLimit caps the rate at which blocks are sent to any single
+// peer, in bytes per second. Zero, the default, means unlimited.
+func PeerBandwidthLimit(bytesPerSec int64) Option {
+	return func(bs *Bitswap) {
+		bs.peerBandwidthLimit = bytesPerSec
+	}
+}
+
+// PeerMetricsLimit sets how many peers at a time get metrics of their own.
+// The metrics of the peers connected past that are added up together.
+func PeerMetricsLimit(n int) Option {
+	return func(bs *Bitswap) {
+		bs.peerMetricsLimit = n
+	}
+}
+
+// PeerScoring configures how misbehaving peers are scored, and what is done
+// to them. It defaults to DefaultScoreConfig.
+func PeerScoring(cfg ScoreConfig) Option {
+	return func(bs *Bitswap) {
+		bs.scoreConfig = cfg
+	}
+}
+
+// Clock sets the clock bitswap's and its decision engine's timers run on, so
+// that tests can drive them with a simulated clock. It defaults to the wall
+// clock.
+func Clock(c clock.Clock) Option {
+	return func(bs *Bitswap) {
+		bs.clock = c
+		bs.engineOptions = append(bs.engineOptions, decision.Clock(c))
+	}
+}
 
 // New initializes a BitSwap instance that communicates over the provided
 // BitSwapNetwork. This function registers the returned instance as the network
 // delegate.
 // Runs until context is cancelled.
 func New(parent context.Context, network bsnet.BitSwapNetwork,
-	bstore blockstore.Blockstore) exchange.Interface {
+	bstore blockstore.Blockstore, options ...Option) exchange.Interface {
 
 	// important to use provided parent context (since it may include important
 	// loggable data). It's probably not a good idea to allow bitswap to be
@@ -95,18 +357,70 @@ func New(parent context.Context, network bsnet.BitSwapNetwork,
 	bs := &Bitswap{
 		blockstore:    bstore,
 		notifications: notif,
-		engine:        decision.NewEngine(ctx, bstore), // TODO close the engine with Close() method
 		network:       network,
 		findKeys:      make(chan *blockRequest, sizeBatchRequestChan),
 		process:       px,
-		newBlocks:     make(chan cid.Cid, HasBlockBufferSize),
-		provideKeys:   make(chan cid.Cid, provideKeysBufferSize),
+		closing:       make(chan struct{}),
 		wm:            NewWantManager(ctx, network),
 		counters:      new(counters),
 
 		dupMetric: dupHist,
 		allMetric: allHist,
+
+		taskWorkerCount:        defaultTaskWorkerCount,
+		hasBlockBufferSize:     defaultHasBlockBufferSize,
+		provideKeysBufferSize:  defaultProvideKeysBufferSize,
+		provideWorkerMax:       defaultProvideWorkerMax,
+		provideBatchSize:       defaultProvideBatchSize,
+		provideBatchWindow:     defaultProvideBatchWindow,
+		rebroadcastDelay:       delay.Fixed(defaultRebroadcastDelay),
+		rebroadcastBudget:      defaultRebroadcastBudget,
+		findProviderDelay:      defaultFindProviderDelay,
+		provSearchDelay:        defaultProvSearchDelay,
+		orderedWindow:          defaultOrderedWindow,
+		maxProvidersPerRequest: defaultMaxProvidersPerRequest,
+		maxProviderQueries:     defaultMaxProviderQueries,
+		providerQueryTimeout:   providerRequestTimeout,
+		providerCacheTTL:       defaultProviderCacheTTL,
+		provideEnabled:         true,
+		engineStrategy:         decision.NewNiceStrategy(),
+		clock:                  clock.New(),
+		scoreConfig:            DefaultScoreConfig(),
+		peerMetricsLimit:       defaultPeerMetricsLimit,
+	}
+
+	if flags.LowMemMode {
+		bs.hasBlockBufferSize = lowMemHasBlockBufferSize
+		bs.provideKeysBufferSize = lowMemProvideKeysBufferSize
+		bs.provideWorkerMax = lowMemProvideWorkerMax
+	}
+
+	// apply functional options after the defaults so they take precedence
+	for _, option := range options {
+		option(bs)
 	}
+
+	if bs.tracer != nil {
+		bs.tracer = clockTracer{Tracer: bs.tracer, clock: bs.clock}
+	}
+	bs.metrics = newBitswapMetrics(ctx, bs.peerMetricsLimit)
+	bs.scores = newPeerScorer(bs.scoreConfig, bs.clock, bs.penalizePeer, bs.releasePeer)
+	bs.engineOptions = append(bs.engineOptions, decision.OnUnknownCancel(func(p peer.ID, c cid.Cid) {
+		bs.scores.record(p, UnknownCancel)
+	}))
+	bs.engine = decision.NewEngine(ctx, bstore, bs.engineStrategy, bs.engineOptions...)
+	bs.wm.peerFilter = bs.peerFilter
+	bs.wm.tracer = bs.tracer
+	bs.wm.clock = bs.clock
+	bs.rebroadcast = newRebroadcastSchedule(bs.clock, bs.rebroadcastDelay.Get(), bs.rebroadcastBudget)
+	bs.pqm = newProviderQueryManager(ctx, network, bs.clock, bs.tracer, bs.maxProviderQueries,
+		bs.maxProvidersPerRequest, bs.providerQueryTimeout, bs.providerCacheTTL)
+	bs.bwLimiter = newBandwidthLimiter(bs.clock, bs.globalBandwidthLimit, bs.peerBandwidthLimit)
+	bs.newBlocks = make(chan cid.Cid, bs.hasBlockBufferSize)
+	bs.provideKeys = make(chan cid.Cid, bs.provideKeysBufferSize)
+	bs.reprovideKeys = make(chan cid.Cid)
+	bs.provideQueue = bs.openProvideQueue()
+
 	go bs.wm.Run()
 	network.SetDelegate(bs)
 
@@ -136,6 +450,9 @@ type Bitswap struct {
 	// network delivers messages on behalf of the session
 	network bsnet.BitSwapNetwork
 
+	// bwLimiter throttles the blocks we send out
+	bwLimiter *bandwidthLimiter
+
 	// blockstore is the local database
 	// NB: ensure threadsafety
 	blockstore blockstore.Blockstore
@@ -146,15 +463,34 @@ type Bitswap struct {
 
 	// findKeys sends keys to a worker to find and connect to providers for them
 	findKeys chan *blockRequest
+	// pqm runs the searches for providers, for the worker and the sessions
+	pqm *providerQueryManager
+	// rebroadcast decides which stale wants to search for providers of
+	rebroadcast *rebroadcastSchedule
 	// newBlocks is a channel for newly added blocks to be provided to the
 	// network.  blocks pushed down this channel get buffered and fed to the
 	// provideKeys channel later on to avoid too much network activity
 	newBlocks chan cid.Cid
 	// provideKeys directly feeds provide workers
 	provideKeys chan cid.Cid
+	// provideQueue holds the new blocks until they're fed to the provide
+	// workers, and until they're provided if persisted
+	provideQueue   *provideQueue
+	provideQueueDs ds.Datastore
+	// reprovideKeys feeds the keys being reprovided to the provide workers
+	// once the new blocks are out of the way
+	reprovideKeys chan cid.Cid
+	reprovider    *reprovider
 
 	process process.Process
 
+	// closing is closed when shutdown starts, to stop accepting new wants
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// taskWorkers tracks the workers sending blocks to other peers
+	taskWorkers sync.WaitGroup
+
 	// Counters for various statistics
 	counterLk sync.Mutex
 	counters  *counters
@@ -169,6 +505,50 @@ type Bitswap struct {
 
 	sessID   uint64
 	sessIDLk sync.Mutex
+
+	// tunables, set through functional options in New
+	taskWorkerCount        int
+	hasBlockBufferSize     int
+	provideKeysBufferSize  int
+	provideWorkerMax       int
+	provideBatchSize       int
+	provideBatchWindow     time.Duration
+	rebroadcastDelay       delay.D
+	rebroadcastBudget      int
+	findProviderDelay      time.Duration
+	provSearchDelay        time.Duration
+	orderedWindow          int
+	maxProvidersPerRequest int
+	maxProviderQueries     int
+	providerQueryTimeout   time.Duration
+	providerCacheTTL       time.Duration
+	globalBandwidthLimit   int64
+	peerBandwidthLimit     int64
+
+	// whether or not to make provide announcements
+	provideEnabled bool
+
+	// the strategy the decision engine serves peers with
+	engineStrategy decision.Strategy
+	// further options to create the decision engine with
+	engineOptions []decision.Option
+
+	// peerFilter restricts which peers we exchange blocks with, if set
+	peerFilter decision.PeerFilter
+
+	// tracer receives events for protocol-level decisions, if set
+	tracer Tracer
+
+	// clock is what timers run on
+	clock clock.Clock
+
+	// scores tracks misbehaving peers
+	scores      *peerScorer
+	scoreConfig ScoreConfig
+
+	// metrics are kept per peer, for up to peerMetricsLimit peers
+	metrics          *bitswapMetrics
+	peerMetricsLimit int
 }
 
 type counters struct {
@@ -179,6 +559,10 @@ type counters struct {
 	dataSent       uint64
 	dataRecvd      uint64
 	messagesRecvd  uint64
+	throttleTime   time.Duration
+
+	provided        uint64
+	provideFailures uint64
 }
 
 type blockRequest struct {
@@ -204,6 +588,18 @@ func (bs *Bitswap) LedgerForPeer(p peer.ID) *decision.Receipt {
 	return bs.engine.LedgerForPeer(p)
 }
 
+// SetGlobalBandwidthLimit changes the rate at which blocks are sent to all
+// peers combined, in bytes per second. Zero means unlimited.
+func (bs *Bitswap) SetGlobalBandwidthLimit(bytesPerSec int64) {
+	bs.bwLimiter.setGlobalRate(bytesPerSec)
+}
+
+// SetPeerBandwidthLimit changes the rate at which blocks are sent to any
+// single peer, in bytes per second. Zero means unlimited.
+func (bs *Bitswap) SetPeerBandwidthLimit(bytesPerSec int64) {
+	bs.bwLimiter.setPeerRate(bytesPerSec)
+}
+
 // GetBlocks returns a channel where the caller may receive blocks that
 // correspond to the provided |keys|. Returns an error if BitSwap is unable to
 // begin this request within the deadline enforced by the context.
@@ -212,16 +608,66 @@ func (bs *Bitswap) LedgerForPeer(p peer.ID) *decision.Receipt {
 // resources, provide a context with a reasonably short deadline (ie. not one
 // that lasts throughout the lifetime of the server)
 func (bs *Bitswap) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks.Block, error) {
+	return bs.getBlocks(ctx, keys, nil)
+}
+
+// GetBlocksWithPriority is GetBlocks, asking for all the keys with the given
+// priority rather than in the order given. Priorities range from 0 to
+// math.MaxInt32, higher ones being served first, and can be changed later
+// with UpdatePriority. See DefaultPriority for how they compare to the
+// priorities of GetBlocks.
+func (bs *Bitswap) GetBlocksWithPriority(ctx context.Context, keys []cid.Cid, priority int) (<-chan blocks.Block, error) {
+	priority = clampPriority(priority)
+	priorities := make([]int, len(keys))
+	for i := range priorities {
+		priorities[i] = priority
+	}
+	return bs.getBlocks(ctx, keys, priorities)
+}
+
+// UpdatePriority changes the priority of the given keys, if we still want
+// them, and tells the peers we asked for them
+func (bs *Bitswap) UpdatePriority(keys []cid.Cid, priority int) {
 	if len(keys) == 0 {
-		out := make(chan blocks.Block)
-		close(out)
-		return out, nil
+		return
+	}
+	bs.wm.UpdatePriority(context.Background(), keys, clampPriority(priority))
+}
+
+func clampPriority(priority int) int {
+	if priority < 0 {
+		return 0
+	}
+	if priority > kMaxPriority {
+		return kMaxPriority
 	}
+	return priority
+}
 
+var errBitswapClosed = errors.New("bitswap is closed")
+
+// isClosing returns true once shutdown has started, after which no new wants
+// are accepted
+func (bs *Bitswap) isClosing() bool {
 	select {
+	case <-bs.closing:
+		return true
 	case <-bs.process.Closing():
-		return nil, errors.New("bitswap is closed")
+		return true
 	default:
+		return false
+	}
+}
+
+func (bs *Bitswap) getBlocks(ctx context.Context, keys []cid.Cid, priorities []int) (<-chan blocks.Block, error) {
+	if len(keys) == 0 {
+		out := make(chan blocks.Block)
+		close(out)
+		return out, nil
+	}
+
+	if bs.isClosing() {
+		return nil, errBitswapClosed
 	}
 	promise := bs.notifications.Subscribe(ctx, keys...)
 
@@ -231,7 +677,7 @@ func (bs *Bitswap) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks
 
 	mses := bs.getNextSessionID()
 
-	bs.wm.WantBlocks(ctx, keys, nil, mses)
+	bs.wm.WantBlocks(ctx, keys, nil, mses, priorities...)
 
 	remaining := cid.NewSet()
 	for _, k := range keys {
@@ -247,7 +693,7 @@ func (bs *Bitswap) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks
 			// can't just defer this call on its own, arguments are resolved *when* the defer is created
 			bs.CancelWants(remaining.Keys(), mses)
 		}()
-		findProvsDelay := time.NewTimer(findProviderDelay)
+		findProvsDelay := bs.clock.NewTimer(bs.findProviderDelay)
 		defer findProvsDelay.Stop()
 
 		findProvsDelayCh := findProvsDelay.C
@@ -348,11 +794,13 @@ func (bs *Bitswap) receiveBlockFrom(blk blocks.Block, from peer.ID) error {
 
 	bs.engine.AddBlock(blk)
 
-	select {
-	case bs.newBlocks <- blk.Cid():
-		// send block off to be reprovided
-	case <-bs.process.Closing():
-		return bs.process.Close()
+	if bs.provideEnabled {
+		select {
+		case bs.newBlocks <- blk.Cid():
+			// send block off to be reprovided
+		case <-bs.process.Closing():
+			return bs.process.Close()
+		}
 	}
 	return nil
 }
@@ -371,6 +819,21 @@ func (bs *Bitswap) SessionsForBlock(c cid.Cid) []*Session {
 	return out
 }
 
+// sessionsRecentlyInterestedIn returns the sessions that have wanted the given
+// cid, without asking them whether they still do
+func (bs *Bitswap) sessionsRecentlyInterestedIn(c cid.Cid) []*Session {
+	bs.sessLk.Lock()
+	defer bs.sessLk.Unlock()
+
+	var out []*Session
+	for _, s := range bs.sessions {
+		if s.interest.Contains(c) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) {
 	atomic.AddUint64(&bs.counters.messagesRecvd, 1)
 
@@ -380,6 +843,13 @@ func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg
 	// TODO: this is bad, and could be easily abused.
 	// Should only track *useful* messages in ledger
 
+	// let interested sessions know who has (or doesn't have) which blocks
+	for _, bp := range incoming.BlockPresences() {
+		for _, s := range bs.SessionsForBlock(bp.Cid) {
+			s.receiveBlockPresence(p, bp.Cid, bp.Type == pb.Message_Have)
+		}
+	}
+
 	iblocks := incoming.Blocks()
 
 	if len(iblocks) == 0 {
@@ -393,12 +863,34 @@ func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg
 		go func(b blocks.Block) { // TODO: this probably doesnt need to be a goroutine...
 			defer wg.Done()
 
-			bs.updateReceiveCounters(b)
+			dup := bs.updateReceiveCounters(b)
+			pm := bs.metrics.forPeer(p)
+			pm.bytesRecvd.Add(float64(len(b.RawData())))
+			if dup {
+				pm.dupBlocks.Inc()
+			}
+			traceEvent(bs.tracer, Event{
+				Type:      EventBlockReceived,
+				Peer:      p,
+				Cid:       b.Cid(),
+				Size:      len(b.RawData()),
+				Duplicate: dup,
+			})
 
 			log.Debugf("got block %s from %s", b, p)
 
-			// skip received blocks that are not in the wantlist
+			// skip received blocks that are not in the wantlist, but let the
+			// sessions that wanted them know they got a duplicate. Blocks
+			// nobody wanted count against the peer, unless they crossed our
+			// cancel.
 			if _, contains := bs.wm.wl.Contains(b.Cid()); !contains {
+				sessions := bs.sessionsRecentlyInterestedIn(b.Cid())
+				for _, s := range sessions {
+					s.receiveDuplicateFrom(p, b)
+				}
+				if !dup && len(sessions) == 0 && !bs.wm.recentlyCanceled(b.Cid()) {
+					bs.scores.record(p, UnwantedBlock)
+				}
 				return
 			}
 
@@ -413,12 +905,14 @@ func (bs *Bitswap) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg
 
 var ErrAlreadyHaveBlock = errors.New("already have block")
 
-func (bs *Bitswap) updateReceiveCounters(b blocks.Block) {
+// updateReceiveCounters counts a received block, and returns whether it was a
+// duplicate
+func (bs *Bitswap) updateReceiveCounters(b blocks.Block) bool {
 	blkLen := len(b.RawData())
 	has, err := bs.blockstore.Has(b.Cid())
 	if err != nil {
 		log.Infof("blockstore.Has error: %s", err)
-		return
+		return false
 	}
 
 	bs.allMetric.Observe(float64(blkLen))
@@ -436,28 +930,120 @@ func (bs *Bitswap) updateReceiveCounters(b blocks.Block) {
 		c.dupBlocksRecvd++
 		c.dupDataRecvd += uint64(blkLen)
 	}
+	return has
 }
 
 // Connected/Disconnected warns bitswap about peer connections
 func (bs *Bitswap) PeerConnected(p peer.ID) {
+	traceEvent(bs.tracer, Event{Type: EventPeerConnected, Peer: p})
 	bs.wm.Connected(p)
 	bs.engine.PeerConnected(p)
+	if bs.scoreConfig.Action == ScoreDisconnect && bs.scores.isPenalized(p) {
+		go bs.disconnectFrom(p)
+	}
 }
 
 // Connected/Disconnected warns bitswap about peer connections
 func (bs *Bitswap) PeerDisconnected(p peer.ID) {
+	traceEvent(bs.tracer, Event{Type: EventPeerDisconnected, Peer: p})
 	bs.wm.Disconnected(p)
 	bs.engine.PeerDisconnected(p)
+	bs.bwLimiter.removePeer(p)
+	bs.metrics.releasePeer(p)
 }
 
 func (bs *Bitswap) ReceiveError(err error) {
 	log.Infof("Bitswap ReceiveError: %s", err)
-	// TODO log the network error
+	if me, ok := err.(*bsnet.MessageError); ok {
+		if _, ok := me.Err.(*bsmsg.MalformedError); ok {
+			bs.scores.record(me.Peer, MalformedMessage)
+		}
+	}
 	// TODO bubble the network error up to the parent context/error logger
 }
 
+// PeerScore returns the score of the given peer. Peers that haven't
+// misbehaved, or not for a long while, have a score of zero.
+func (bs *Bitswap) PeerScore(p peer.ID) PeerScore {
+	return bs.scores.score(p)
+}
+
+// PeerScores returns the scores of all the peers that misbehaved recently
+func (bs *Bitswap) PeerScores() map[peer.ID]PeerScore {
+	return bs.scores.scores()
+}
+
+// ResetPeerScore forgets the misbehavior of the given peer, lifting any
+// action taken against it
+func (bs *Bitswap) ResetPeerScore(p peer.ID) {
+	bs.scores.reset(p)
+}
+
+// penalizePeer takes the configured action against a peer whose score
+// reached the threshold
+func (bs *Bitswap) penalizePeer(p peer.ID) {
+	traceEvent(bs.tracer, Event{Type: EventPeerPenalized, Peer: p})
+	switch bs.scoreConfig.Action {
+	case ScoreDeprioritize:
+		bs.engine.SetDeprioritized(p, true)
+	case ScoreDisconnect:
+		go bs.disconnectFrom(p)
+	}
+}
+
+// releasePeer lifts the action taken against a peer by penalizePeer
+func (bs *Bitswap) releasePeer(p peer.ID) {
+	traceEvent(bs.tracer, Event{Type: EventPeerReleased, Peer: p})
+	if bs.scoreConfig.Action == ScoreDeprioritize {
+		bs.engine.SetDeprioritized(p, false)
+	}
+}
+
+func (bs *Bitswap) disconnectFrom(p peer.ID) {
+	if err := bs.network.DisconnectFrom(context.Background(), p); err != nil {
+		log.Debugf("failed to disconnect from misbehaving peer %s: %s", p, err)
+	}
+}
+
+// Close shuts bitswap down right away, abandoning any sends in progress. Use
+// Shutdown to let them finish first.
 func (bs *Bitswap) Close() error {
-	return bs.process.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return bs.Shutdown(ctx)
+}
+
+// Shutdown stops bitswap in an orderly way. It stops accepting new wants,
+// sends cancels for our wantlist to all peers, and lets the blocks being sent
+// out finish sending. Whatever hasn't been sent by the time the context is
+// done is abandoned. Shutdown returns once all of bitswap's workers have
+// exited.
+func (bs *Bitswap) Shutdown(ctx context.Context) error {
+	bs.closeOnce.Do(func() {
+		close(bs.closing)
+	})
+
+	// stop preparing new envelopes, and let the task workers and message
+	// queues send out what they already hold
+	bs.engine.Close()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		bs.taskWorkers.Wait()
+		bs.wm.Shutdown()
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Info("bitswap shutdown deadline passed, abandoning sends in progress")
+	}
+
+	// closing the process cancels the context everything runs under, and
+	// waits for the workers to exit
+	err := bs.process.Close()
+	<-drained
+	return err
 }
 
 func (bs *Bitswap) GetWantlist() []cid.Cid {
@@ -3,13 +3,16 @@ package bitswap
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
 	decision "github.com/ipfs/go-bitswap/decision"
 	"github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
 	tn "github.com/ipfs/go-bitswap/testnet"
 
 	blocks "github.com/ipfs/go-block-format"
@@ -20,6 +23,7 @@ import (
 	delay "github.com/ipfs/go-ipfs-delay"
 	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
 	p2ptestutil "github.com/libp2p/go-libp2p-netutil"
+	peer "github.com/libp2p/go-libp2p-peer"
 	tu "github.com/libp2p/go-testutil"
 	travis "github.com/libp2p/go-testutil/ci/travis"
 )
@@ -68,6 +72,39 @@ func TestProviderForKeyButNetworkCannotFind(t *testing.T) { // TODO revisit this
 	}
 }
 
+func TestOptionsAreIsolated(t *testing.T) {
+	net := getVirtualNetwork()
+	sg := NewTestSessionGenerator(net)
+	defer sg.Close()
+	custom := NewTestSessionGenerator(net,
+		TaskWorkerCount(2),
+		HasBlockBufferSize(4),
+		MaxProvidersPerRequest(7),
+		ProvideEnabled(false))
+	defer custom.Close()
+
+	def := sg.Next().Exchange
+	cus := custom.Next().Exchange
+
+	if def.taskWorkerCount != defaultTaskWorkerCount || !def.provideEnabled {
+		t.Fatal("options leaked into a differently configured instance")
+	}
+	if cus.taskWorkerCount != 2 || cus.maxProvidersPerRequest != 7 {
+		t.Fatal("options were not applied")
+	}
+	if cap(cus.newBlocks) != 4 {
+		t.Fatal("expected buffer size to be set through options, got", cap(cus.newBlocks))
+	}
+
+	block := blocks.NewBlock([]byte("block"))
+	if err := cus.HasBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if len(cus.newBlocks) != 0 {
+		t.Fatal("block queued for providing with providing disabled")
+	}
+}
+
 func TestGetBlockFromPeerAfterPeerAnnounces(t *testing.T) {
 
 	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
@@ -164,15 +201,16 @@ func TestLargeFile(t *testing.T) {
 }
 
 func TestLargeFileNoRebroadcast(t *testing.T) {
-	rbd := rebroadcastDelay.Get()
-	rebroadcastDelay.Set(time.Hour * 24 * 365 * 10) // ten years should be long enough
 	if testing.Short() {
 		t.SkipNow()
 	}
 	numInstances := 10
 	numBlocks := 100
-	PerformDistributionTest(t, numInstances, numBlocks)
-	rebroadcastDelay.Set(rbd)
+	// the clock never moves, so nothing is rebroadcast, and no session ever
+	// ticks: the blocks have to get through on the first wants sent
+	clk := clock.NewMock()
+	net := tn.VirtualNetworkWithClock(mockrouting.NewServer(), delay.Fixed(0), clk)
+	performDistributionTest(t, net, numInstances, numBlocks, Clock(clk))
 }
 
 func TestLargeFileTwoPeers(t *testing.T) {
@@ -184,13 +222,18 @@ func TestLargeFileTwoPeers(t *testing.T) {
 	PerformDistributionTest(t, numInstances, numBlocks)
 }
 
-func PerformDistributionTest(t *testing.T, numInstances, numBlocks int) {
-	ctx := context.Background()
+func PerformDistributionTest(t *testing.T, numInstances, numBlocks int, bsOptions ...Option) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	performDistributionTest(t, net, numInstances, numBlocks, bsOptions...)
+}
+
+func performDistributionTest(t *testing.T, net tn.Network, numInstances, numBlocks int, bsOptions ...Option) {
 	if testing.Short() {
 		t.SkipNow()
 	}
-	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
-	sg := NewTestSessionGenerator(net)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sg := NewTestSessionGenerator(net, bsOptions...)
 	defer sg.Close()
 	bg := blocksutil.NewBlockGenerator()
 
@@ -266,13 +309,10 @@ func TestSendToWantingPeer(t *testing.T) {
 	}
 
 	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
-	sg := NewTestSessionGenerator(net)
+	sg := NewTestSessionGenerator(net, RebroadcastDelay(delay.Fixed(time.Second/2)))
 	defer sg.Close()
 	bg := blocksutil.NewBlockGenerator()
 
-	prev := rebroadcastDelay.Set(time.Second / 2)
-	defer func() { rebroadcastDelay.Set(prev) }()
-
 	peers := sg.Instances(2)
 	peerA := peers[0]
 	peerB := peers[1]
@@ -705,3 +745,334 @@ func TestBitswapLedgerTwoWay(t *testing.T) {
 		}
 	}
 }
+
+func TestPeerFilter(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net)
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	allowlist := decision.NewAllowlist()
+	filtered := NewTestSessionGenerator(net, PeerFilter(allowlist))
+	defer filtered.Close()
+	server := filtered.Next()
+	instances := sg.Instances(2)
+	friend := instances[0]
+	stranger := instances[1]
+	allowlist.Add(friend.Peer)
+	for _, inst := range instances {
+		server.Exchange.network.ConnectTo(context.Background(), inst.Peer)
+	}
+
+	blks := bg.Blocks(4)
+	for _, blk := range []blocks.Block{blks[0], blks[2], blks[3]} {
+		if err := server.Exchange.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := friend.Exchange.GetBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatal("allowed peer should have been served", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := stranger.Exchange.GetBlock(ctx, blks[2].Cid()); err == nil {
+		t.Fatal("filtered peer should not have been served")
+	}
+
+	// the allowlist can be updated at runtime
+	allowlist.Add(stranger.Peer)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := stranger.Exchange.GetBlock(ctx, blks[3].Cid()); err != nil {
+		t.Fatal("newly allowed peer should have been served", err)
+	}
+
+	// peers the server doesn't allow aren't sent its wants either
+	if err := stranger.Exchange.HasBlock(blks[1]); err != nil {
+		t.Fatal(err)
+	}
+	allowlist.Remove(stranger.Peer)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := server.Exchange.GetBlock(ctx, blks[1].Cid()); err == nil {
+		t.Fatal("should not have requested a block from a filtered peer")
+	}
+	if wl := stranger.Exchange.WantlistForPeer(server.Peer); len(wl) != 0 {
+		t.Fatal("filtered peer should not have received any wants", wl)
+	}
+}
+
+func TestShutdownCancelsWants(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net)
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(2)
+	a := instances[0]
+	b := instances[1]
+	blk := bg.Next()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := a.Exchange.GetBlocks(ctx, []cid.Cid{blk.Cid()}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		return len(b.Exchange.WantlistForPeer(a.Peer)) == 1
+	})
+	ses := a.Exchange.NewSession(ctx)
+
+	sctx, scancel := context.WithTimeout(context.Background(), time.Second)
+	defer scancel()
+	if err := a.Exchange.Shutdown(sctx); err != nil {
+		t.Fatal(err)
+	}
+	if sctx.Err() != nil {
+		t.Fatal("shutdown should have finished before the deadline")
+	}
+
+	waitFor(t, func() bool {
+		return len(b.Exchange.WantlistForPeer(a.Peer)) == 0
+	})
+	if _, err := a.Exchange.GetBlocks(ctx, []cid.Cid{blk.Cid()}); err == nil {
+		t.Fatal("should not accept new wants after shutting down")
+	}
+	if _, err := ses.GetBlocks(ctx, []cid.Cid{blk.Cid()}); err == nil {
+		t.Fatal("sessions should not accept new wants after shutting down")
+	}
+	if _, err := a.Exchange.NewSession(ctx).GetBlock(ctx, blk.Cid()); err == nil {
+		t.Fatal("new sessions should not accept wants after shutting down")
+	}
+}
+
+func TestFetchAcrossHealedPartition(t *testing.T) {
+	net := tn.ConditionedVirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net)
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(2)
+	server := instances[0]
+	client := instances[1]
+	blk := bg.Next()
+	if err := server.Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	heal := net.Partition([]peer.ID{server.Peer}, []peer.ID{client.Peer})
+	waitFor(t, func() bool {
+		return len(client.Exchange.wm.ConnectedPeers()) == 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := client.Exchange.GetBlocks(ctx, []cid.Cid{blk.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-out:
+		t.Fatal("should not get the block across the partition")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	heal()
+	select {
+	case <-out:
+	case <-ctx.Done():
+		t.Fatal("expected the want to be resent once the partition healed")
+	}
+}
+
+func TestProviderSearchOnSimulatedClock(t *testing.T) {
+	clk := clock.NewMock()
+	net := tn.VirtualNetworkWithClock(mockrouting.NewServer(), delay.Fixed(kNetworkDelay), clk)
+	sg := NewTestSessionGenerator(net, Clock(clk), ProviderSearchDelay(time.Hour))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	// not connected, so the client has to search for the server
+	server := sg.Next()
+	client := sg.Next()
+	blk := bg.Next()
+	if err := server.Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	timers := clk.Timers()
+	out, err := client.Exchange.GetBlocks(ctx, []cid.Cid{blk.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session waits on the clock for the delay to pass
+	waitFor(t, func() bool {
+		return clk.Timers() > timers
+	})
+	select {
+	case <-out:
+		t.Fatal("should not search for providers before the delay")
+	default:
+	}
+
+	clk.Add(time.Hour)
+	select {
+	case <-out:
+	case <-ctx.Done():
+		t.Fatal("expected the block to be found once the delay passed")
+	}
+}
+
+func TestPriorityUpdates(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net)
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(2)
+	server := instances[0]
+	client := instances[1]
+	blks := bg.Blocks(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	priorityAt := func(c cid.Cid) int {
+		for _, e := range server.Exchange.engine.WantlistForPeer(client.Peer) {
+			if e.Cid.Equals(c) {
+				return e.Priority
+			}
+		}
+		return -1
+	}
+
+	if _, err := client.Exchange.GetBlocksWithPriority(ctx, []cid.Cid{blks[0].Cid()}, 100); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return priorityAt(blks[0].Cid()) == 100 })
+	client.Exchange.UpdatePriority([]cid.Cid{blks[0].Cid()}, 200)
+	waitFor(t, func() bool { return priorityAt(blks[0].Cid()) == 200 })
+
+	ses := client.Exchange.NewSession(ctx).(*Session)
+	if _, err := ses.GetBlocksWithPriority(ctx, []cid.Cid{blks[1].Cid()}, 10); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return priorityAt(blks[1].Cid()) == 10 })
+	ses.UpdatePriority([]cid.Cid{blks[1].Cid()}, 5)
+	waitFor(t, func() bool { return priorityAt(blks[1].Cid()) == 5 })
+
+	// wants without a priority leave room above them for ones with one
+	if _, err := client.Exchange.GetBlocks(ctx, []cid.Cid{blks[2].Cid()}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return priorityAt(blks[2].Cid()) == DefaultPriority })
+	client.Exchange.UpdatePriority([]cid.Cid{blks[0].Cid()}, DefaultPriority+1)
+	waitFor(t, func() bool { return priorityAt(blks[0].Cid()) > priorityAt(blks[2].Cid()) })
+}
+
+func TestMisbehavingPeersScored(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, PeerScoring(ScoreConfig{
+		Penalties: map[Misbehavior]float64{UnwantedBlock: 1, MalformedMessage: 3},
+		Threshold: 5,
+		Action:    ScoreDisconnect,
+	}))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(2)
+	victim := instances[0]
+	rogue := instances[1]
+
+	// a malformed message counts against the peer that sent it
+	victim.Exchange.ReceiveError(&bsnet.MessageError{
+		Peer: rogue.Peer,
+		Err:  &message.MalformedError{Err: errors.New("bad cid")},
+	})
+	if s := victim.Exchange.PeerScore(rogue.Peer); s.Score != 3 || s.Counts[MalformedMessage] != 1 || s.Penalized {
+		t.Fatalf("unexpected score %+v", s)
+	}
+
+	// as do blocks nobody wanted
+	m := message.New(false)
+	for _, blk := range bg.Blocks(2) {
+		m.AddBlock(blk)
+	}
+	if err := rogue.Exchange.network.SendMessage(context.Background(), victim.Peer, m); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		return victim.Exchange.PeerScore(rogue.Peer).Penalized
+	})
+	if s := victim.Exchange.PeerScore(rogue.Peer); s.Counts[UnwantedBlock] != 2 {
+		t.Fatalf("expected two unwanted blocks to be counted, got %+v", s)
+	}
+	waitFor(t, func() bool {
+		for _, p := range victim.Exchange.wm.ConnectedPeers() {
+			if p == rogue.Peer {
+				return false
+			}
+		}
+		return true
+	})
+
+	victim.Exchange.ResetPeerScore(rogue.Peer)
+	if len(victim.Exchange.PeerScores()) != 0 {
+		t.Fatal("expected no scores after the reset")
+	}
+}
+
+func TestBlockCrossingCancelNotScored(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	sg := NewTestSessionGenerator(net, PeerScoring(ScoreConfig{
+		Penalties: map[Misbehavior]float64{UnwantedBlock: 1},
+		Threshold: 5,
+		Action:    ScoreDisconnect,
+	}))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(2)
+	client := instances[0]
+	server := instances[1]
+	blks := bg.Blocks(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := client.Exchange.GetBlocks(ctx, []cid.Cid{blks[0].Cid()}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(client.Exchange.GetWantlist()) == 1 })
+	cancel()
+	waitFor(t, func() bool { return len(client.Exchange.GetWantlist()) == 0 })
+
+	// the block was on its way as we canceled, the second one never wanted
+	for _, blk := range blks {
+		m := message.New(false)
+		m.AddBlock(blk)
+		if err := server.Exchange.network.SendMessage(context.Background(), client.Peer, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		return client.Exchange.PeerScore(server.Peer).Counts[UnwantedBlock] > 0
+	})
+	if s := client.Exchange.PeerScore(server.Peer); s.Counts[UnwantedBlock] != 1 {
+		t.Fatalf("expected only the block never wanted to be counted, got %+v", s)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
@@ -0,0 +1,87 @@
+// Package clock abstracts the passing of time, so that tests can run bitswap
+// and the virtual network on a simulated clock.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time, and makes timers and tickers that fire as it passes
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Until(t time.Time) time.Duration
+
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel
+	After(d time.Duration) <-chan time.Time
+	// Sleep blocks until the duration has elapsed
+	Sleep(d time.Duration)
+	// AfterFunc calls f in its own goroutine once the duration has elapsed
+	AfterFunc(d time.Duration, f func()) *Timer
+
+	NewTimer(d time.Duration) *Timer
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Timer is a time.Timer running on a Clock. C is nil for timers made by
+// AfterFunc.
+type Timer struct {
+	C <-chan time.Time
+	t timer
+}
+
+type timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Stop prevents the timer from firing. It returns false if the timer already
+// fired or was stopped.
+func (t *Timer) Stop() bool {
+	return t.t.Stop()
+}
+
+// Reset changes the timer to fire after the given duration. It returns true
+// if the timer had been active.
+func (t *Timer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+// Ticker is a time.Ticker running on a Clock
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns the ticker off
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// New returns the real, wall clock
+func New() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Until(t time.Time) time.Duration        { return time.Until(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) *Timer {
+	return &Timer{t: time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{C: t.C, t: t}
+}
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
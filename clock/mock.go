@@ -0,0 +1,238 @@
+package clock
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mock is a simulated Clock that only moves when told to. Its timers and
+// tickers fire, in order, as it's moved past them.
+type Mock struct {
+	lk     sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+	seq    int
+}
+
+// NewMock returns a Mock starting at the unix epoch, so that runs against it
+// are reproducible
+func NewMock() *Mock {
+	return &Mock{now: time.Unix(0, 0)}
+}
+
+type mockTimer struct {
+	m      *Mock
+	when   time.Time
+	period time.Duration
+	seq    int
+	active bool
+
+	c chan time.Time
+	f func()
+}
+
+// fire sends the time on the timer's channel, dropping it if the last one
+// hasn't been received yet, or calls its function
+func (t *mockTimer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+// Stop implements timer
+func (t *mockTimer) Stop() bool {
+	t.m.lk.Lock()
+	defer t.m.lk.Unlock()
+	return t.m.remove(t)
+}
+
+// Reset implements timer
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.m.lk.Lock()
+	wasActive := t.m.remove(t)
+	t.when = t.m.now.Add(d)
+	t.m.lk.Unlock()
+
+	t.m.schedule(t)
+	return wasActive
+}
+
+// Now implements Clock
+func (m *Mock) Now() time.Time {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.now
+}
+
+// Since implements Clock
+func (m *Mock) Since(t time.Time) time.Duration {
+	return m.Now().Sub(t)
+}
+
+// Until implements Clock
+func (m *Mock) Until(t time.Time) time.Duration {
+	return t.Sub(m.Now())
+}
+
+// After implements Clock
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	return m.NewTimer(d).C
+}
+
+// Sleep implements Clock. It blocks until the clock is moved past the
+// duration.
+func (m *Mock) Sleep(d time.Duration) {
+	<-m.After(d)
+}
+
+// AfterFunc implements Clock
+func (m *Mock) AfterFunc(d time.Duration, f func()) *Timer {
+	t := m.newTimer(d, 0)
+	t.f = f
+	m.schedule(t)
+	return &Timer{t: t}
+}
+
+// NewTimer implements Clock
+func (m *Mock) NewTimer(d time.Duration) *Timer {
+	t := m.newTimer(d, 0)
+	m.schedule(t)
+	return &Timer{C: t.c, t: t}
+}
+
+// NewTicker implements Clock
+func (m *Mock) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := m.newTimer(d, d)
+	m.schedule(t)
+	return &Ticker{C: t.c, stop: func() { t.Stop() }}
+}
+
+// Add moves the clock forward by the given duration, firing the timers and
+// tickers it passes in the order they are due. The clock reads the time each
+// one was due when it fires, and other goroutines get a chance to run in
+// between.
+func (m *Mock) Add(d time.Duration) {
+	m.lk.Lock()
+	end := m.now.Add(d)
+	m.lk.Unlock()
+
+	for m.fireNext(end) {
+		runtime.Gosched()
+	}
+
+	m.lk.Lock()
+	if end.After(m.now) {
+		m.now = end
+	}
+	m.lk.Unlock()
+	yield()
+}
+
+// Set moves the clock forward to the given time, as Add does. Times in the
+// past are ignored.
+func (m *Mock) Set(t time.Time) {
+	m.Add(m.Until(t))
+}
+
+// Timers returns the number of timers and tickers waiting to fire. Tests can
+// use it to wait for the goroutines they're driving to block on the clock.
+func (m *Mock) Timers() int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return len(m.timers)
+}
+
+func (m *Mock) newTimer(d, period time.Duration) *mockTimer {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return &mockTimer{
+		m:      m,
+		when:   m.now.Add(d),
+		period: period,
+		c:      make(chan time.Time, 1),
+	}
+}
+
+// schedule adds the timer to the ones waiting to fire, or fires it right
+// away if it's already due
+func (m *Mock) schedule(t *mockTimer) {
+	m.lk.Lock()
+	now := m.now
+	if t.period == 0 && !t.when.After(now) {
+		m.lk.Unlock()
+		t.fire(now)
+		return
+	}
+	m.seq++
+	t.seq = m.seq
+	t.active = true
+	m.timers = append(m.timers, t)
+	m.sortTimers()
+	m.lk.Unlock()
+}
+
+// fireNext fires the first timer due by the given time, and returns false if
+// there is none. Tickers are rescheduled for their next tick.
+func (m *Mock) fireNext(end time.Time) bool {
+	m.lk.Lock()
+	if len(m.timers) == 0 || m.timers[0].when.After(end) {
+		m.lk.Unlock()
+		return false
+	}
+	t := m.timers[0]
+	if t.when.After(m.now) {
+		m.now = t.when
+	}
+	now := m.now
+	if t.period > 0 {
+		t.when = t.when.Add(t.period)
+		m.sortTimers()
+	} else {
+		m.remove(t)
+	}
+	m.lk.Unlock()
+
+	t.fire(now)
+	return true
+}
+
+// remove takes the timer off the ones waiting to fire, and returns false if
+// it wasn't on them. m.lk must be held.
+func (m *Mock) remove(t *mockTimer) bool {
+	if !t.active {
+		return false
+	}
+	t.active = false
+	for i, ot := range m.timers {
+		if ot == t {
+			m.timers = append(m.timers[:i], m.timers[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (m *Mock) sortTimers() {
+	sort.Slice(m.timers, func(i, j int) bool {
+		a, b := m.timers[i], m.timers[j]
+		if a.when.Equal(b.when) {
+			return a.seq < b.seq
+		}
+		return a.when.Before(b.when)
+	})
+}
+
+// yield gives the goroutines woken by the clock a chance to run
+func yield() {
+	time.Sleep(time.Millisecond)
+}
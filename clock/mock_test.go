@@ -0,0 +1,122 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func expectFired(t *testing.T, c <-chan time.Time, at time.Time) {
+	t.Helper()
+	select {
+	case got := <-c:
+		if !got.Equal(at) {
+			t.Fatal("expected to fire at", at, "fired at", got)
+		}
+	default:
+		t.Fatal("expected to have fired")
+	}
+}
+
+func expectNotFired(t *testing.T, c <-chan time.Time) {
+	t.Helper()
+	select {
+	case <-c:
+		t.Fatal("fired too early")
+	default:
+	}
+}
+
+func TestMockTimers(t *testing.T) {
+	m := NewMock()
+	start := m.Now()
+
+	late := m.NewTimer(2 * time.Second)
+	early := m.NewTimer(time.Second)
+	stopped := m.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Fatal("expected stopping an active timer to return true")
+	}
+
+	m.Add(500 * time.Millisecond)
+	expectNotFired(t, early.C)
+	m.Add(time.Second)
+	expectFired(t, early.C, start.Add(time.Second))
+	expectNotFired(t, late.C)
+	expectNotFired(t, stopped.C)
+	if m.Now() != start.Add(1500*time.Millisecond) {
+		t.Fatal("expected the clock to have moved 1.5s, got", m.Since(start))
+	}
+
+	if !late.Reset(time.Second) {
+		t.Fatal("expected resetting an active timer to return true")
+	}
+	m.Add(time.Second)
+	expectFired(t, late.C, start.Add(2500*time.Millisecond))
+	if late.Stop() {
+		t.Fatal("expected stopping a fired timer to return false")
+	}
+
+	expectFired(t, m.After(0), m.Now())
+}
+
+func TestMockTicker(t *testing.T) {
+	m := NewMock()
+	start := m.Now()
+	tk := m.NewTicker(time.Second)
+
+	var ticks []time.Time
+	for i := 0; i < 3; i++ {
+		m.Add(time.Second)
+		select {
+		case at := <-tk.C:
+			ticks = append(ticks, at)
+		default:
+		}
+	}
+	if len(ticks) != 3 || !ticks[2].Equal(start.Add(3*time.Second)) {
+		t.Fatal("expected a tick every second, got", ticks)
+	}
+
+	// a tick that isn't received is dropped, not queued up
+	m.Add(time.Hour)
+	expectFired(t, tk.C, start.Add(4*time.Second))
+	expectNotFired(t, tk.C)
+
+	tk.Stop()
+	if m.Timers() != 0 {
+		t.Fatal("expected the stopped ticker to be gone")
+	}
+}
+
+func TestMockSleepAndAfterFunc(t *testing.T) {
+	m := NewMock()
+	woke := make(chan struct{})
+	go func() {
+		m.Sleep(time.Minute)
+		close(woke)
+	}()
+	called := make(chan struct{})
+	m.AfterFunc(time.Hour, func() { close(called) })
+
+	for m.Timers() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	m.Add(time.Minute)
+	select {
+	case <-woke:
+	case <-time.After(time.Second):
+		t.Fatal("expected the sleeper to wake up")
+	}
+	select {
+	case <-called:
+		t.Fatal("function called too early")
+	default:
+	}
+
+	m.Add(time.Hour)
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("expected the function to be called")
+	}
+}
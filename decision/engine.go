@@ -3,13 +3,20 @@ package decision
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	wl "github.com/ipfs/go-bitswap/wantlist"
 
+	lru "github.com/hashicorp/golang-lru"
 	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log"
 	peer "github.com/libp2p/go-libp2p-peer"
@@ -54,8 +61,13 @@ const (
 	outboxChanBuffer = 0
 	// maxMessageSize is the maximum size of the batched payload
 	maxMessageSize = 512 * 1024
+	// recentWantsSize is the number of wants remembered per partner to tell
+	// cancels for wants that were never made apart
+	recentWantsSize = 1024
 )
 
+var errEngineClosed = errors.New("engine closed")
+
 // Envelope contains a message for a Peer
 type Envelope struct {
 	// Peer is the intended recipient
@@ -69,6 +81,10 @@ type Envelope struct {
 }
 
 type Engine struct {
+	// deniedWants counts the wants the serve policy denied. It is accessed
+	// atomically, and kept first for 64-bit alignment.
+	deniedWants uint64
+
 	// peerRequestQueue is a priority queue of requests received from peers.
 	// Requests are popped from the queue, packaged up, and placed in the
 	// outbox.
@@ -91,22 +107,167 @@ type Engine struct {
 	// ledgerMap lists Ledgers by their Partner key.
 	ledgerMap map[peer.ID]*ledger
 
-	ticker *time.Ticker
+	ticker *clock.Ticker
+	clock  clock.Clock
+
+	// closing is closed by Close, to stop the engine from preparing new
+	// envelopes
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// ledgerStore persists ledgers, if a ledger datastore was given
+	ledgerStore     *ledgerStore
+	ledgerDatastore ds.Datastore
+	ledgerRetention time.Duration
+
+	// limits bound what each partner can ask of us, and limitExceeded is
+	// told about the wants dropped for exceeding them
+	limits        RequestLimits
+	limitExceeded func(LimitEvent)
+
+	// peerFilter decides which partners are served, if set
+	peerFilter PeerFilter
+
+	// servePolicy decides which blocks are served to whom, if set
+	servePolicy ServePolicy
+
+	// unknownCancel is told about cancels for wants the partner never made,
+	// if set
+	unknownCancel func(peer.ID, cid.Cid)
+}
+
+// Option configures an Engine
+type Option func(*Engine)
+
+// LedgerDatastore makes the engine persist the ledgers of its partners to the
+// given datastore, and restore them when a partner reconnects.
+func LedgerDatastore(d ds.Datastore) Option {
+	return func(e *Engine) {
+		e.ledgerDatastore = d
+	}
+}
+
+// LedgerRetention sets how long after the last exchange with a partner its
+// persisted ledger is kept. Zero, the default, keeps ledgers forever.
+func LedgerRetention(retention time.Duration) Option {
+	return func(e *Engine) {
+		e.ledgerRetention = retention
+	}
+}
+
+// PeerRequestLimits bounds the wantlist size, want rate and queued bytes of
+// each partner. Wants exceeding the limits are dropped.
+func PeerRequestLimits(limits RequestLimits) Option {
+	return func(e *Engine) {
+		e.limits = limits
+	}
 }
 
-func NewEngine(ctx context.Context, bs bstore.Blockstore) *Engine {
+// OnLimitExceeded sets a function to be called with the wants dropped from a
+// partner for exceeding the engine's request limits. It is called without any
+// of the engine's locks held.
+func OnLimitExceeded(f func(LimitEvent)) Option {
+	return func(e *Engine) {
+		e.limitExceeded = f
+	}
+}
+
+// OnUnknownCancel sets a function to be called with the cancels partners send
+// for wants they never made. It is called without any of the engine's locks
+// held.
+func OnUnknownCancel(f func(peer.ID, cid.Cid)) Option {
+	return func(e *Engine) {
+		e.unknownCancel = f
+	}
+}
+
+// FilterPeers makes the engine only serve the partners the given filter
+// allows. Wants from other partners are ignored.
+func FilterPeers(f PeerFilter) Option {
+	return func(e *Engine) {
+		e.peerFilter = f
+	}
+}
+
+// FilterContent makes the engine consult the given policy before serving
+// each block.
+func FilterContent(policy ServePolicy) Option {
+	return func(e *Engine) {
+		e.servePolicy = policy
+	}
+}
+
+// Clock sets the clock the engine's timers run on. It defaults to the wall
+// clock.
+func Clock(c clock.Clock) Option {
+	return func(e *Engine) {
+		e.clock = c
+	}
+}
+
+// NewEngine creates a decision engine that serves requests from the given
+// blockstore, ordering them as decided by the given Strategy
+func NewEngine(ctx context.Context, bs bstore.Blockstore, strategy Strategy, options ...Option) *Engine {
 	e := &Engine{
 		ledgerMap:        make(map[peer.ID]*ledger),
 		bs:               bs,
-		peerRequestQueue: newPRQ(),
+		peerRequestQueue: newPRQ(strategy),
 		outbox:           make(chan (<-chan *Envelope), outboxChanBuffer),
 		workSignal:       make(chan struct{}, 1),
-		ticker:           time.NewTicker(time.Millisecond * 100),
+		closing:          make(chan struct{}),
+		clock:            clock.New(),
 	}
+	for _, option := range options {
+		option(e)
+	}
+	e.ticker = e.clock.NewTicker(time.Millisecond * 100)
+	e.peerRequestQueue.maxQueuedBytes = e.limits.MaxQueuedBytes
+	e.peerRequestQueue.clock = e.clock
+
 	go e.taskWorker(ctx)
+	if e.ledgerDatastore != nil {
+		e.ledgerStore = newLedgerStore(e.ledgerDatastore, e.ledgerRetention, e.clock)
+		go e.ledgerWorker(ctx)
+	}
 	return e
 }
 
+// ledgerWorker periodically persists the ledgers of connected partners and
+// cleans out expired ones, and persists them one last time on shutdown.
+func (e *Engine) ledgerWorker(ctx context.Context) {
+	t := e.clock.NewTicker(ledgerFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			e.flushLedgers()
+			e.ledgerStore.sweep()
+		case <-e.closing:
+			e.flushLedgers()
+			return
+		case <-ctx.Done():
+			e.flushLedgers()
+			return
+		}
+	}
+}
+
+func (e *Engine) flushLedgers() {
+	e.lock.Lock()
+	ledgers := make([]*ledger, 0, len(e.ledgerMap))
+	for _, l := range e.ledgerMap {
+		ledgers = append(ledgers, l)
+	}
+	e.lock.Unlock()
+
+	for _, l := range ledgers {
+		l.lk.Lock()
+		li := l.info()
+		l.lk.Unlock()
+		e.ledgerStore.save(l.Partner, li)
+	}
+}
+
 func (e *Engine) WantlistForPeer(p peer.ID) (out []*wl.Entry) {
 	partner := e.findOrCreate(p)
 	partner.lk.Lock()
@@ -131,11 +292,14 @@ func (e *Engine) LedgerForPeer(p peer.ID) *Receipt {
 
 func (e *Engine) taskWorker(ctx context.Context) {
 	defer close(e.outbox) // because taskWorker uses the channel exclusively
+	defer e.ticker.Stop()
 	for {
 		oneTimeUse := make(chan *Envelope, 1) // buffer to prevent blocking
 		select {
 		case <-ctx.Done():
 			return
+		case <-e.closing:
+			return
 		case e.outbox <- oneTimeUse:
 		}
 		// receiver is ready for an outoing envelope. let's prepare one. first,
@@ -159,6 +323,8 @@ func (e *Engine) nextEnvelope(ctx context.Context) (*Envelope, error) {
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
+			case <-e.closing:
+				return nil, errEngineClosed
 			case <-e.workSignal:
 				nextTask = e.peerRequestQueue.Pop()
 			case <-e.ticker.C:
@@ -167,11 +333,44 @@ func (e *Engine) nextEnvelope(ctx context.Context) (*Envelope, error) {
 			}
 		}
 
+		// the partner may have been filtered out since the task was queued
+		if !e.allowed(nextTask.Target) {
+			nextTask.Done(nextTask.Entries)
+			continue
+		}
+
 		// with a task in hand, we're ready to prepare the envelope...
 		msg := bsmsg.New(true)
 		for _, entry := range nextTask.Entries {
+			if e.servePolicy != nil && !e.servePolicy.AllowServe(nextTask.Target, entry.Cid) {
+				log.Debugf("serve policy denied %s to %s", entry.Cid, nextTask.Target)
+				atomic.AddUint64(&e.deniedWants, 1)
+				if entry.SendDontHave {
+					msg.AddDontHave(entry.Cid)
+				}
+				continue
+			}
+
+			if entry.WantType == pb.Message_Wantlist_Have {
+				has, err := e.bs.Has(entry.Cid)
+				if err != nil {
+					log.Errorf("tried to execute a task and errored checking for block: %s", err)
+					continue
+				}
+				if has {
+					msg.AddHave(entry.Cid)
+				} else if entry.SendDontHave {
+					msg.AddDontHave(entry.Cid)
+				}
+				continue
+			}
+
 			block, err := e.bs.Get(entry.Cid)
 			if err != nil {
+				if err == bstore.ErrNotFound && entry.SendDontHave {
+					msg.AddDontHave(entry.Cid)
+					continue
+				}
 				log.Errorf("tried to execute a task and errored fetching block: %s", err)
 				continue
 			}
@@ -201,11 +400,49 @@ func (e *Engine) nextEnvelope(ctx context.Context) (*Envelope, error) {
 	}
 }
 
+// DeniedWants returns the number of wants the serve policy has denied
+func (e *Engine) DeniedWants() uint64 {
+	return atomic.LoadUint64(&e.deniedWants)
+}
+
+// Close stops the engine from preparing any more envelopes, closes the outbox
+// and stops the engine's ticker. Envelopes already taken from the outbox can
+// still be sent.
+func (e *Engine) Close() {
+	e.closeOnce.Do(func() {
+		close(e.closing)
+	})
+}
+
 // Outbox returns a channel of one-time use Envelope channels.
 func (e *Engine) Outbox() <-chan (<-chan *Envelope) {
 	return e.outbox
 }
 
+// WantlistSizes returns the number of wants in each partner's wantlist
+func (e *Engine) WantlistSizes() map[peer.ID]int {
+	e.lock.Lock()
+	ledgers := make([]*ledger, 0, len(e.ledgerMap))
+	for _, l := range e.ledgerMap {
+		ledgers = append(ledgers, l)
+	}
+	e.lock.Unlock()
+
+	sizes := make(map[peer.ID]int, len(ledgers))
+	for _, l := range ledgers {
+		l.lk.Lock()
+		sizes[l.Partner] = l.wantList.Len()
+		l.lk.Unlock()
+	}
+	return sizes
+}
+
+// QueuedRequests returns the number of blocks and block presences waiting
+// in the peer request queue to be sent
+func (e *Engine) QueuedRequests() int {
+	return e.peerRequestQueue.queued()
+}
+
 // Returns a slice of Peers with whom the local node has active sessions
 func (e *Engine) Peers() []peer.ID {
 	e.lock.Lock()
@@ -227,10 +464,16 @@ func (e *Engine) MessageReceived(p peer.ID, m bsmsg.BitSwapMessage) error {
 	}
 
 	newWorkExists := false
+	dropped := &limitEvents{p: p}
+	var unknownCancels []cid.Cid
 	defer func() {
 		if newWorkExists {
 			e.signalNewWork()
 		}
+		e.reportDropped(dropped)
+		for _, c := range unknownCancels {
+			e.unknownCancel(p, c)
+		}
 	}()
 
 	l := e.findOrCreate(p)
@@ -239,54 +482,115 @@ func (e *Engine) MessageReceived(p peer.ID, m bsmsg.BitSwapMessage) error {
 	if m.Full() {
 		l.wantList = wl.New()
 	}
+	if e.unknownCancel != nil && l.recentWants == nil {
+		l.recentWants, _ = lru.New(recentWantsSize)
+	}
+
+	push := func(entries []*wl.Entry) {
+		for _, entry := range e.peerRequestQueue.Push(p, entries...) {
+			l.CancelWant(entry.Cid)
+			dropped.drop(QueuedBytesLimit, entry.Cid)
+		}
+	}
 
 	var msgSize int
 	var activeEntries []*wl.Entry
-	for _, entry := range m.Wantlist() {
+	now := e.clock.Now()
+	wants := m.Wantlist()
+	if !e.allowed(p) {
+		log.Debugf("ignoring wants from filtered peer %s", p)
+		wants = nil
+	}
+	for _, entry := range wants {
 		if entry.Cancel {
 			log.Debugf("%s cancel %s", p, entry.Cid)
+			if l.recentWants != nil && !l.recentWants.Contains(entry.Cid) {
+				if _, ok := l.WantListContains(entry.Cid); !ok {
+					unknownCancels = append(unknownCancels, entry.Cid)
+				}
+			}
 			l.CancelWant(entry.Cid)
 			e.peerRequestQueue.Remove(entry.Cid, p)
 		} else {
 			log.Debugf("wants %s - %d", entry.Cid, entry.Priority)
-			l.Wants(entry.Cid, entry.Priority)
+			if l.recentWants != nil {
+				l.recentWants.Add(entry.Cid, nil)
+			}
+			if _, ok := l.WantListContains(entry.Cid); !ok {
+				if e.limits.MaxWantlistSize > 0 && l.wantList.Len() >= e.limits.MaxWantlistSize {
+					dropped.drop(WantlistSizeLimit, entry.Cid)
+					continue
+				}
+				if !l.takeWant(e.limits, now) {
+					dropped.drop(WantRateLimit, entry.Cid)
+					continue
+				}
+			}
+			l.Wants(entry.Cid, entry.Priority, entry.WantType)
 			blockSize, err := e.bs.GetSize(entry.Cid)
 			if err != nil {
 				if err == bstore.ErrNotFound {
+					if entry.SendDontHave {
+						// queue up a DONT_HAVE response
+						newWorkExists = true
+						activeEntries = append(activeEntries, entry.Entry)
+					}
 					continue
 				}
 				log.Error(err)
+			} else if entry.WantType == pb.Message_Wantlist_Have {
+				// we have the block, but only need to say so
+				newWorkExists = true
+				activeEntries = append(activeEntries, entry.Entry)
 			} else {
 				// we have the block
 				newWorkExists = true
 				if msgSize+blockSize > maxMessageSize {
-					e.peerRequestQueue.Push(p, activeEntries...)
+					push(activeEntries)
 					activeEntries = []*wl.Entry{}
 					msgSize = 0
 				}
+				entry.Size = blockSize
 				activeEntries = append(activeEntries, entry.Entry)
 				msgSize += blockSize
 			}
 		}
 	}
 	if len(activeEntries) > 0 {
-		e.peerRequestQueue.Push(p, activeEntries...)
+		push(activeEntries)
 	}
 	for _, block := range m.Blocks() {
 		log.Debugf("got block %s %d bytes", block, len(block.RawData()))
 		l.ReceivedBytes(len(block.RawData()))
 	}
+	e.peerRequestQueue.updateLedger(p, l.info())
 	return nil
 }
 
-func (e *Engine) addBlock(block blocks.Block) {
+func (e *Engine) addBlock(block blocks.Block) []*limitEvents {
 	work := false
+	var dropped []*limitEvents
 
 	for _, l := range e.ledgerMap {
+		if !e.allowed(l.Partner) {
+			continue
+		}
 		l.lk.Lock()
 		if entry, ok := l.WantListContains(block.Cid()); ok {
-			e.peerRequestQueue.Push(l.Partner, entry)
-			work = true
+			if entry.WantType == pb.Message_Wantlist_Block {
+				// the entry may already be queued, so size a copy
+				sized := *entry
+				sized.Size = len(block.RawData())
+				entry = &sized
+			}
+			if len(e.peerRequestQueue.Push(l.Partner, entry)) > 0 {
+				l.CancelWant(entry.Cid)
+				le := &limitEvents{p: l.Partner}
+				le.drop(QueuedBytesLimit, entry.Cid)
+				dropped = append(dropped, le)
+			} else {
+				work = true
+			}
 		}
 		l.lk.Unlock()
 	}
@@ -294,13 +598,28 @@ func (e *Engine) addBlock(block blocks.Block) {
 	if work {
 		e.signalNewWork()
 	}
+	return dropped
 }
 
 func (e *Engine) AddBlock(block blocks.Block) {
 	e.lock.Lock()
-	defer e.lock.Unlock()
+	dropped := e.addBlock(block)
+	e.lock.Unlock()
 
-	e.addBlock(block)
+	for _, le := range dropped {
+		e.reportDropped(le)
+	}
+}
+
+// reportDropped logs the wants dropped for exceeding the request limits, and
+// passes them on to the limitExceeded callback
+func (e *Engine) reportDropped(le *limitEvents) {
+	for _, ev := range le.events {
+		log.Infof("dropped %d wants from %s exceeding the %s limit", len(ev.Dropped), ev.Peer, ev.Limit)
+		if e.limitExceeded != nil {
+			e.limitExceeded(*ev)
+		}
+	}
 }
 
 // TODO add contents of m.WantList() to my local wantlist? NB: could introduce
@@ -309,6 +628,31 @@ func (e *Engine) AddBlock(block blocks.Block) {
 // inconsistent. Would need to ensure that Sends and acknowledgement of the
 // send happen atomically
 
+// HoldPeer stops the engine from preparing envelopes for the partner for the
+// given duration, such as while sends to it are throttled, so that the task
+// workers serve other partners in the meantime
+func (e *Engine) HoldPeer(p peer.ID, d time.Duration) {
+	until := e.clock.Now().Add(d)
+	if !e.peerRequestQueue.hold(p, until) {
+		return
+	}
+	e.clock.AfterFunc(d, func() {
+		if !e.peerRequestQueue.release(p, until) {
+			return
+		}
+		select {
+		case e.workSignal <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// SetDeprioritized sets whether the partner is served after all others,
+// whatever the engine's strategy
+func (e *Engine) SetDeprioritized(p peer.ID, deprioritized bool) {
+	e.peerRequestQueue.setDeprioritized(p, deprioritized)
+}
+
 func (e *Engine) MessageSent(p peer.ID, m bsmsg.BitSwapMessage) error {
 	l := e.findOrCreate(p)
 	l.lk.Lock()
@@ -320,6 +664,15 @@ func (e *Engine) MessageSent(p peer.ID, m bsmsg.BitSwapMessage) error {
 		e.peerRequestQueue.Remove(block.Cid(), p)
 	}
 
+	// a HAVE fully answers a want-have. DONT_HAVEs leave the want in place,
+	// so that the peer hears from us if we get the block later on
+	for _, c := range m.Haves() {
+		if entry, ok := l.WantListContains(c); ok && entry.WantType == pb.Message_Wantlist_Have {
+			l.wantList.Remove(c)
+		}
+	}
+	e.peerRequestQueue.updateLedger(p, l.info())
+
 	return nil
 }
 
@@ -328,7 +681,7 @@ func (e *Engine) PeerConnected(p peer.ID) {
 	defer e.lock.Unlock()
 	l, ok := e.ledgerMap[p]
 	if !ok {
-		l = newLedger(p)
+		l = e.loadLedger(p)
 		e.ledgerMap[p] = l
 	}
 	l.lk.Lock()
@@ -338,17 +691,24 @@ func (e *Engine) PeerConnected(p peer.ID) {
 
 func (e *Engine) PeerDisconnected(p peer.ID) {
 	e.lock.Lock()
-	defer e.lock.Unlock()
 	l, ok := e.ledgerMap[p]
 	if !ok {
+		e.lock.Unlock()
 		return
 	}
 	l.lk.Lock()
-	defer l.lk.Unlock()
 	l.ref--
-	if l.ref <= 0 {
+	gone := l.ref <= 0
+	if gone {
 		delete(e.ledgerMap, p)
 	}
+	li := l.info()
+	l.lk.Unlock()
+	e.lock.Unlock()
+
+	if gone && e.ledgerStore != nil {
+		e.ledgerStore.save(p, li)
+	}
 }
 
 func (e *Engine) numBytesSentTo(p peer.ID) uint64 {
@@ -367,12 +727,31 @@ func (e *Engine) findOrCreate(p peer.ID) *ledger {
 	defer e.lock.Unlock()
 	l, ok := e.ledgerMap[p]
 	if !ok {
-		l = newLedger(p)
+		l = e.loadLedger(p)
 		e.ledgerMap[p] = l
 	}
 	return l
 }
 
+// loadLedger creates a ledger for the given peer, restoring its accounting
+// from the ledger store if it was persisted before. e.lock must be held.
+func (e *Engine) loadLedger(p peer.ID) *ledger {
+	l := newLedger(p, e.clock)
+	if e.ledgerStore == nil {
+		return l
+	}
+	if li, ok := e.ledgerStore.load(p); ok {
+		l.restore(li)
+		e.peerRequestQueue.updateLedger(p, li)
+	}
+	return l
+}
+
+// allowed returns true if the peer filter allows serving the given partner
+func (e *Engine) allowed(p peer.ID) bool {
+	return e.peerFilter == nil || e.peerFilter.AllowPeer(p)
+}
+
 func (e *Engine) signalNewWork() {
 	// Signal task generation to restart (if stopped!)
 	select {
@@ -7,15 +7,19 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	message "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 
 	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	peer "github.com/libp2p/go-libp2p-peer"
 	testutil "github.com/libp2p/go-testutil"
+	mh "github.com/multiformats/go-multihash"
 )
 
 type peerAndEngine struct {
@@ -28,7 +32,7 @@ func newEngine(ctx context.Context, idStr string) peerAndEngine {
 		Peer: peer.ID(idStr),
 		//Strategy: New(true),
 		Engine: NewEngine(ctx,
-			blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))),
+			blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), NewNiceStrategy()),
 	}
 }
 
@@ -106,8 +110,7 @@ func peerIsPartner(p peer.ID, e *Engine) bool {
 }
 
 func TestOutboxClosedWhenEngineClosed(t *testing.T) {
-	t.SkipNow() // TODO implement *Engine.Close
-	e := NewEngine(context.Background(), blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())))
+	e := NewEngine(context.Background(), blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), NewNiceStrategy())
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -116,7 +119,7 @@ func TestOutboxClosedWhenEngineClosed(t *testing.T) {
 		}
 		wg.Done()
 	}()
-	// e.Close()
+	e.Close()
 	wg.Wait()
 	if _, ok := <-e.Outbox(); ok {
 		t.Fatal("channel should be closed")
@@ -164,7 +167,7 @@ func TestPartnerWantsThenCancels(t *testing.T) {
 
 	for i := 0; i < numRounds; i++ {
 		expected := make([][]string, 0, len(testcases))
-		e := NewEngine(context.Background(), bs)
+		e := NewEngine(context.Background(), bs, NewNiceStrategy())
 		for _, testcase := range testcases {
 			set := testcase[0]
 			cancels := testcase[1]
@@ -183,6 +186,223 @@ func TestPartnerWantsThenCancels(t *testing.T) {
 	}
 }
 
+func TestPartnerWantHaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	have := blocks.NewBlock([]byte("have"))
+	if err := bs.Put(have); err != nil {
+		t.Fatal(err)
+	}
+	missing := blocks.NewBlock([]byte("missing"))
+	silent := blocks.NewBlock([]byte("silent"))
+
+	e := NewEngine(ctx, bs, NewNiceStrategy())
+	partner := testutil.RandPeerIDFatal(t)
+
+	m := message.New(false)
+	m.AddEntryWithType(have.Cid(), 3, pb.Message_Wantlist_Have, true)
+	m.AddEntryWithType(missing.Cid(), 2, pb.Message_Wantlist_Block, true)
+	m.AddEntryWithType(silent.Cid(), 1, pb.Message_Wantlist_Have, false)
+	e.MessageReceived(partner, m)
+
+	next := <-e.Outbox()
+	envelope := <-next
+	if len(envelope.Message.Blocks()) != 0 {
+		t.Fatal("should only have responded with block presences")
+	}
+	if haves := envelope.Message.Haves(); len(haves) != 1 || !haves[0].Equals(have.Cid()) {
+		t.Fatal("expected a HAVE for the block we have")
+	}
+	if dontHaves := envelope.Message.DontHaves(); len(dontHaves) != 1 || !dontHaves[0].Equals(missing.Cid()) {
+		t.Fatal("expected a DONT_HAVE only for the block requested with send-dont-have")
+	}
+
+	e.MessageSent(partner, envelope.Message)
+	envelope.Sent()
+	if _, ok := e.findOrCreate(partner).WantListContains(have.Cid()); ok {
+		t.Fatal("answered want-have should have been removed from the ledger")
+	}
+	if _, ok := e.findOrCreate(partner).WantListContains(missing.Cid()); !ok {
+		t.Fatal("want-block should remain in the ledger after a DONT_HAVE")
+	}
+}
+
+func TestLedgerPersistsAcrossReconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	lds := dssync.MutexWrap(ds.NewMapDatastore())
+	partner := testutil.RandPeerIDFatal(t)
+
+	e := NewEngine(ctx, bs, NewNiceStrategy(), LedgerDatastore(lds))
+	e.PeerConnected(partner)
+	m := message.New(false)
+	m.AddBlock(blocks.NewBlock([]byte("reciprocity")))
+	e.MessageReceived(partner, m)
+	e.PeerDisconnected(partner)
+
+	// a fresh engine, as after a restart, should pick the ledger back up
+	restarted := NewEngine(ctx, bs, NewNiceStrategy(), LedgerDatastore(lds))
+	restarted.PeerConnected(partner)
+	receipt := restarted.LedgerForPeer(partner)
+	if receipt.Recv != uint64(len("reciprocity")) || receipt.Exchanged != 1 {
+		t.Fatal("ledger was not restored", receipt)
+	}
+
+	// with a retention shorter than the time since the last exchange, the
+	// persisted ledger is dropped instead
+	expiring := NewEngine(ctx, bs, NewNiceStrategy(), LedgerDatastore(lds), LedgerRetention(time.Nanosecond))
+	expiring.PeerConnected(partner)
+	if receipt := expiring.LedgerForPeer(partner); receipt.Recv != 0 {
+		t.Fatal("expired ledger should not have been restored", receipt)
+	}
+}
+
+func TestRequestLimitsDropExcessWants(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	keys := strings.Split("abcdef", "")
+	for _, letter := range keys {
+		if err := bs.Put(blocks.NewBlock([]byte(letter))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		limits RequestLimits
+		limit  Limit
+	}{
+		{RequestLimits{MaxWantlistSize: 4}, WantlistSizeLimit},
+		{RequestLimits{MaxWantRate: 1, MaxWantBurst: 4}, WantRateLimit},
+		{RequestLimits{MaxQueuedBytes: 4}, QueuedBytesLimit},
+	}
+	for _, tc := range testCases {
+		var events []LimitEvent
+		e := NewEngine(ctx, bs, NewNiceStrategy(), PeerRequestLimits(tc.limits), OnLimitExceeded(func(ev LimitEvent) {
+			events = append(events, ev)
+		}))
+		partner := testutil.RandPeerIDFatal(t)
+		partnerWants(e, keys, partner)
+
+		if len(events) != 1 || events[0].Limit != tc.limit || events[0].Peer != partner {
+			t.Fatalf("expected a single %s event, got %v", tc.limit, events)
+		}
+		if len(events[0].Dropped) != 2 {
+			t.Fatalf("expected the %s limit to drop 2 wants, dropped %d", tc.limit, len(events[0].Dropped))
+		}
+		if n := len(e.WantlistForPeer(partner)); n != 4 {
+			t.Fatalf("expected dropped wants to stay out of the wantlist, got %d entries with the %s limit", n, tc.limit)
+		}
+	}
+}
+
+func TestRequestLimitsLetThroughWhatFits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	big := blocks.NewBlock([]byte("a block bigger than the limit"))
+	if err := bs.Put(big); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		limits RequestLimits
+	}{
+		// a block larger than the queue limit still gets into an empty queue
+		{"oversized block", RequestLimits{MaxQueuedBytes: 4}},
+		// a rate under a want a second still lets wants through
+		{"slow want rate", RequestLimits{MaxWantRate: 0.5}},
+	}
+	for _, tc := range testCases {
+		var events []LimitEvent
+		e := NewEngine(ctx, bs, NewNiceStrategy(), PeerRequestLimits(tc.limits), OnLimitExceeded(func(ev LimitEvent) {
+			events = append(events, ev)
+		}))
+		partner := testutil.RandPeerIDFatal(t)
+
+		m := message.New(false)
+		m.AddEntry(big.Cid(), 1)
+		e.MessageReceived(partner, m)
+		if len(events) != 0 {
+			t.Fatalf("%s: expected the want to be let through, got %v", tc.name, events)
+		}
+		if n := len(e.WantlistForPeer(partner)); n != 1 {
+			t.Fatalf("%s: expected the want in the wantlist, got %d entries", tc.name, n)
+		}
+	}
+}
+
+func TestServePolicyDeniesBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	allowed := blocks.NewBlock([]byte("allowed"))
+	denied := blocks.NewBlock([]byte("denied"))
+	for _, b := range []blocks.Block{allowed, denied} {
+		if err := bs.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ReadDenyList(strings.NewReader("not a cid\n")); err == nil {
+		t.Fatal("expected an error reading an invalid deny list")
+	}
+	dl, err := ReadDenyList(strings.NewReader("# blocks we won't serve\n\n" + denied.Cid().String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Len() != 1 {
+		t.Fatal("expected one block on the deny list, got", dl.Len())
+	}
+
+	e := NewEngine(ctx, bs, NewNiceStrategy(), FilterContent(dl))
+	partner := testutil.RandPeerIDFatal(t)
+	m := message.New(false)
+	m.AddEntryWithType(allowed.Cid(), 2, pb.Message_Wantlist_Block, true)
+	m.AddEntryWithType(denied.Cid(), 1, pb.Message_Wantlist_Block, true)
+	e.MessageReceived(partner, m)
+
+	next := <-e.Outbox()
+	envelope := <-next
+	if blks := envelope.Message.Blocks(); len(blks) != 1 || !blks[0].Cid().Equals(allowed.Cid()) {
+		t.Fatal("expected only the allowed block to be served")
+	}
+	if dontHaves := envelope.Message.DontHaves(); len(dontHaves) != 1 || !dontHaves[0].Equals(denied.Cid()) {
+		t.Fatal("expected a DONT_HAVE for the denied block")
+	}
+	if n := e.DeniedWants(); n != 1 {
+		t.Fatal("expected one denied want to be counted, got", n)
+	}
+}
+
+func TestDenyListOfMultihashes(t *testing.T) {
+	digest := make([]byte, 64)
+	copy(digest, "not a sha2-256 digest")
+	h, err := mh.Encode(digest, mh.SHA2_512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cid.NewCidV1(cid.Raw, h)
+
+	for _, line := range []string{mh.Multihash(h).B58String(), mh.Multihash(h).HexString()} {
+		dl, err := ReadDenyList(strings.NewReader(line + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dl.AllowServe(testutil.RandPeerIDFatal(t), c) {
+			t.Fatalf("expected the block listed as %s to be denied", line)
+		}
+	}
+}
+
 func partnerWants(e *Engine, keys []string, partner peer.ID) {
 	add := message.New(false)
 	for i, letter := range keys {
@@ -241,3 +461,40 @@ func stringsComplement(set, subset []string) []string {
 	}
 	return complement
 }
+
+func TestUnknownCancelsReported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	var unknown []cid.Cid
+	e := NewEngine(ctx, bs, NewNiceStrategy(), OnUnknownCancel(func(p peer.ID, c cid.Cid) {
+		unknown = append(unknown, c)
+	}))
+	partner := testutil.RandPeerIDFatal(t)
+
+	partnerWants(e, []string{"a", "b"}, partner)
+	partnerCancels(e, []string{"a"}, partner)
+	if len(unknown) != 0 {
+		t.Fatal("expected the cancel of a want made not to be reported")
+	}
+	// wants no longer in the wantlist were made all the same
+	partnerCancels(e, []string{"a", "c"}, partner)
+	if len(unknown) != 1 || !unknown[0].Equals(blocks.NewBlock([]byte("c")).Cid()) {
+		t.Fatal("expected only the cancel of the want never made to be reported, got", unknown)
+	}
+
+	// wants made by other partners don't push out the partner's own
+	other := testutil.RandPeerIDFatal(t)
+	var many []string
+	for i := 0; i < recentWantsSize+1; i++ {
+		many = append(many, fmt.Sprint(i))
+	}
+	partnerWants(e, many, other)
+	unknown = nil
+	partnerCancels(e, []string{"b"}, partner)
+	partnerCancels(e, []string{"a"}, partner)
+	if len(unknown) != 0 {
+		t.Fatal("expected cancels of wants made not to be reported, got", unknown)
+	}
+}
@@ -4,17 +4,21 @@ import (
 	"sync"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	wl "github.com/ipfs/go-bitswap/wantlist"
 
+	lru "github.com/hashicorp/golang-lru"
 	cid "github.com/ipfs/go-cid"
 	peer "github.com/libp2p/go-libp2p-peer"
 )
 
-func newLedger(p peer.ID) *ledger {
+func newLedger(p peer.ID, clk clock.Clock) *ledger {
 	return &ledger{
 		wantList:   wl.New(),
 		Partner:    p,
 		sentToPeer: make(map[string]time.Time),
+		clock:      clk,
 	}
 }
 
@@ -29,6 +33,7 @@ type ledger struct {
 
 	// lastExchange is the time of the last data exchange.
 	lastExchange time.Time
+	clock        clock.Clock
 
 	// exchangeCount is the number of exchanges with this peer
 	exchangeCount uint64
@@ -40,6 +45,15 @@ type ledger struct {
 	// to a given peer
 	sentToPeer map[string]time.Time
 
+	// wantTokens is how many new wants the partner may still send, as of
+	// wantTokensAt, under the engine's want rate limit
+	wantTokens   float64
+	wantTokensAt time.Time
+
+	// recentWants remembers the wants the partner made recently, which may
+	// since have been served or dropped, if the engine reports unknown cancels
+	recentWants *lru.Cache
+
 	// ref is the reference count for this ledger, its used to ensure we
 	// don't drop the reference to this ledger in multi-connection scenarios
 	ref int
@@ -66,19 +80,22 @@ func (dr *debtRatio) Value() float64 {
 
 func (l *ledger) SentBytes(n int) {
 	l.exchangeCount++
-	l.lastExchange = time.Now()
+	l.lastExchange = l.clock.Now()
 	l.Accounting.BytesSent += uint64(n)
 }
 
 func (l *ledger) ReceivedBytes(n int) {
 	l.exchangeCount++
-	l.lastExchange = time.Now()
+	l.lastExchange = l.clock.Now()
 	l.Accounting.BytesRecv += uint64(n)
 }
 
-func (l *ledger) Wants(k cid.Cid, priority int) {
+func (l *ledger) Wants(k cid.Cid, priority int, wantType pb.Message_Wantlist_WantType) {
 	log.Debugf("peer %s wants %s", l.Partner, k)
-	l.wantList.Add(k, priority)
+	if !l.wantList.AddTyped(k, priority, wantType) {
+		// the partner may have raised or lowered its priority
+		l.wantList.SetPriority(k, priority)
+	}
 }
 
 func (l *ledger) CancelWant(k cid.Cid) {
@@ -92,3 +109,21 @@ func (l *ledger) WantListContains(k cid.Cid) (*wl.Entry, bool) {
 func (l *ledger) ExchangeCount() uint64 {
 	return l.exchangeCount
 }
+
+// restore sets the ledger's accounting to that of a persisted ledger
+func (l *ledger) restore(li LedgerInfo) {
+	l.Accounting.BytesSent = li.BytesSent
+	l.Accounting.BytesRecv = li.BytesRecv
+	l.exchangeCount = li.ExchangeCount
+	l.lastExchange = li.LastExchange
+}
+
+// info returns a snapshot of the ledger for strategies to work with
+func (l *ledger) info() LedgerInfo {
+	return LedgerInfo{
+		BytesSent:     l.Accounting.BytesSent,
+		BytesRecv:     l.Accounting.BytesRecv,
+		ExchangeCount: l.exchangeCount,
+		LastExchange:  l.lastExchange,
+	}
+}
@@ -0,0 +1,115 @@
+package decision
+
+import (
+	"encoding/json"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ledgerFlushInterval is how often the ledgers of connected peers are written
+// out to the ledger datastore
+const ledgerFlushInterval = time.Minute
+
+var ledgerPrefix = ds.NewKey("/ledgers")
+
+// ledgerStore persists ledgers in a datastore, so that reciprocity survives
+// disconnects and restarts
+type ledgerStore struct {
+	ds ds.Datastore
+
+	// retention is how long after the last exchange with a peer its ledger
+	// is kept. Zero keeps ledgers forever.
+	retention time.Duration
+	clock     clock.Clock
+}
+
+func newLedgerStore(d ds.Datastore, retention time.Duration, clk clock.Clock) *ledgerStore {
+	return &ledgerStore{
+		ds:        d,
+		retention: retention,
+		clock:     clk,
+	}
+}
+
+func ledgerKey(p peer.ID) ds.Key {
+	return ledgerPrefix.ChildString(p.Pretty())
+}
+
+func (ls *ledgerStore) expired(li LedgerInfo) bool {
+	return ls.retention > 0 && ls.clock.Since(li.LastExchange) > ls.retention
+}
+
+// load returns the persisted ledger for the given peer, if there is one that
+// hasn't expired yet
+func (ls *ledgerStore) load(p peer.ID) (LedgerInfo, bool) {
+	var li LedgerInfo
+	data, err := ls.ds.Get(ledgerKey(p))
+	if err != nil {
+		if err != ds.ErrNotFound {
+			log.Warningf("error loading ledger for %s: %s", p, err)
+		}
+		return li, false
+	}
+
+	if err := json.Unmarshal(data, &li); err != nil {
+		log.Warningf("error decoding ledger for %s: %s", p, err)
+		return li, false
+	}
+
+	if ls.expired(li) {
+		if err := ls.ds.Delete(ledgerKey(p)); err != nil {
+			log.Warningf("error deleting expired ledger for %s: %s", p, err)
+		}
+		return li, false
+	}
+	return li, true
+}
+
+// save persists the given ledger. Ledgers without any exchange are not worth
+// keeping and are skipped.
+func (ls *ledgerStore) save(p peer.ID, li LedgerInfo) {
+	if li.ExchangeCount == 0 {
+		return
+	}
+
+	data, err := json.Marshal(li)
+	if err != nil {
+		log.Warningf("error encoding ledger for %s: %s", p, err)
+		return
+	}
+	if err := ls.ds.Put(ledgerKey(p), data); err != nil {
+		log.Warningf("error saving ledger for %s: %s", p, err)
+	}
+}
+
+// sweep deletes all expired ledgers from the datastore
+func (ls *ledgerStore) sweep() {
+	if ls.retention == 0 {
+		return
+	}
+
+	res, err := ls.ds.Query(dsq.Query{Prefix: ledgerPrefix.String()})
+	if err != nil {
+		log.Warningf("error querying ledgers: %s", err)
+		return
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		log.Warningf("error querying ledgers: %s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		var li LedgerInfo
+		if err := json.Unmarshal(entry.Value, &li); err != nil || ls.expired(li) {
+			if err := ls.ds.Delete(ds.NewKey(entry.Key)); err != nil {
+				log.Warningf("error deleting expired ledger %s: %s", entry.Key, err)
+			}
+		}
+	}
+}
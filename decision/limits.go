@@ -0,0 +1,112 @@
+package decision
+
+import (
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// RequestLimits bound what a single partner can ask of the engine. Wants that
+// exceed them are dropped. Zero values mean unlimited.
+type RequestLimits struct {
+	// MaxWantlistSize is the maximum number of entries in a partner's
+	// wantlist
+	MaxWantlistSize int
+
+	// MaxWantRate is the maximum number of new wants per second a partner
+	// may send, with bursts of up to MaxWantBurst wants. MaxWantBurst
+	// defaults to a second's worth of wants, and at least one.
+	MaxWantRate  float64
+	MaxWantBurst int
+
+	// MaxQueuedBytes is the maximum number of bytes of blocks queued up to be
+	// sent to a partner
+	MaxQueuedBytes int
+}
+
+func (rl RequestLimits) wantBurst() float64 {
+	if rl.MaxWantBurst > 0 {
+		return float64(rl.MaxWantBurst)
+	}
+	// below a want a second, a second's worth would never add up to a
+	// whole want
+	if rl.MaxWantRate < 1 {
+		return 1
+	}
+	return rl.MaxWantRate
+}
+
+// Limit identifies one of the RequestLimits
+type Limit int
+
+const (
+	WantlistSizeLimit Limit = iota
+	WantRateLimit
+	QueuedBytesLimit
+)
+
+func (l Limit) String() string {
+	switch l {
+	case WantlistSizeLimit:
+		return "wantlist size"
+	case WantRateLimit:
+		return "want rate"
+	case QueuedBytesLimit:
+		return "queued bytes"
+	default:
+		return "unknown"
+	}
+}
+
+// LimitEvent reports the wants dropped from a partner for exceeding one of the
+// RequestLimits
+type LimitEvent struct {
+	Peer    peer.ID
+	Limit   Limit
+	Dropped []cid.Cid
+}
+
+// limitEvents collects the wants dropped while handling a message, so that
+// they can be reported once the engine's locks are released
+type limitEvents struct {
+	p      peer.ID
+	events map[Limit]*LimitEvent
+}
+
+func (le *limitEvents) drop(limit Limit, c cid.Cid) {
+	if le.events == nil {
+		le.events = make(map[Limit]*LimitEvent)
+	}
+	ev, ok := le.events[limit]
+	if !ok {
+		ev = &LimitEvent{Peer: le.p, Limit: limit}
+		le.events[limit] = ev
+	}
+	ev.Dropped = append(ev.Dropped, c)
+}
+
+// takeWant takes a token for a new want from the partner's want rate bucket,
+// returning false if there is none left. l.lk must be held.
+func (l *ledger) takeWant(limits RequestLimits, now time.Time) bool {
+	if limits.MaxWantRate <= 0 {
+		return true
+	}
+
+	burst := limits.wantBurst()
+	if l.wantTokensAt.IsZero() {
+		l.wantTokens = burst
+	} else if elapsed := now.Sub(l.wantTokensAt); elapsed > 0 {
+		l.wantTokens += elapsed.Seconds() * limits.MaxWantRate
+		if l.wantTokens > burst {
+			l.wantTokens = burst
+		}
+	}
+	l.wantTokensAt = now
+
+	if l.wantTokens < 1 {
+		return false
+	}
+	l.wantTokens--
+	return true
+}
@@ -4,6 +4,8 @@ import (
 	"sync"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	wantlist "github.com/ipfs/go-bitswap/wantlist"
 
 	cid "github.com/ipfs/go-cid"
@@ -14,64 +16,113 @@ import (
 type peerRequestQueue interface {
 	// Pop returns the next peerRequestTask. Returns nil if the peerRequestQueue is empty.
 	Pop() *peerRequestTask
-	Push(to peer.ID, entries ...*wantlist.Entry)
+	// Push queues up the given entries, and returns the ones it had to drop
+	// to stay within the queued bytes limit
+	Push(to peer.ID, entries ...*wantlist.Entry) []*wantlist.Entry
 	Remove(k cid.Cid, p peer.ID)
 
+	// updateLedger records the current state of a partner's ledger, for the
+	// strategy to take into account
+	updateLedger(p peer.ID, li LedgerInfo)
+
 	// NB: cannot expose simply expose taskQueue.Len because trashed elements
 	// may exist. These trashed elements should not contribute to the count.
 }
 
-func newPRQ() *prq {
+func newPRQ(strategy Strategy) *prq {
 	return &prq{
 		taskMap:  make(map[taskEntryKey]*peerRequestTask),
 		partners: make(map[peer.ID]*activePartner),
 		frozen:   make(map[peer.ID]*activePartner),
-		pQueue:   pq.New(partnerCompare),
+		pQueue:   pq.New(partnerComparator(strategy)),
+		strategy: strategy,
+		clock:    clock.New(),
 	}
 }
 
 // verify interface implementation
 var _ peerRequestQueue = &prq{}
 
-// TODO: at some point, the strategy needs to plug in here
-// to help decide how to sort tasks (on add) and how to select
-// tasks (on getnext). For now, we are assuming a dumb/nice strategy.
+// prq orders partners, and the tasks of each partner, as decided by its
+// Strategy
 type prq struct {
 	lock     sync.Mutex
 	pQueue   pq.PQ
 	taskMap  map[taskEntryKey]*peerRequestTask
 	partners map[peer.ID]*activePartner
+	strategy Strategy
+
+	// maxQueuedBytes bounds the size of the blocks queued for a partner.
+	// Zero means unlimited.
+	maxQueuedBytes int
 
 	frozen map[peer.ID]*activePartner
+
+	// clock stamps the tasks as they're created
+	clock clock.Clock
 }
 
-// Push currently adds a new peerRequestTask to the end of the list
-func (tl *prq) Push(to peer.ID, entries ...*wantlist.Entry) {
-	tl.lock.Lock()
-	defer tl.lock.Unlock()
-	partner, ok := tl.partners[to]
+// partner returns the activePartner for the given peer, creating it if
+// necessary. tl.lock must be held.
+func (tl *prq) partner(p peer.ID) *activePartner {
+	partner, ok := tl.partners[p]
 	if !ok {
-		partner = newActivePartner()
+		partner = newActivePartner(p, tl.strategy)
 		tl.pQueue.Push(partner)
-		tl.partners[to] = partner
+		tl.partners[p] = partner
 	}
+	return partner
+}
+
+// Push currently adds a new peerRequestTask to the end of the list
+func (tl *prq) Push(to peer.ID, entries ...*wantlist.Entry) []*wantlist.Entry {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	partner := tl.partner(to)
 
 	partner.activelk.Lock()
 	defer partner.activelk.Unlock()
 
 	var priority int
+	var dropped []*wantlist.Entry
 	newEntries := make([]*wantlist.Entry, 0, len(entries))
 	for _, entry := range entries {
 		if partner.activeBlocks.Has(entry.Cid) {
 			continue
 		}
 		if task, ok := tl.taskMap[taskEntryKey{to, entry.Cid}]; ok {
-			if entry.Priority > task.Priority {
-				task.Priority = entry.Priority
+			for i, te := range task.Entries {
+				if !te.Cid.Equals(entry.Cid) {
+					continue
+				}
+				if entry.WantType == pb.Message_Wantlist_Block && te.WantType != pb.Message_Wantlist_Block {
+					// a want-block supersedes a pending want-have
+					if !tl.fits(partner, entry.Size-te.Size) {
+						dropped = append(dropped, entry)
+						continue
+					}
+					partner.queuedBytes += entry.Size - te.Size
+					task.Entries[i] = entry
+				} else if te.Priority != entry.Priority {
+					// the partner raised or lowered its priority.
+					// Entries are shared with its ledger, so replace
+					// rather than mutate.
+					updated := *te
+					updated.Priority = entry.Priority
+					task.Entries[i] = &updated
+				}
+			}
+			if p := task.entriesPriority(); p != task.Priority {
+				task.Priority = p
 				partner.taskQueue.Update(task.index)
 			}
 			continue
 		}
+		if !tl.fits(partner, entry.Size) {
+			dropped = append(dropped, entry)
+			continue
+		}
+		partner.queuedBytes += entry.Size
 		if entry.Priority > priority {
 			priority = entry.Priority
 		}
@@ -79,13 +130,13 @@ func (tl *prq) Push(to peer.ID, entries ...*wantlist.Entry) {
 	}
 
 	if len(newEntries) == 0 {
-		return
+		return dropped
 	}
 
 	task := &peerRequestTask{
 		Entries: newEntries,
 		Target:  to,
-		created: time.Now(),
+		created: tl.clock.Now(),
 		Done: func(e []*wantlist.Entry) {
 			tl.lock.Lock()
 			for _, entry := range e {
@@ -102,6 +153,15 @@ func (tl *prq) Push(to peer.ID, entries ...*wantlist.Entry) {
 	}
 	partner.requests += len(newEntries)
 	tl.pQueue.Update(partner.Index())
+	return dropped
+}
+
+// fits returns true if n more bytes can be queued for the given partner. A
+// block larger than the limit is let into an empty queue, or it could never
+// be served at all.
+func (tl *prq) fits(partner *activePartner, n int) bool {
+	return tl.maxQueuedBytes <= 0 || n <= 0 || partner.queuedBytes == 0 ||
+		partner.queuedBytes+n <= tl.maxQueuedBytes
 }
 
 // Pop 'pops' the next task to be performed. Returns nil if no task exists.
@@ -114,7 +174,7 @@ func (tl *prq) Pop() *peerRequestTask {
 	partner := tl.pQueue.Pop().(*activePartner)
 
 	var out *peerRequestTask
-	for partner.taskQueue.Len() > 0 && partner.freezeVal == 0 {
+	for partner.taskQueue.Len() > 0 && partner.freezeVal == 0 && partner.heldUntil.IsZero() {
 		out = partner.taskQueue.Pop().(*peerRequestTask)
 
 		newEntries := make([]*wantlist.Entry, 0, len(out.Entries))
@@ -123,6 +183,7 @@ func (tl *prq) Pop() *peerRequestTask {
 			if entry.Trash {
 				continue
 			}
+			partner.queuedBytes -= entry.Size
 			partner.requests--
 			partner.StartTask(entry.Cid)
 			newEntries = append(newEntries, entry)
@@ -150,6 +211,9 @@ func (tl *prq) Remove(k cid.Cid, p peer.ID) {
 				// remove the task "lazily"
 				// simply mark it as trash, so it'll be dropped when popped off the
 				// queue.
+				if !entry.Trash {
+					tl.partners[p].queuedBytes -= entry.Size
+				}
 				entry.Trash = true
 				break
 			}
@@ -173,6 +237,64 @@ func (tl *prq) Remove(k cid.Cid, p peer.ID) {
 	tl.lock.Unlock()
 }
 
+func (tl *prq) updateLedger(p peer.ID, li LedgerInfo) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	partner := tl.partner(p)
+	partner.ledger = li
+	tl.pQueue.Update(partner.Index())
+}
+
+// queued returns the number of entries the partners are waiting on
+func (tl *prq) queued() int {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	var n int
+	for _, partner := range tl.partners {
+		n += partner.requests
+	}
+	return n
+}
+
+// setDeprioritized sets whether the partner is served after everyone else
+func (tl *prq) setDeprioritized(p peer.ID, deprioritized bool) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	partner := tl.partner(p)
+	if partner.deprioritized != deprioritized {
+		partner.deprioritized = deprioritized
+		tl.pQueue.Update(partner.Index())
+	}
+}
+
+// hold keeps the partner's tasks from being popped until released, and
+// returns false if it's already held for as long
+func (tl *prq) hold(p peer.ID, until time.Time) bool {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	partner := tl.partner(p)
+	if !until.After(partner.heldUntil) {
+		return false
+	}
+	partner.heldUntil = until
+	tl.pQueue.Update(partner.Index())
+	return true
+}
+
+// release releases the partner from the hold until the given time, unless it
+// has been held for longer since, and returns true if it was released
+func (tl *prq) release(p peer.ID, until time.Time) bool {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	partner, ok := tl.partners[p]
+	if !ok || !partner.heldUntil.Equal(until) {
+		return false
+	}
+	partner.heldUntil = time.Time{}
+	tl.pQueue.Update(partner.Index())
+	return true
+}
+
 func (tl *prq) fullThaw() {
 	tl.lock.Lock()
 	defer tl.lock.Unlock()
@@ -210,6 +332,18 @@ type peerRequestTask struct {
 	index   int // book-keeping field used by the pq container
 }
 
+// entriesPriority returns the highest priority of the task's live entries,
+// as Push sets it
+func (t *peerRequestTask) entriesPriority() int {
+	var priority int
+	for _, e := range t.Entries {
+		if !e.Trash && e.Priority > priority {
+			priority = e.Priority
+		}
+	}
+	return priority
+}
+
 // Index implements pq.Elem
 func (t *peerRequestTask) Index() int {
 	return t.index
@@ -246,7 +380,33 @@ func wrapCmp(f func(a, b *peerRequestTask) bool) func(a, b pq.Elem) bool {
 	}
 }
 
+// taskComparator adapts the strategy's TaskCompare to a pq.ElemComparator
+func taskComparator(s Strategy) func(a, b pq.Elem) bool {
+	return wrapCmp(func(a, b *peerRequestTask) bool {
+		return s.TaskCompare(a.info(), b.info())
+	})
+}
+
+func (t *peerRequestTask) info() TaskInfo {
+	return TaskInfo{
+		Target:   t.Target,
+		Priority: t.Priority,
+		Created:  t.created,
+	}
+}
+
 type activePartner struct {
+	p peer.ID
+
+	// ledger is the latest snapshot of our ledger with this partner
+	ledger LedgerInfo
+
+	// deprioritized partners are served after all others
+	deprioritized bool
+
+	// heldUntil is set while the partner's tasks are held back, such as
+	// while sends to it are throttled
+	heldUntil time.Time
 
 	// Active is the number of blocks this peer is currently being sent
 	// active must be locked around as it will be updated externally
@@ -260,6 +420,10 @@ type activePartner struct {
 	// the peerRequestQueue's locks
 	requests int
 
+	// queuedBytes is the size of the blocks queued up for this peer, and is
+	// likewise only modified under the peerRequestQueue's locks
+	queuedBytes int
+
 	// for the PQ interface
 	index int
 
@@ -269,42 +433,45 @@ type activePartner struct {
 	taskQueue pq.PQ
 }
 
-func newActivePartner() *activePartner {
+func newActivePartner(p peer.ID, s Strategy) *activePartner {
 	return &activePartner{
-		taskQueue:    pq.New(wrapCmp(V1)),
+		p:            p,
+		taskQueue:    pq.New(taskComparator(s)),
 		activeBlocks: cid.NewSet(),
 	}
 }
 
-// partnerCompare implements pq.ElemComparator
-// returns true if peer 'a' has higher priority than peer 'b'
-func partnerCompare(a, b pq.Elem) bool {
-	pa := a.(*activePartner)
-	pb := b.(*activePartner)
-
-	// having no blocks in their wantlist means lowest priority
-	// having both of these checks ensures stability of the sort
-	if pa.requests == 0 {
-		return false
-	}
-	if pb.requests == 0 {
-		return true
+// partnerComparator adapts the strategy's PartnerCompare to a
+// pq.ElemComparator. Held partners with requests come after the others with
+// requests, and deprioritized ones after the rest of those, however the
+// strategy orders them.
+func partnerComparator(s Strategy) func(a, b pq.Elem) bool {
+	return func(a, b pq.Elem) bool {
+		ap, bp := a.(*activePartner), b.(*activePartner)
+		ai, bi := ap.info(), bp.info()
+		if ai.Requests > 0 && bi.Requests > 0 {
+			if aHeld, bHeld := !ap.heldUntil.IsZero(), !bp.heldUntil.IsZero(); aHeld != bHeld {
+				return bHeld
+			}
+		}
+		if ai.Requests > 0 && bi.Requests > 0 && ai.Deprioritized != bi.Deprioritized {
+			return bi.Deprioritized
+		}
+		return s.PartnerCompare(ai, bi)
 	}
+}
 
-	if pa.freezeVal > pb.freezeVal {
-		return false
-	}
-	if pa.freezeVal < pb.freezeVal {
-		return true
-	}
+func (p *activePartner) info() PartnerInfo {
+	return PartnerInfo{
+		Peer:     p.p,
+		Active:   p.active,
+		Requests: p.requests,
+		Queued:   p.taskQueue.Len(),
+		Frozen:   p.freezeVal,
+		Ledger:   p.ledger,
 
-	if pa.active == pb.active {
-		// sorting by taskQueue.Len() aids in cleaning out trash entries faster
-		// if we sorted instead by requests, one peer could potentially build up
-		// a huge number of cancelled entries in the queue resulting in a memory leak
-		return pa.taskQueue.Len() > pb.taskQueue.Len()
+		Deprioritized: p.deprioritized,
 	}
-	return pa.active < pb.active
 }
 
 // StartTask signals that a task was started for this partner
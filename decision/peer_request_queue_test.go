@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-bitswap/wantlist"
 	cid "github.com/ipfs/go-cid"
@@ -15,7 +16,7 @@ import (
 )
 
 func TestPushPop(t *testing.T) {
-	prq := newPRQ()
+	prq := newPRQ(NewNiceStrategy())
 	partner := testutil.RandPeerIDFatal(t)
 	alphabet := strings.Split("abcdefghijklmnopqrstuvwxyz", "")
 	vowels := strings.Split("aeiou", "")
@@ -77,7 +78,7 @@ func TestPushPop(t *testing.T) {
 
 // This test checks that peers wont starve out other peers
 func TestPeerRepeats(t *testing.T) {
-	prq := newPRQ()
+	prq := newPRQ(NewNiceStrategy())
 	a := testutil.RandPeerIDFatal(t)
 	b := testutil.RandPeerIDFatal(t)
 	c := testutil.RandPeerIDFatal(t)
@@ -128,3 +129,112 @@ func TestPeerRepeats(t *testing.T) {
 		}
 	}
 }
+
+func TestTitForTatServesDebtorsLast(t *testing.T) {
+	prq := newPRQ(NewTitForTatStrategy(1))
+	debtor := testutil.RandPeerIDFatal(t)
+	other := testutil.RandPeerIDFatal(t)
+
+	prq.updateLedger(debtor, LedgerInfo{BytesSent: 1 << 20})
+	prq.updateLedger(other, LedgerInfo{BytesSent: 1 << 20, BytesRecv: 1 << 20})
+
+	for i := 0; i < 3; i++ {
+		c := cid.NewCidV0(u.Hash([]byte(fmt.Sprint(i))))
+		prq.Push(debtor, &wantlist.Entry{Cid: c})
+		prq.Push(other, &wantlist.Entry{Cid: c})
+	}
+
+	// every task for the peer in good standing comes first, even though the
+	// nice strategy would alternate between the two
+	for i := 0; i < 3; i++ {
+		task := prq.Pop()
+		if task.Target != other {
+			t.Fatal("expected the peer in good standing to be served first")
+		}
+	}
+	if task := prq.Pop(); task == nil || task.Target != debtor {
+		t.Fatal("expected the debtor to be served once nobody else is waiting")
+	}
+}
+
+func TestPriorityUpdatesReorderTasks(t *testing.T) {
+	prq := newPRQ(NewNiceStrategy())
+	partner := testutil.RandPeerIDFatal(t)
+	a := cid.NewCidV0(u.Hash([]byte("a")))
+	b := cid.NewCidV0(u.Hash([]byte("b")))
+	c := cid.NewCidV0(u.Hash([]byte("c")))
+
+	prq.Push(partner, &wantlist.Entry{Cid: a, Priority: 30})
+	prq.Push(partner, &wantlist.Entry{Cid: b, Priority: 20})
+	prq.Push(partner, &wantlist.Entry{Cid: c, Priority: 10})
+
+	// lower a below the others, and raise c above them
+	prq.Push(partner, &wantlist.Entry{Cid: a, Priority: 5})
+	prq.Push(partner, &wantlist.Entry{Cid: c, Priority: 40})
+	prq.fullThaw()
+
+	expected := []cid.Cid{c, b, a}
+	for _, exp := range expected {
+		task := prq.Pop()
+		if task == nil || len(task.Entries) != 1 {
+			t.Fatal("expected a task with one entry")
+		}
+		if !task.Entries[0].Cid.Equals(exp) {
+			t.Fatal("received", task.Entries[0].Cid, "expected", exp)
+		}
+		task.Done(task.Entries)
+	}
+}
+
+func TestDeprioritizedPartnersServedLast(t *testing.T) {
+	prq := newPRQ(NewNiceStrategy())
+	bad := testutil.RandPeerIDFatal(t)
+	good := testutil.RandPeerIDFatal(t)
+
+	prq.setDeprioritized(bad, true)
+	for i := 0; i < 3; i++ {
+		c := cid.NewCidV0(u.Hash([]byte(fmt.Sprint(i))))
+		prq.Push(bad, &wantlist.Entry{Cid: c})
+		prq.Push(good, &wantlist.Entry{Cid: c})
+	}
+
+	for i := 0; i < 3; i++ {
+		if task := prq.Pop(); task.Target != good {
+			t.Fatal("expected the partner in good standing to be served first")
+		}
+	}
+	prq.setDeprioritized(bad, false)
+	if task := prq.Pop(); task == nil || task.Target != bad {
+		t.Fatal("expected the deprioritized partner to be served once the others are")
+	}
+}
+
+func TestHeldPartnersServedOnceReleased(t *testing.T) {
+	prq := newPRQ(NewNiceStrategy())
+	held := testutil.RandPeerIDFatal(t)
+	other := testutil.RandPeerIDFatal(t)
+
+	c := cid.NewCidV0(u.Hash([]byte("held")))
+	prq.Push(held, &wantlist.Entry{Cid: c})
+	prq.Push(other, &wantlist.Entry{Cid: c})
+	until := time.Now().Add(time.Second)
+	if !prq.hold(held, until) {
+		t.Fatal("expected the partner to be held")
+	}
+
+	if task := prq.Pop(); task == nil || task.Target != other {
+		t.Fatal("expected the partner that isn't held to be served")
+	}
+	if task := prq.Pop(); task != nil {
+		t.Fatal("expected nothing to be served while the partner is held")
+	}
+	if prq.release(held, until.Add(-time.Millisecond)) {
+		t.Fatal("expected a release for an earlier hold to be ignored")
+	}
+	if !prq.release(held, until) {
+		t.Fatal("expected the partner to be released")
+	}
+	if task := prq.Pop(); task == nil || task.Target != held {
+		t.Fatal("expected the partner to be served once released")
+	}
+}
@@ -0,0 +1,78 @@
+package decision
+
+import (
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// PeerFilter decides which peers we exchange blocks with. Peers it doesn't
+// allow are neither served blocks nor sent our wants.
+type PeerFilter interface {
+	// AllowPeer returns true if blocks may be exchanged with the given peer
+	AllowPeer(p peer.ID) bool
+}
+
+// PeerList is a PeerFilter that either allows only the peers on it, or all
+// peers but the ones on it. The list can be updated at runtime.
+type PeerList struct {
+	lk    sync.RWMutex
+	peers map[peer.ID]struct{}
+	allow bool
+}
+
+// NewAllowlist returns a PeerList that only allows the given peers
+func NewAllowlist(peers ...peer.ID) *PeerList {
+	return newPeerList(true, peers)
+}
+
+// NewDenylist returns a PeerList that allows all peers except the given ones
+func NewDenylist(peers ...peer.ID) *PeerList {
+	return newPeerList(false, peers)
+}
+
+func newPeerList(allow bool, peers []peer.ID) *PeerList {
+	pl := &PeerList{
+		peers: make(map[peer.ID]struct{}, len(peers)),
+		allow: allow,
+	}
+	pl.Add(peers...)
+	return pl
+}
+
+// Add puts the given peers on the list
+func (pl *PeerList) Add(peers ...peer.ID) {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	for _, p := range peers {
+		pl.peers[p] = struct{}{}
+	}
+}
+
+// Remove takes the given peers off the list
+func (pl *PeerList) Remove(peers ...peer.ID) {
+	pl.lk.Lock()
+	defer pl.lk.Unlock()
+	for _, p := range peers {
+		delete(pl.peers, p)
+	}
+}
+
+// Peers returns the peers on the list
+func (pl *PeerList) Peers() []peer.ID {
+	pl.lk.RLock()
+	defer pl.lk.RUnlock()
+	out := make([]peer.ID, 0, len(pl.peers))
+	for p := range pl.peers {
+		out = append(out, p)
+	}
+	return out
+}
+
+// AllowPeer implements PeerFilter
+func (pl *PeerList) AllowPeer(p peer.ID) bool {
+	pl.lk.RLock()
+	defer pl.lk.RUnlock()
+	_, ok := pl.peers[p]
+	return ok == pl.allow
+}
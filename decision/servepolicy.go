@@ -0,0 +1,122 @@
+package decision
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ServePolicy decides which blocks may be served to which peers. Wants for
+// blocks it doesn't allow are dropped, or answered with DONT_HAVE if the peer
+// asked for one.
+type ServePolicy interface {
+	// AllowServe returns true if the block with the given cid may be sent
+	// to the given peer
+	AllowServe(p peer.ID, c cid.Cid) bool
+}
+
+// DenyList is a ServePolicy that serves no peer the blocks on it. Blocks are
+// matched by multihash, so all CIDs of a block are denied together. The list
+// can be updated at runtime.
+type DenyList struct {
+	lk     sync.RWMutex
+	hashes map[string]struct{}
+}
+
+// NewDenyList returns a DenyList of the given cids
+func NewDenyList(cids ...cid.Cid) *DenyList {
+	dl := &DenyList{
+		hashes: make(map[string]struct{}, len(cids)),
+	}
+	dl.Add(cids...)
+	return dl
+}
+
+// LoadDenyList reads a DenyList from the file at the given path. See
+// ReadDenyList for the format.
+func LoadDenyList(path string) (*DenyList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadDenyList(f)
+}
+
+// ReadDenyList reads a DenyList of one block per line, given by CID, or by
+// multihash in base58 or hex. Blank lines and lines starting with '#' are
+// skipped.
+func ReadDenyList(r io.Reader) (*DenyList, error) {
+	dl := NewDenyList()
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		h, err := parseDenied(line)
+		if err != nil {
+			return nil, fmt.Errorf("deny list line %d: %s", n, err)
+		}
+		dl.hashes[string(h)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// parseDenied returns the multihash of the block a deny list line is for.
+// CIDs are tried first, as base58 sha2-256 multihashes are valid CIDs too.
+func parseDenied(line string) (mh.Multihash, error) {
+	if c, err := cid.Decode(line); err == nil {
+		return c.Hash(), nil
+	}
+	if h, err := mh.FromHexString(line); err == nil {
+		return h, nil
+	}
+	if h, err := mh.FromB58String(line); err == nil {
+		return h, nil
+	}
+	return nil, fmt.Errorf("%q is neither a CID nor a multihash", line)
+}
+
+// Add puts the given cids on the list
+func (dl *DenyList) Add(cids ...cid.Cid) {
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+	for _, c := range cids {
+		dl.hashes[string(c.Hash())] = struct{}{}
+	}
+}
+
+// Remove takes the given cids off the list
+func (dl *DenyList) Remove(cids ...cid.Cid) {
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+	for _, c := range cids {
+		delete(dl.hashes, string(c.Hash()))
+	}
+}
+
+// Len returns the number of blocks on the list
+func (dl *DenyList) Len() int {
+	dl.lk.RLock()
+	defer dl.lk.RUnlock()
+	return len(dl.hashes)
+}
+
+// AllowServe implements ServePolicy
+func (dl *DenyList) AllowServe(p peer.ID, c cid.Cid) bool {
+	dl.lk.RLock()
+	defer dl.lk.RUnlock()
+	_, denied := dl.hashes[string(c.Hash())]
+	return !denied
+}
@@ -0,0 +1,139 @@
+package decision
+
+import (
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Strategy decides the order in which the engine serves its partners, and the
+// order in which each partner's tasks are served. Comparisons are made while
+// the peer request queue is locked, so implementations must only rely on the
+// information they are given.
+type Strategy interface {
+	// PartnerCompare returns true if partner 'a' should be served before
+	// partner 'b'
+	PartnerCompare(a, b PartnerInfo) bool
+
+	// TaskCompare returns true if task 'a' should be served before task 'b'.
+	// Both tasks always belong to the same partner.
+	TaskCompare(a, b TaskInfo) bool
+}
+
+// LedgerInfo is a snapshot of the ledger the engine keeps for a partner
+type LedgerInfo struct {
+	BytesSent     uint64
+	BytesRecv     uint64
+	ExchangeCount uint64
+	LastExchange  time.Time
+}
+
+// DebtRatio returns the ratio of bytes sent to the partner to bytes received
+// from them. The higher it is, the more the partner owes us.
+func (li LedgerInfo) DebtRatio() float64 {
+	dr := debtRatio{BytesSent: li.BytesSent, BytesRecv: li.BytesRecv}
+	return dr.Value()
+}
+
+// PartnerInfo describes a partner's state in the peer request queue
+type PartnerInfo struct {
+	Peer peer.ID
+
+	// Active is the number of blocks currently being sent to the partner
+	Active int
+
+	// Requests is the number of blocks the partner is waiting on
+	Requests int
+
+	// Queued is the number of tasks queued for the partner, including
+	// cancelled ones that haven't been cleaned out yet
+	Queued int
+
+	// Frozen is non-zero while we wait for more in-flight cancels from the
+	// partner
+	Frozen int
+
+	// Deprioritized is set for partners the engine was told to serve after
+	// everyone else, whatever the strategy
+	Deprioritized bool
+
+	Ledger LedgerInfo
+}
+
+// TaskInfo describes a task in the peer request queue
+type TaskInfo struct {
+	Target   peer.ID
+	Priority int
+	Created  time.Time
+}
+
+// NewNiceStrategy returns a strategy that serves all partners fairly,
+// regardless of what they have sent us, and serves each partner's tasks in
+// order of priority.
+func NewNiceStrategy() Strategy {
+	return niceStrategy{}
+}
+
+type niceStrategy struct{}
+
+func (niceStrategy) PartnerCompare(a, b PartnerInfo) bool {
+	// having no blocks in their wantlist means lowest priority
+	// having both of these checks ensures stability of the sort
+	if a.Requests == 0 {
+		return false
+	}
+	if b.Requests == 0 {
+		return true
+	}
+
+	if a.Frozen > b.Frozen {
+		return false
+	}
+	if a.Frozen < b.Frozen {
+		return true
+	}
+
+	if a.Active == b.Active {
+		// sorting by Queued aids in cleaning out trash entries faster
+		// if we sorted instead by requests, one peer could potentially build up
+		// a huge number of cancelled entries in the queue resulting in a memory leak
+		return a.Queued > b.Queued
+	}
+	return a.Active < b.Active
+}
+
+func (niceStrategy) TaskCompare(a, b TaskInfo) bool {
+	if a.Target == b.Target {
+		return a.Priority > b.Priority
+	}
+	return a.Created.Before(b.Created)
+}
+
+// NewTitForTatStrategy returns a strategy that serves partners whose debt
+// ratio is above maxDebtRatio only after everyone else, and the most indebted
+// of them last. Partners in good standing are served as by the nice strategy.
+func NewTitForTatStrategy(maxDebtRatio float64) Strategy {
+	return titForTatStrategy{maxDebtRatio: maxDebtRatio}
+}
+
+type titForTatStrategy struct {
+	niceStrategy
+	maxDebtRatio float64
+}
+
+func (s titForTatStrategy) PartnerCompare(a, b PartnerInfo) bool {
+	// idle and frozen partners are handled the same as by the nice strategy
+	if a.Requests == 0 || b.Requests == 0 || a.Frozen != b.Frozen {
+		return s.niceStrategy.PartnerCompare(a, b)
+	}
+
+	ra, rb := a.Ledger.DebtRatio(), b.Ledger.DebtRatio()
+	aDebtor, bDebtor := ra > s.maxDebtRatio, rb > s.maxDebtRatio
+	if aDebtor != bDebtor {
+		return bDebtor
+	}
+	if aDebtor && ra != rb {
+		return ra < rb
+	}
+	return s.niceStrategy.PartnerCompare(a, b)
+}
@@ -224,7 +224,7 @@ func oneAtATime(b *testing.B, bs *Bitswap, ks []cid.Cid) {
 			b.Fatal(err)
 		}
 	}
-	b.Logf("Session fetch latency: %s", ses.latTotal/time.Duration(ses.fetchcnt))
+	b.Logf("Session fetch latency: %s", ses.latTotal/time.Duration(ses.latcnt))
 }
 
 // fetch data in batches, 10 at a time
@@ -290,3 +290,41 @@ func unixfsFileFetch(b *testing.B, bs *Bitswap, ks []cid.Cid) {
 	for range out {
 	}
 }
+
+func TestSessionSplitCutsDuplicates(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(10*time.Millisecond))
+	sg := NewTestSessionGenerator(net)
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(10)
+	blks := bg.Blocks(50)
+	fetcher := instances[len(instances)-1]
+	for _, p := range instances[:len(instances)-1] {
+		if err := p.Blockstore().PutMany(blks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	ses := fetcher.Exchange.NewSession(ctx)
+	for _, blk := range blks {
+		if _, err := ses.GetBlock(ctx, blk.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := fetcher.Exchange.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sending every want to all nine peers would get eight duplicates of
+	// each block
+	if st.DupBlksReceived >= uint64(len(blks)) {
+		t.Fatalf("got %d duplicate blocks for %d blocks fetched", st.DupBlksReceived, len(blks))
+	}
+}
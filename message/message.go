@@ -27,6 +27,11 @@ type BitSwapMessage interface {
 	// AddEntry adds an entry to the Wantlist.
 	AddEntry(key cid.Cid, priority int)
 
+	// AddEntryWithType adds an entry of the given want type to the Wantlist.
+	// If sendDontHave is set, the receiver is asked to respond with DONT_HAVE
+	// when it doesn't have the block.
+	AddEntryWithType(key cid.Cid, priority int, wantType pb.Message_Wantlist_WantType, sendDontHave bool)
+
 	Cancel(key cid.Cid)
 
 	Empty() bool
@@ -35,6 +40,17 @@ type BitSwapMessage interface {
 	Full() bool
 
 	AddBlock(blocks.Block)
+
+	// BlockPresences returns the HAVE / DONT_HAVE responses in the message
+	BlockPresences() []BlockPresence
+	// Haves returns the cids the sender has told us it has
+	Haves() []cid.Cid
+	// DontHaves returns the cids the sender has told us it doesn't have
+	DontHaves() []cid.Cid
+
+	AddHave(cid.Cid)
+	AddDontHave(cid.Cid)
+
 	Exportable
 
 	Loggable() map[string]interface{}
@@ -48,9 +64,10 @@ type Exportable interface {
 }
 
 type impl struct {
-	full     bool
-	wantlist map[cid.Cid]*Entry
-	blocks   map[cid.Cid]blocks.Block
+	full           bool
+	wantlist       map[cid.Cid]*Entry
+	blocks         map[cid.Cid]blocks.Block
+	blockPresences map[cid.Cid]pb.Message_BlockPresenceType
 }
 
 func New(full bool) BitSwapMessage {
@@ -59,9 +76,10 @@ func New(full bool) BitSwapMessage {
 
 func newMsg(full bool) *impl {
 	return &impl{
-		blocks:   make(map[cid.Cid]blocks.Block),
-		wantlist: make(map[cid.Cid]*Entry),
-		full:     full,
+		blocks:         make(map[cid.Cid]blocks.Block),
+		wantlist:       make(map[cid.Cid]*Entry),
+		blockPresences: make(map[cid.Cid]pb.Message_BlockPresenceType),
+		full:           full,
 	}
 }
 
@@ -70,6 +88,12 @@ type Entry struct {
 	Cancel bool
 }
 
+// BlockPresence is a HAVE or DONT_HAVE response for a single cid
+type BlockPresence struct {
+	Cid  cid.Cid
+	Type pb.Message_BlockPresenceType
+}
+
 func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 	m := newMsg(pbm.Wantlist.Full)
 	for _, e := range pbm.Wantlist.Entries {
@@ -77,7 +101,7 @@ func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 		if err != nil {
 			return nil, fmt.Errorf("incorrectly formatted cid in wantlist: %s", err)
 		}
-		m.addEntry(c, int(e.Priority), e.Cancel)
+		m.addEntry(c, int(e.Priority), e.Cancel, e.WantType, e.SendDontHave)
 	}
 
 	// deprecated
@@ -107,6 +131,14 @@ func newMessageFromProto(pbm pb.Message) (BitSwapMessage, error) {
 		m.AddBlock(blk)
 	}
 
+	for _, bp := range pbm.GetBlockPresences() {
+		c, err := cid.Cast(bp.GetCid())
+		if err != nil {
+			return nil, fmt.Errorf("incorrectly formatted cid in block presence: %s", err)
+		}
+		m.addBlockPresence(c, bp.GetType())
+	}
+
 	return m, nil
 }
 
@@ -115,7 +147,7 @@ func (m *impl) Full() bool {
 }
 
 func (m *impl) Empty() bool {
-	return len(m.blocks) == 0 && len(m.wantlist) == 0
+	return len(m.blocks) == 0 && len(m.wantlist) == 0 && len(m.blockPresences) == 0
 }
 
 func (m *impl) Wantlist() []Entry {
@@ -134,25 +166,62 @@ func (m *impl) Blocks() []blocks.Block {
 	return bs
 }
 
+func (m *impl) BlockPresences() []BlockPresence {
+	bps := make([]BlockPresence, 0, len(m.blockPresences))
+	for c, t := range m.blockPresences {
+		bps = append(bps, BlockPresence{Cid: c, Type: t})
+	}
+	return bps
+}
+
+func (m *impl) Haves() []cid.Cid {
+	return m.presencesOfType(pb.Message_Have)
+}
+
+func (m *impl) DontHaves() []cid.Cid {
+	return m.presencesOfType(pb.Message_DontHave)
+}
+
+func (m *impl) presencesOfType(t pb.Message_BlockPresenceType) []cid.Cid {
+	var out []cid.Cid
+	for c, bpt := range m.blockPresences {
+		if bpt == t {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
 func (m *impl) Cancel(k cid.Cid) {
 	delete(m.wantlist, k)
-	m.addEntry(k, 0, true)
+	m.addEntry(k, 0, true, pb.Message_Wantlist_Block, false)
 }
 
 func (m *impl) AddEntry(k cid.Cid, priority int) {
-	m.addEntry(k, priority, false)
+	m.addEntry(k, priority, false, pb.Message_Wantlist_Block, false)
 }
 
-func (m *impl) addEntry(c cid.Cid, priority int, cancel bool) {
+func (m *impl) AddEntryWithType(k cid.Cid, priority int, wantType pb.Message_Wantlist_WantType, sendDontHave bool) {
+	m.addEntry(k, priority, false, wantType, sendDontHave)
+}
+
+func (m *impl) addEntry(c cid.Cid, priority int, cancel bool, wantType pb.Message_Wantlist_WantType, sendDontHave bool) {
 	e, exists := m.wantlist[c]
 	if exists {
+		// a want-block supersedes a want-have, but not the other way around
+		if e.Cancel || wantType == pb.Message_Wantlist_Block {
+			e.WantType = wantType
+			e.SendDontHave = sendDontHave
+		}
 		e.Priority = priority
 		e.Cancel = cancel
 	} else {
 		m.wantlist[c] = &Entry{
 			Entry: &wantlist.Entry{
-				Cid:      c,
-				Priority: priority,
+				Cid:          c,
+				Priority:     priority,
+				WantType:     wantType,
+				SendDontHave: sendDontHave,
 			},
 			Cancel: cancel,
 		}
@@ -160,35 +229,88 @@ func (m *impl) addEntry(c cid.Cid, priority int, cancel bool) {
 }
 
 func (m *impl) AddBlock(b blocks.Block) {
+	// the block itself answers any HAVE / DONT_HAVE question
+	delete(m.blockPresences, b.Cid())
 	m.blocks[b.Cid()] = b
 }
 
+func (m *impl) AddHave(c cid.Cid) {
+	m.addBlockPresence(c, pb.Message_Have)
+}
+
+func (m *impl) AddDontHave(c cid.Cid) {
+	m.addBlockPresence(c, pb.Message_DontHave)
+}
+
+func (m *impl) addBlockPresence(c cid.Cid, t pb.Message_BlockPresenceType) {
+	if _, ok := m.blocks[c]; ok {
+		return
+	}
+	m.blockPresences[c] = t
+}
+
+// FromNet reads a single message off the reader
 func FromNet(r io.Reader) (BitSwapMessage, error) {
-	pbr := ggio.NewDelimitedReader(r, inet.MessageSizeMax)
-	return FromPBReader(pbr)
+	return NewReader(r, inet.MessageSizeMax).ReadMsg()
 }
 
+// FromPBReader reads a message off a protobuf reader. Unlike a Reader, it
+// copies the blocks out of the buffer the message was read into.
 func FromPBReader(pbr ggio.Reader) (BitSwapMessage, error) {
 	pb := new(pb.Message)
 	if err := pbr.ReadMsg(pb); err != nil {
 		return nil, err
 	}
 
-	return newMessageFromProto(*pb)
+	m, err := newMessageFromProto(*pb)
+	if err != nil {
+		return nil, &MalformedError{Err: err}
+	}
+	return m, nil
+}
+
+// MalformedError is returned when a message was read, but its contents are
+// invalid, such as a cid that doesn't parse
+type MalformedError struct {
+	Err error
 }
 
-func (m *impl) ToProtoV0() *pb.Message {
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("malformed message: %s", e.Err)
+}
+
+// protoHead returns the message without its blocks, in the v0 or v1 format
+func (m *impl) protoHead(v1 bool) *pb.Message {
 	pbm := new(pb.Message)
 	pbm.Wantlist.Entries = make([]pb.Message_Wantlist_Entry, 0, len(m.wantlist))
 	for _, e := range m.wantlist {
-		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, pb.Message_Wantlist_Entry{
+		entry := pb.Message_Wantlist_Entry{
 			Block:    e.Cid.Bytes(),
 			Priority: int32(e.Priority),
 			Cancel:   e.Cancel,
-		})
+		}
+		if v1 {
+			entry.WantType = e.WantType
+			entry.SendDontHave = e.SendDontHave
+		}
+		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, entry)
 	}
 	pbm.Wantlist.Full = m.full
 
+	if v1 {
+		pbm.BlockPresences = make([]pb.Message_BlockPresence, 0, len(m.blockPresences))
+		for c, t := range m.blockPresences {
+			pbm.BlockPresences = append(pbm.BlockPresences, pb.Message_BlockPresence{
+				Cid:  c.Bytes(),
+				Type: t,
+			})
+		}
+	}
+	return pbm
+}
+
+func (m *impl) ToProtoV0() *pb.Message {
+	pbm := m.protoHead(false)
 	blocks := m.Blocks()
 	pbm.Blocks = make([][]byte, 0, len(blocks))
 	for _, b := range blocks {
@@ -198,17 +320,7 @@ func (m *impl) ToProtoV0() *pb.Message {
 }
 
 func (m *impl) ToProtoV1() *pb.Message {
-	pbm := new(pb.Message)
-	pbm.Wantlist.Entries = make([]pb.Message_Wantlist_Entry, 0, len(m.wantlist))
-	for _, e := range m.wantlist {
-		pbm.Wantlist.Entries = append(pbm.Wantlist.Entries, pb.Message_Wantlist_Entry{
-			Block:    e.Cid.Bytes(),
-			Priority: int32(e.Priority),
-			Cancel:   e.Cancel,
-		})
-	}
-	pbm.Wantlist.Full = m.full
-
+	pbm := m.protoHead(true)
 	blocks := m.Blocks()
 	pbm.Payload = make([]pb.Message_Block, 0, len(blocks))
 	for _, b := range blocks {
@@ -221,15 +333,11 @@ func (m *impl) ToProtoV1() *pb.Message {
 }
 
 func (m *impl) ToNetV0(w io.Writer) error {
-	pbw := ggio.NewDelimitedWriter(w)
-
-	return pbw.WriteMsg(m.ToProtoV0())
+	return m.writeDelimited(w, false)
 }
 
 func (m *impl) ToNetV1(w io.Writer) error {
-	pbw := ggio.NewDelimitedWriter(w)
-
-	return pbw.WriteMsg(m.ToProtoV1())
+	return m.writeDelimited(w, true)
 }
 
 func (m *impl) Loggable() map[string]interface{} {
@@ -238,7 +346,9 @@ func (m *impl) Loggable() map[string]interface{} {
 		blocks = append(blocks, v.Cid().String())
 	}
 	return map[string]interface{}{
-		"blocks": blocks,
-		"wants":  m.Wantlist(),
+		"blocks":    blocks,
+		"wants":     m.Wantlist(),
+		"haves":     m.Haves(),
+		"dontHaves": m.DontHaves(),
 	}
 }
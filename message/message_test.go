@@ -2,10 +2,15 @@ package message
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"testing"
 
 	pb "github.com/ipfs/go-bitswap/message/pb"
 
+	ggio "github.com/gogo/protobuf/io"
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	u "github.com/ipfs/go-ipfs-util"
@@ -196,3 +201,300 @@ func TestDuplicates(t *testing.T) {
 		t.Fatal("Duplicate in BitSwapMessage")
 	}
 }
+
+func TestToAndFromNetBlockPresences(t *testing.T) {
+	have := mkFakeCid("have")
+	donthave := mkFakeCid("donthave")
+	wanthave := mkFakeCid("wanthave")
+
+	original := New(false)
+	original.AddHave(have)
+	original.AddDontHave(donthave)
+	original.AddEntryWithType(wanthave, 1, pb.Message_Wantlist_Have, true)
+
+	buf := new(bytes.Buffer)
+	if err := original.ToNetV1(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	m2, err := FromNet(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if haves := m2.Haves(); len(haves) != 1 || !haves[0].Equals(have) {
+		t.Fatal("HAVE got dropped on marshal")
+	}
+	if donthaves := m2.DontHaves(); len(donthaves) != 1 || !donthaves[0].Equals(donthave) {
+		t.Fatal("DONT_HAVE got dropped on marshal")
+	}
+
+	wl := m2.Wantlist()
+	if len(wl) != 1 {
+		t.Fatal("expected a single wantlist entry")
+	}
+	if wl[0].WantType != pb.Message_Wantlist_Have || !wl[0].SendDontHave {
+		t.Fatal("want type got dropped on marshal")
+	}
+}
+
+func TestBlockSupersedesPresence(t *testing.T) {
+	b := blocks.NewBlock([]byte("foo"))
+
+	m := New(false)
+	m.AddDontHave(b.Cid())
+	m.AddBlock(b)
+	m.AddHave(b.Cid())
+
+	if len(m.BlockPresences()) != 0 {
+		t.Fatal("expected the block to supersede the block presences")
+	}
+
+	m.AddEntryWithType(b.Cid(), 1, pb.Message_Wantlist_Block, true)
+	m.AddEntryWithType(b.Cid(), 1, pb.Message_Wantlist_Have, false)
+	if wl := m.Wantlist(); wl[0].WantType != pb.Message_Wantlist_Block {
+		t.Fatal("want-have should not downgrade a want-block")
+	}
+}
+
+func TestFromNetMalformed(t *testing.T) {
+	pbm := new(pb.Message)
+	pbm.Wantlist.Entries = []pb.Message_Wantlist_Entry{
+		{Block: []byte("not a cid")},
+	}
+	buf := new(bytes.Buffer)
+	if err := ggio.NewDelimitedWriter(buf).WriteMsg(pbm); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := FromNet(buf)
+	if _, ok := err.(*MalformedError); !ok {
+		t.Fatal("expected a MalformedError, got", err)
+	}
+}
+
+func TestToNetMatchesProto(t *testing.T) {
+	// without presences, the fields are written in the same order they're
+	// marshalled in
+	for _, data := range [][]byte{[]byte("W"), bytes.Repeat([]byte("E"), 1<<16), nil} {
+		m := New(true)
+		m.AddEntryWithType(mkFakeCid("want"), 1, pb.Message_Wantlist_Have, true)
+		m.AddBlock(blocks.NewBlock(data))
+
+		for _, v1 := range []bool{false, true} {
+			streamed := new(bytes.Buffer)
+			proto := new(bytes.Buffer)
+			var err error
+			if v1 {
+				err = m.ToNetV1(streamed)
+				ggio.NewDelimitedWriter(proto).WriteMsg(m.ToProtoV1())
+			} else {
+				err = m.ToNetV0(streamed)
+				ggio.NewDelimitedWriter(proto).WriteMsg(m.ToProtoV0())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(streamed.Bytes(), proto.Bytes()) {
+				t.Fatalf("v1=%t: streamed encoding of %d bytes differs from the marshalled message", v1, len(data))
+			}
+		}
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	b1 := blocks.NewBlock([]byte("block"))
+	b2 := blocks.NewBlock(bytes.Repeat([]byte("B"), 1<<16))
+	have := mkFakeCid("have")
+
+	m := New(false)
+	m.AddEntryWithType(mkFakeCid("want"), 3, pb.Message_Wantlist_Have, true)
+	m.AddBlock(b1)
+	m.AddBlock(b2)
+	m.AddHave(have)
+	m.AddDontHave(mkFakeCid("dont"))
+
+	buf := new(bytes.Buffer)
+	if err := m.ToNetV1(buf); err != nil {
+		t.Fatal(err)
+	}
+	// the old encoding reads the same
+	if err := ggio.NewDelimitedWriter(buf).WriteMsg(m.ToProtoV1()); err != nil {
+		t.Fatal(err)
+	}
+	streamed := buf.Bytes()[:0:0]
+	streamed = append(streamed, buf.Bytes()...)
+
+	r := NewReader(buf, 1<<20)
+	for i := 0; i < 2; i++ {
+		m2, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m2.Full() {
+			t.Fatal("expected a partial wantlist")
+		}
+		wl := m2.Wantlist()
+		if len(wl) != 1 || wl[0].Priority != 3 || wl[0].WantType != pb.Message_Wantlist_Have || !wl[0].SendDontHave {
+			t.Fatal("wantlist not preserved", wl)
+		}
+		if len(m2.Blocks()) != 2 {
+			t.Fatal("expected two blocks, got", len(m2.Blocks()))
+		}
+		for _, b := range m2.Blocks() {
+			if !b.Cid().Equals(b1.Cid()) && !b.Cid().Equals(b2.Cid()) {
+				t.Fatal("unexpected block", b.Cid())
+			}
+		}
+		if haves := m2.Haves(); len(haves) != 1 || !haves[0].Equals(have) {
+			t.Fatal("haves not preserved", haves)
+		}
+		if len(m2.DontHaves()) != 1 {
+			t.Fatal("dont-haves not preserved", m2.DontHaves())
+		}
+	}
+	if _, err := r.ReadMsg(); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+
+	// and so does the streamed encoding with the old reader
+	m2, err := FromPBReader(ggio.NewDelimitedReader(bytes.NewReader(streamed), 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.Blocks()) != 2 || len(m2.Haves()) != 1 {
+		t.Fatal("message not preserved by the old reader")
+	}
+}
+
+func TestReaderCopiesSmallBlocks(t *testing.T) {
+	small := blocks.NewBlock([]byte("small"))
+	large := blocks.NewBlock(bytes.Repeat([]byte("L"), 1<<16))
+	m := New(false)
+	m.AddBlock(small)
+	m.AddBlock(large)
+
+	buf := new(bytes.Buffer)
+	if err := m.ToNetV1(buf); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+	_, n := binary.Uvarint(enc)
+	data := enc[n:]
+	m2, err := decodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// clobber the buffer: the large block is read from it, the small one
+	// was copied out
+	for i := range data {
+		data[i] = 0
+	}
+	for _, b := range m2.Blocks() {
+		switch {
+		case b.Cid().Equals(small.Cid()):
+			if !bytes.Equal(b.RawData(), small.RawData()) {
+				t.Fatal("expected the small block to be copied out of the buffer")
+			}
+		case b.Cid().Equals(large.Cid()):
+			if bytes.Equal(b.RawData(), large.RawData()) {
+				t.Fatal("expected the large block to be left in the buffer")
+			}
+		}
+	}
+}
+
+func TestReaderMalformed(t *testing.T) {
+	m := New(true)
+	m.AddBlock(blocks.NewBlock([]byte("block")))
+	buf := new(bytes.Buffer)
+	if err := m.ToNetV1(buf); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+
+	// a message cut short in the middle of the stream
+	if _, err := NewReader(bytes.NewReader(enc[:len(enc)-2]), 1<<20).ReadMsg(); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected an unexpected EOF, got", err)
+	}
+
+	// a field running past the end of the message
+	bad := []byte{3, 0x12, 0x05, 'B'}
+	if _, err := NewReader(bytes.NewReader(bad), 1<<20).ReadMsg(); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(*MalformedError); !ok {
+		t.Fatal("expected a MalformedError, got", err)
+	}
+
+	// a message larger than allowed
+	if _, err := NewReader(bytes.NewReader(enc), 4).ReadMsg(); err != io.ErrShortBuffer {
+		t.Fatal("expected the message to be refused, got", err)
+	}
+}
+
+// benchmarkMessage returns a message filling most of an envelope
+func benchmarkMessage() BitSwapMessage {
+	m := New(false)
+	for i := 0; i < 2; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 256<<10-1024)
+		m.AddBlock(blocks.NewBlock(data))
+	}
+	for i := 0; i < 16; i++ {
+		m.AddEntry(mkFakeCid(fmt.Sprint("want", i)), i)
+		m.AddHave(mkFakeCid(fmt.Sprint("have", i)))
+	}
+	return m
+}
+
+func BenchmarkToNetV1(b *testing.B) {
+	m := benchmarkMessage()
+	b.SetBytes(int64(m.ToProtoV1().Size()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.ToNetV1(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkToNetV1Proto(b *testing.B) {
+	m := benchmarkMessage()
+	b.SetBytes(int64(m.ToProtoV1().Size()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := ggio.NewDelimitedWriter(ioutil.Discard).WriteMsg(m.ToProtoV1()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	buf := new(bytes.Buffer)
+	if err := benchmarkMessage().ToNetV1(buf); err != nil {
+		b.Fatal(err)
+	}
+	enc := buf.Bytes()
+	b.SetBytes(int64(len(enc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewReader(bytes.NewReader(enc), 1<<20).ReadMsg(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFromPBReader(b *testing.B) {
+	buf := new(bytes.Buffer)
+	if err := benchmarkMessage().ToNetV1(buf); err != nil {
+		b.Fatal(err)
+	}
+	enc := buf.Bytes()
+	b.SetBytes(int64(len(enc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := FromPBReader(ggio.NewDelimitedReader(bytes.NewReader(enc), 1<<20)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
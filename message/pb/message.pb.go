@@ -21,19 +21,66 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 
+type Message_BlockPresenceType int32
+
+const (
+	Message_Have     Message_BlockPresenceType = 0
+	Message_DontHave Message_BlockPresenceType = 1
+)
+
+var Message_BlockPresenceType_name = map[int32]string{
+	0: "Have",
+	1: "DontHave",
+}
+var Message_BlockPresenceType_value = map[string]int32{
+	"Have":     0,
+	"DontHave": 1,
+}
+
+func (x Message_BlockPresenceType) String() string {
+	return proto.EnumName(Message_BlockPresenceType_name, int32(x))
+}
+func (Message_BlockPresenceType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_message_79048fcae24d6374, []int{0, 0}
+}
+
+type Message_Wantlist_WantType int32
+
+const (
+	Message_Wantlist_Block Message_Wantlist_WantType = 0
+	Message_Wantlist_Have  Message_Wantlist_WantType = 1
+)
+
+var Message_Wantlist_WantType_name = map[int32]string{
+	0: "Block",
+	1: "Have",
+}
+var Message_Wantlist_WantType_value = map[string]int32{
+	"Block": 0,
+	"Have":  1,
+}
+
+func (x Message_Wantlist_WantType) String() string {
+	return proto.EnumName(Message_Wantlist_WantType_name, int32(x))
+}
+func (Message_Wantlist_WantType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_message_79048fcae24d6374, []int{0, 0, 0}
+}
+
 type Message struct {
-	Wantlist             Message_Wantlist `protobuf:"bytes,1,opt,name=wantlist" json:"wantlist"`
-	Blocks               [][]byte         `protobuf:"bytes,2,rep,name=blocks" json:"blocks,omitempty"`
-	Payload              []Message_Block  `protobuf:"bytes,3,rep,name=payload" json:"payload"`
-	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
-	XXX_sizecache        int32            `json:"-"`
+	Wantlist             Message_Wantlist        `protobuf:"bytes,1,opt,name=wantlist" json:"wantlist"`
+	Blocks               [][]byte                `protobuf:"bytes,2,rep,name=blocks" json:"blocks,omitempty"`
+	Payload              []Message_Block         `protobuf:"bytes,3,rep,name=payload" json:"payload"`
+	BlockPresences       []Message_BlockPresence `protobuf:"bytes,4,rep,name=blockPresences" json:"blockPresences"`
+	XXX_NoUnkeyedLiteral struct{}                `json:"-"`
+	XXX_sizecache        int32                   `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
 func (m *Message) String() string { return proto.CompactTextString(m) }
 func (*Message) ProtoMessage()    {}
 func (*Message) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_c28309e4affd853b, []int{0}
+	return fileDescriptor_message_79048fcae24d6374, []int{0}
 }
 func (m *Message) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -83,6 +130,13 @@ func (m *Message) GetPayload() []Message_Block {
 	return nil
 }
 
+func (m *Message) GetBlockPresences() []Message_BlockPresence {
+	if m != nil {
+		return m.BlockPresences
+	}
+	return nil
+}
+
 type Message_Wantlist struct {
 	Entries              []Message_Wantlist_Entry `protobuf:"bytes,1,rep,name=entries" json:"entries"`
 	Full                 bool                     `protobuf:"varint,2,opt,name=full,proto3" json:"full,omitempty"`
@@ -94,7 +148,7 @@ func (m *Message_Wantlist) Reset()         { *m = Message_Wantlist{} }
 func (m *Message_Wantlist) String() string { return proto.CompactTextString(m) }
 func (*Message_Wantlist) ProtoMessage()    {}
 func (*Message_Wantlist) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_c28309e4affd853b, []int{0, 0}
+	return fileDescriptor_message_79048fcae24d6374, []int{0, 0}
 }
 func (m *Message_Wantlist) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -138,18 +192,20 @@ func (m *Message_Wantlist) GetFull() bool {
 }
 
 type Message_Wantlist_Entry struct {
-	Block                []byte   `protobuf:"bytes,1,opt,name=block,proto3" json:"block,omitempty"`
-	Priority             int32    `protobuf:"varint,2,opt,name=priority,proto3" json:"priority,omitempty"`
-	Cancel               bool     `protobuf:"varint,3,opt,name=cancel,proto3" json:"cancel,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Block                []byte                    `protobuf:"bytes,1,opt,name=block,proto3" json:"block,omitempty"`
+	Priority             int32                     `protobuf:"varint,2,opt,name=priority,proto3" json:"priority,omitempty"`
+	Cancel               bool                      `protobuf:"varint,3,opt,name=cancel,proto3" json:"cancel,omitempty"`
+	WantType             Message_Wantlist_WantType `protobuf:"varint,4,opt,name=wantType,proto3,enum=bitswap.message.pb.Message_Wantlist_WantType" json:"wantType,omitempty"`
+	SendDontHave         bool                      `protobuf:"varint,5,opt,name=sendDontHave,proto3" json:"sendDontHave,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}                  `json:"-"`
+	XXX_sizecache        int32                     `json:"-"`
 }
 
 func (m *Message_Wantlist_Entry) Reset()         { *m = Message_Wantlist_Entry{} }
 func (m *Message_Wantlist_Entry) String() string { return proto.CompactTextString(m) }
 func (*Message_Wantlist_Entry) ProtoMessage()    {}
 func (*Message_Wantlist_Entry) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_c28309e4affd853b, []int{0, 0, 0}
+	return fileDescriptor_message_79048fcae24d6374, []int{0, 0, 0}
 }
 func (m *Message_Wantlist_Entry) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -199,6 +255,20 @@ func (m *Message_Wantlist_Entry) GetCancel() bool {
 	return false
 }
 
+func (m *Message_Wantlist_Entry) GetWantType() Message_Wantlist_WantType {
+	if m != nil {
+		return m.WantType
+	}
+	return Message_Wantlist_Block
+}
+
+func (m *Message_Wantlist_Entry) GetSendDontHave() bool {
+	if m != nil {
+		return m.SendDontHave
+	}
+	return false
+}
+
 type Message_Block struct {
 	Prefix               []byte   `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
 	Data                 []byte   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
@@ -210,7 +280,7 @@ func (m *Message_Block) Reset()         { *m = Message_Block{} }
 func (m *Message_Block) String() string { return proto.CompactTextString(m) }
 func (*Message_Block) ProtoMessage()    {}
 func (*Message_Block) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_c28309e4affd853b, []int{0, 1}
+	return fileDescriptor_message_79048fcae24d6374, []int{0, 1}
 }
 func (m *Message_Block) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -253,11 +323,68 @@ func (m *Message_Block) GetData() []byte {
 	return nil
 }
 
+type Message_BlockPresence struct {
+	Cid                  []byte                    `protobuf:"bytes,1,opt,name=cid,proto3" json:"cid,omitempty"`
+	Type                 Message_BlockPresenceType `protobuf:"varint,2,opt,name=type,proto3,enum=bitswap.message.pb.Message_BlockPresenceType" json:"type,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}                  `json:"-"`
+	XXX_sizecache        int32                     `json:"-"`
+}
+
+func (m *Message_BlockPresence) Reset()         { *m = Message_BlockPresence{} }
+func (m *Message_BlockPresence) String() string { return proto.CompactTextString(m) }
+func (*Message_BlockPresence) ProtoMessage()    {}
+func (*Message_BlockPresence) Descriptor() ([]byte, []int) {
+	return fileDescriptor_message_79048fcae24d6374, []int{0, 2}
+}
+func (m *Message_BlockPresence) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Message_BlockPresence) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Message_BlockPresence.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (dst *Message_BlockPresence) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Message_BlockPresence.Merge(dst, src)
+}
+func (m *Message_BlockPresence) XXX_Size() int {
+	return m.Size()
+}
+func (m *Message_BlockPresence) XXX_DiscardUnknown() {
+	xxx_messageInfo_Message_BlockPresence.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Message_BlockPresence proto.InternalMessageInfo
+
+func (m *Message_BlockPresence) GetCid() []byte {
+	if m != nil {
+		return m.Cid
+	}
+	return nil
+}
+
+func (m *Message_BlockPresence) GetType() Message_BlockPresenceType {
+	if m != nil {
+		return m.Type
+	}
+	return Message_Have
+}
+
 func init() {
 	proto.RegisterType((*Message)(nil), "bitswap.message.pb.Message")
 	proto.RegisterType((*Message_Wantlist)(nil), "bitswap.message.pb.Message.Wantlist")
 	proto.RegisterType((*Message_Wantlist_Entry)(nil), "bitswap.message.pb.Message.Wantlist.Entry")
 	proto.RegisterType((*Message_Block)(nil), "bitswap.message.pb.Message.Block")
+	proto.RegisterType((*Message_BlockPresence)(nil), "bitswap.message.pb.Message.BlockPresence")
+	proto.RegisterEnum("bitswap.message.pb.Message_BlockPresenceType", Message_BlockPresenceType_name, Message_BlockPresenceType_value)
+	proto.RegisterEnum("bitswap.message.pb.Message_Wantlist_WantType", Message_Wantlist_WantType_name, Message_Wantlist_WantType_value)
 }
 func (m *Message) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
@@ -302,6 +429,18 @@ func (m *Message) MarshalTo(dAtA []byte) (int, error) {
 			i += n
 		}
 	}
+	if len(m.BlockPresences) > 0 {
+		for _, msg := range m.BlockPresences {
+			dAtA[i] = 0x22
+			i++
+			i = encodeVarintMessage(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
 	return i, nil
 }
 
@@ -381,6 +520,21 @@ func (m *Message_Wantlist_Entry) MarshalTo(dAtA []byte) (int, error) {
 		}
 		i++
 	}
+	if m.WantType != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintMessage(dAtA, i, uint64(m.WantType))
+	}
+	if m.SendDontHave {
+		dAtA[i] = 0x28
+		i++
+		if m.SendDontHave {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
 	return i, nil
 }
 
@@ -414,6 +568,35 @@ func (m *Message_Block) MarshalTo(dAtA []byte) (int, error) {
 	return i, nil
 }
 
+func (m *Message_BlockPresence) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Message_BlockPresence) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Cid) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintMessage(dAtA, i, uint64(len(m.Cid)))
+		i += copy(dAtA[i:], m.Cid)
+	}
+	if m.Type != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintMessage(dAtA, i, uint64(m.Type))
+	}
+	return i, nil
+}
+
 func encodeVarintMessage(dAtA []byte, offset int, v uint64) int {
 	for v >= 1<<7 {
 		dAtA[offset] = uint8(v&0x7f | 0x80)
@@ -440,6 +623,12 @@ func (m *Message) Size() (n int) {
 			n += 1 + l + sovMessage(uint64(l))
 		}
 	}
+	if len(m.BlockPresences) > 0 {
+		for _, e := range m.BlockPresences {
+			l = e.Size()
+			n += 1 + l + sovMessage(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -471,6 +660,12 @@ func (m *Message_Wantlist_Entry) Size() (n int) {
 	if m.Cancel {
 		n += 2
 	}
+	if m.WantType != 0 {
+		n += 1 + sovMessage(uint64(m.WantType))
+	}
+	if m.SendDontHave {
+		n += 2
+	}
 	return n
 }
 
@@ -488,6 +683,19 @@ func (m *Message_Block) Size() (n int) {
 	return n
 }
 
+func (m *Message_BlockPresence) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Cid)
+	if l > 0 {
+		n += 1 + l + sovMessage(uint64(l))
+	}
+	if m.Type != 0 {
+		n += 1 + sovMessage(uint64(m.Type))
+	}
+	return n
+}
+
 func sovMessage(x uint64) (n int) {
 	for {
 		n++
@@ -620,6 +828,37 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BlockPresences", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.BlockPresences = append(m.BlockPresences, Message_BlockPresence{})
+			if err := m.BlockPresences[len(m.BlockPresences)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
@@ -841,6 +1080,45 @@ func (m *Message_Wantlist_Entry) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Cancel = bool(v != 0)
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WantType", wireType)
+			}
+			m.WantType = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.WantType |= (Message_Wantlist_WantType(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SendDontHave", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.SendDontHave = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
@@ -974,6 +1252,106 @@ func (m *Message_Block) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *Message_BlockPresence) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowMessage
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: BlockPresence: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: BlockPresence: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cid", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cid = append(m.Cid[:0], dAtA[iNdEx:postIndex]...)
+			if m.Cid == nil {
+				m.Cid = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			m.Type = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Type |= (Message_BlockPresenceType(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipMessage(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthMessage
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipMessage(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -1079,29 +1457,37 @@ var (
 	ErrIntOverflowMessage   = fmt.Errorf("proto: integer overflow")
 )
 
-func init() { proto.RegisterFile("message.proto", fileDescriptor_message_c28309e4affd853b) }
-
-var fileDescriptor_message_c28309e4affd853b = []byte{
-	// 328 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x91, 0xcf, 0x4a, 0xf3, 0x40,
-	0x14, 0xc5, 0x3b, 0x4d, 0xd3, 0x86, 0xdb, 0x7e, 0xf0, 0x31, 0x88, 0x84, 0x2c, 0x62, 0x14, 0x17,
-	0x41, 0x70, 0x0a, 0xed, 0x13, 0x58, 0xd0, 0x85, 0xe0, 0xc2, 0x6c, 0x5c, 0x4f, 0xd2, 0x34, 0x0e,
-	0xa6, 0x99, 0x30, 0x33, 0xa5, 0xf6, 0x2d, 0x7c, 0x05, 0x1f, 0xc4, 0x7d, 0x97, 0x3e, 0x81, 0x48,
-	0x7d, 0x11, 0xc9, 0xed, 0x34, 0x1b, 0x41, 0xdc, 0xdd, 0x33, 0x9c, 0xf3, 0xbb, 0x7f, 0x06, 0xfe,
-	0x2d, 0x73, 0xad, 0x79, 0x91, 0xb3, 0x5a, 0x49, 0x23, 0x29, 0x4d, 0x85, 0xd1, 0x6b, 0x5e, 0xb3,
-	0xf6, 0x39, 0x0d, 0x2e, 0x0b, 0x61, 0x1e, 0x57, 0x29, 0xcb, 0xe4, 0x72, 0x5c, 0xc8, 0x42, 0x8e,
-	0xd1, 0x9a, 0xae, 0x16, 0xa8, 0x50, 0x60, 0xb5, 0x47, 0x9c, 0xbd, 0x3a, 0x30, 0xb8, 0xdb, 0xa7,
-	0xe9, 0x0d, 0x78, 0x6b, 0x5e, 0x99, 0x52, 0x68, 0xe3, 0x93, 0x88, 0xc4, 0xc3, 0xc9, 0x39, 0xfb,
-	0xd9, 0x81, 0x59, 0x3b, 0x7b, 0xb0, 0xde, 0x59, 0x6f, 0xfb, 0x71, 0xd2, 0x49, 0xda, 0x2c, 0x3d,
-	0x86, 0x7e, 0x5a, 0xca, 0xec, 0x49, 0xfb, 0xdd, 0xc8, 0x89, 0x47, 0x89, 0x55, 0xf4, 0x0a, 0x06,
-	0x35, 0xdf, 0x94, 0x92, 0xcf, 0x7d, 0x27, 0x72, 0xe2, 0xe1, 0xe4, 0xf4, 0x37, 0xfc, 0xac, 0x09,
-	0x59, 0xf6, 0x21, 0x17, 0xbc, 0x11, 0xf0, 0x0e, 0x7d, 0xe9, 0x2d, 0x0c, 0xf2, 0xca, 0x28, 0x91,
-	0x6b, 0x9f, 0x20, 0xef, 0xe2, 0x2f, 0xe3, 0xb2, 0xeb, 0xca, 0xa8, 0xcd, 0x01, 0x6c, 0x01, 0x94,
-	0x42, 0x6f, 0xb1, 0x2a, 0x4b, 0xbf, 0x1b, 0x91, 0xd8, 0x4b, 0xb0, 0x0e, 0xee, 0xc1, 0x45, 0x2f,
-	0x3d, 0x02, 0x17, 0x57, 0xc0, 0xab, 0x8c, 0x92, 0xbd, 0xa0, 0x01, 0x78, 0xb5, 0x12, 0x52, 0x09,
-	0xb3, 0xc1, 0x98, 0x9b, 0xb4, 0xba, 0x39, 0x41, 0xc6, 0xab, 0x2c, 0x2f, 0x7d, 0x07, 0x81, 0x56,
-	0x05, 0x53, 0x70, 0x71, 0xaf, 0xc6, 0x50, 0xab, 0x7c, 0x21, 0x9e, 0x2d, 0xd3, 0xaa, 0x66, 0x8e,
-	0x39, 0x37, 0x1c, 0x81, 0xa3, 0x04, 0xeb, 0xd9, 0xff, 0xed, 0x2e, 0x24, 0xef, 0xbb, 0x90, 0x7c,
-	0xee, 0x42, 0xf2, 0xf2, 0x15, 0x76, 0xd2, 0x3e, 0x7e, 0xde, 0xf4, 0x3b, 0x00, 0x00, 0xff, 0xff,
-	0xd1, 0x6a, 0x3a, 0xa2, 0x10, 0x02, 0x00, 0x00,
+func init() { proto.RegisterFile("message.proto", fileDescriptor_message_79048fcae24d6374) }
+
+var fileDescriptor_message_79048fcae24d6374 = []byte{
+	// 457 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x93, 0xd1, 0x8a, 0xd3, 0x4e,
+	0x14, 0xc6, 0x3b, 0x4d, 0xd2, 0xe6, 0x7f, 0x36, 0xbb, 0xe4, 0x3f, 0x88, 0x0c, 0xb9, 0xe8, 0xc6,
+	0xe2, 0x45, 0x54, 0x36, 0x0b, 0xdd, 0x27, 0xd8, 0xa2, 0xa2, 0x82, 0x20, 0x41, 0xe8, 0xf5, 0x24,
+	0x99, 0xd6, 0x60, 0x36, 0x13, 0x32, 0x53, 0xd7, 0xbe, 0x85, 0x4f, 0xe0, 0xb3, 0x78, 0xb9, 0x57,
+	0xe2, 0x13, 0x88, 0xd4, 0x17, 0x91, 0x9c, 0x4c, 0x02, 0x75, 0xc1, 0xdd, 0xbb, 0xf3, 0x4d, 0xce,
+	0xf7, 0x9b, 0xf3, 0x9d, 0x21, 0x70, 0x7c, 0x25, 0x94, 0xe2, 0x1b, 0x11, 0xd7, 0x8d, 0xd4, 0x92,
+	0xd2, 0xb4, 0xd0, 0xea, 0x9a, 0xd7, 0xf1, 0x70, 0x9c, 0x06, 0x67, 0x9b, 0x42, 0x7f, 0xd8, 0xa6,
+	0x71, 0x26, 0xaf, 0xce, 0x37, 0x72, 0x23, 0xcf, 0xb1, 0x35, 0xdd, 0xae, 0x51, 0xa1, 0xc0, 0xaa,
+	0x43, 0xcc, 0xbf, 0x4e, 0x60, 0xfa, 0xb6, 0x73, 0xd3, 0x97, 0xe0, 0x5e, 0xf3, 0x4a, 0x97, 0x85,
+	0xd2, 0x8c, 0x84, 0x24, 0x3a, 0x5a, 0x3c, 0x8e, 0x6f, 0xdf, 0x10, 0x9b, 0xf6, 0x78, 0x65, 0x7a,
+	0x97, 0xf6, 0xcd, 0xcf, 0xd3, 0x51, 0x32, 0x78, 0xe9, 0x43, 0x98, 0xa4, 0xa5, 0xcc, 0x3e, 0x2a,
+	0x36, 0x0e, 0xad, 0xc8, 0x4b, 0x8c, 0xa2, 0x97, 0x30, 0xad, 0xf9, 0xae, 0x94, 0x3c, 0x67, 0x56,
+	0x68, 0x45, 0x47, 0x8b, 0x47, 0xff, 0xc2, 0x2f, 0x5b, 0x93, 0x61, 0xf7, 0x3e, 0xba, 0x82, 0x13,
+	0x84, 0xbd, 0x6b, 0x84, 0x12, 0x55, 0x26, 0x14, 0xb3, 0x91, 0xf4, 0xe4, 0x4e, 0x52, 0xef, 0x30,
+	0xc4, 0xbf, 0x30, 0xc1, 0xf7, 0x31, 0xb8, 0x7d, 0x20, 0xfa, 0x06, 0xa6, 0xa2, 0xd2, 0x4d, 0x21,
+	0x14, 0x23, 0x88, 0x7f, 0x7a, 0x9f, 0x3d, 0xc4, 0x2f, 0x2a, 0xdd, 0xec, 0xfa, 0x89, 0x0d, 0x80,
+	0x52, 0xb0, 0xd7, 0xdb, 0xb2, 0x64, 0xe3, 0x90, 0x44, 0x6e, 0x82, 0x75, 0xf0, 0x8d, 0x80, 0x83,
+	0xcd, 0xf4, 0x01, 0x38, 0x38, 0x08, 0xee, 0xdb, 0x4b, 0x3a, 0x41, 0x03, 0x70, 0xeb, 0xa6, 0x90,
+	0x4d, 0xa1, 0x77, 0xe8, 0x73, 0x92, 0x41, 0xb7, 0xcb, 0xcd, 0x78, 0x95, 0x89, 0x92, 0x59, 0x48,
+	0x34, 0x8a, 0xbe, 0xee, 0x1e, 0xef, 0xfd, 0xae, 0x16, 0xcc, 0x0e, 0x49, 0x74, 0xb2, 0x38, 0xbb,
+	0xd7, 0xd0, 0x2b, 0x63, 0x4a, 0x06, 0x3b, 0x9d, 0x83, 0xa7, 0x44, 0x95, 0x3f, 0x97, 0x95, 0x7e,
+	0xc5, 0x3f, 0x09, 0xe6, 0xe0, 0x45, 0x07, 0x67, 0xf3, 0xd3, 0x6e, 0x5d, 0xd8, 0xff, 0x1f, 0x38,
+	0xb8, 0x62, 0x7f, 0x44, 0x5d, 0xb0, 0xdb, 0xcf, 0x3e, 0x09, 0x2e, 0xcc, 0x61, 0x3b, 0x70, 0xdd,
+	0x88, 0x75, 0xf1, 0xd9, 0x64, 0x34, 0xaa, 0x5d, 0x4c, 0xce, 0x35, 0xc7, 0x80, 0x5e, 0x82, 0x75,
+	0x90, 0xc3, 0xf1, 0xc1, 0x63, 0x51, 0x1f, 0xac, 0xac, 0xc8, 0x8d, 0xb3, 0x2d, 0xe9, 0x25, 0xd8,
+	0xba, 0xcd, 0x38, 0xbe, 0x3b, 0xe3, 0x01, 0x0a, 0x33, 0xa2, 0x75, 0xfe, 0x0c, 0xfe, 0xbf, 0xf5,
+	0x69, 0x98, 0x7c, 0x44, 0x3d, 0x70, 0xfb, 0x98, 0x3e, 0x59, 0xfa, 0x37, 0xfb, 0x19, 0xf9, 0xb1,
+	0x9f, 0x91, 0x5f, 0xfb, 0x19, 0xf9, 0xf2, 0x7b, 0x36, 0x4a, 0x27, 0xf8, 0xe7, 0x5c, 0xfc, 0x19,
+	0x00, 0x99, 0x93, 0x5b, 0xd1, 0x8d, 0x03, 0x00, 0x00,
 }
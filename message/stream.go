@@ -0,0 +1,263 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+
+	pb "github.com/ipfs/go-bitswap/message/pb"
+)
+
+// streamBufferSize is the size of the buffer the headers of the fields are
+// gathered in between the blocks, which are mostly written past it
+const streamBufferSize = 4096
+
+// protobuf keys of the Message fields written out separately
+const (
+	keyBlocks  = 2<<3 | 2
+	keyPayload = 3<<3 | 2
+	// keys of the Message_Block fields
+	keyPrefix = 1<<3 | 2
+	keyData   = 2<<3 | 2
+)
+
+// sizeVarint returns the size of x encoded as a varint
+func sizeVarint(x uint64) int {
+	return (bits.Len64(x|1) + 6) / 7
+}
+
+// sizeBytesField returns the size of a length-delimited field holding l bytes
+func sizeBytesField(l int) int {
+	return 1 + sizeVarint(uint64(l)) + l
+}
+
+// sizePayload returns the size of the Message_Block holding the block
+func sizePayload(prefix []byte, data []byte) int {
+	var n int
+	if len(prefix) > 0 {
+		n += sizeBytesField(len(prefix))
+	}
+	if len(data) > 0 {
+		n += sizeBytesField(len(data))
+	}
+	return n
+}
+
+// writeDelimited writes the message as a varint-delimited protobuf. The
+// wantlist and block presences are small and encoded up front, but the blocks
+// are written straight from their data, rather than copied into the encoded
+// message first.
+func (m *impl) writeDelimited(w io.Writer, v1 bool) error {
+	head := m.protoHead(v1)
+	headSize := head.Size()
+
+	blks := m.Blocks()
+	prefixes := make([][]byte, len(blks))
+	size := headSize
+	for i, b := range blks {
+		if v1 {
+			prefixes[i] = b.Cid().Prefix().Bytes()
+			size += sizeBytesField(sizePayload(prefixes[i], b.RawData()))
+		} else {
+			size += sizeBytesField(len(b.RawData()))
+		}
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64+headSize)
+	n := binary.PutUvarint(buf, uint64(size))
+	if _, err := head.MarshalTo(buf[n:]); err != nil {
+		return err
+	}
+
+	// the headers are gathered in the writer's own buffer if it has one
+	bw, buffered := w.(*bufio.Writer)
+	if !buffered {
+		bw = bufio.NewWriterSize(w, streamBufferSize)
+	}
+	if _, err := bw.Write(buf[:n+headSize]); err != nil {
+		return err
+	}
+	var hdr [1 + binary.MaxVarintLen64]byte
+	writeHeader := func(key byte, l int) error {
+		hdr[0] = key
+		n := binary.PutUvarint(hdr[1:], uint64(l))
+		_, err := bw.Write(hdr[:1+n])
+		return err
+	}
+	for i, b := range blks {
+		data := b.RawData()
+		if !v1 {
+			if err := writeHeader(keyBlocks, len(data)); err != nil {
+				return err
+			}
+			if _, err := bw.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := writeHeader(keyPayload, sizePayload(prefixes[i], data)); err != nil {
+			return err
+		}
+		if len(prefixes[i]) > 0 {
+			if err := writeHeader(keyPrefix, len(prefixes[i])); err != nil {
+				return err
+			}
+			if _, err := bw.Write(prefixes[i]); err != nil {
+				return err
+			}
+		}
+		if len(data) > 0 {
+			if err := writeHeader(keyData, len(data)); err != nil {
+				return err
+			}
+			if _, err := bw.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	if buffered {
+		return nil
+	}
+	return bw.Flush()
+}
+
+// Reader reads varint-delimited messages off a stream. Each message is read
+// into a buffer of its own, and its large blocks are decoded in place rather
+// than copied out of it, so that they're only allocated once. Small blocks are
+// copied out, so that keeping one doesn't keep the whole buffer in memory.
+type Reader struct {
+	r       *bufio.Reader
+	maxSize int
+}
+
+// NewReader returns a Reader of messages of up to maxSize bytes
+func NewReader(r io.Reader, maxSize int) *Reader {
+	return &Reader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// ReadMsg reads the next message. It returns io.EOF if the stream ended
+// cleanly between messages, and a MalformedError if the message can't be
+// decoded.
+func (r *Reader) ReadMsg() (BitSwapMessage, error) {
+	length64, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	if length64 > uint64(r.maxSize) {
+		return nil, io.ErrShortBuffer
+	}
+	buf := make([]byte, length64)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	m, err := decodeMessage(buf)
+	if err != nil {
+		return nil, &MalformedError{Err: err}
+	}
+	return m, nil
+}
+
+var errTruncated = errors.New("truncated protobuf")
+
+// nextField splits the next field off the encoded message, returning its
+// number and, for length-delimited fields, its contents
+func nextField(data []byte) (field uint64, val []byte, rest []byte, err error) {
+	key, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, nil, errTruncated
+	}
+	data = data[n:]
+	field = key >> 3
+
+	switch key & 7 {
+	case 0: // varint
+		_, n = binary.Uvarint(data)
+		if n <= 0 {
+			return 0, nil, nil, errTruncated
+		}
+		return field, nil, data[n:], nil
+	case 1: // fixed64
+		if len(data) < 8 {
+			return 0, nil, nil, errTruncated
+		}
+		return field, nil, data[8:], nil
+	case 2: // length-delimited
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return 0, nil, nil, errTruncated
+		}
+		end := n + int(l)
+		return field, data[n:end:end], data[end:], nil
+	case 5: // fixed32
+		if len(data) < 4 {
+			return 0, nil, nil, errTruncated
+		}
+		return field, nil, data[4:], nil
+	default:
+		return 0, nil, nil, errors.New("unsupported protobuf wire type")
+	}
+}
+
+// inPlaceFraction is the fraction of the message buffer a block has to take
+// up at least for it to be left in the buffer. Keeping such a block alive
+// keeps at most that many times its size in memory.
+const inPlaceFraction = 4
+
+// decodeMessage decodes the message, leaving the data of its large blocks in
+// the buffer
+func decodeMessage(data []byte) (BitSwapMessage, error) {
+	var pbm pb.Message
+	minInPlace := len(data) / inPlaceFraction
+	blockData := func(b []byte) []byte {
+		if len(b) >= minInPlace {
+			return b
+		}
+		return append([]byte(nil), b...)
+	}
+	for len(data) > 0 {
+		field, val, rest, err := nextField(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		switch field {
+		case 1:
+			if err := pbm.Wantlist.Unmarshal(val); err != nil {
+				return nil, err
+			}
+		case 2:
+			pbm.Blocks = append(pbm.Blocks, blockData(val))
+		case 3:
+			var blk pb.Message_Block
+			for len(val) > 0 {
+				field, bval, brest, err := nextField(val)
+				if err != nil {
+					return nil, err
+				}
+				val = brest
+				switch field {
+				case 1:
+					blk.Prefix = bval
+				case 2:
+					blk.Data = blockData(bval)
+				}
+			}
+			pbm.Payload = append(pbm.Payload, blk)
+		case 4:
+			var bp pb.Message_BlockPresence
+			if err := bp.Unmarshal(val); err != nil {
+				return nil, err
+			}
+			pbm.BlockPresences = append(pbm.BlockPresences, bp)
+		}
+	}
+	return newMessageFromProto(pbm)
+}
@@ -0,0 +1,199 @@
+package bitswap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+const (
+	// defaultPeerMetricsLimit is the number of peers that get metrics of
+	// their own by default
+	defaultPeerMetricsLimit = 64
+	// metricsSampleInterval is how often the gauges are brought up to date
+	metricsSampleInterval = 10 * time.Second
+	// otherPeersScope is the scope the metrics of the peers past the limit
+	// are added up under
+	otherPeersScope = "peer_other"
+)
+
+var (
+	// sessionLifetimeBuckets are in seconds
+	sessionLifetimeBuckets = []float64{1, 10, 60, 600, 3600, 6 * 3600}
+)
+
+// peerMetrics are the metrics kept for a single peer, or for all the peers
+// past the limit together
+type peerMetrics struct {
+	// slot is the number of the peer_slot scope the metrics are under
+	slot int
+
+	bytesSent    metrics.Counter
+	bytesRecvd   metrics.Counter
+	dupBlocks    metrics.Counter
+	wantlistSize metrics.Gauge
+}
+
+func newPeerMetrics(ctx context.Context) *peerMetrics {
+	return &peerMetrics{
+		bytesSent: metrics.NewCtx(ctx, "sent_bytes",
+			"Bytes of blocks sent to the peer.").Counter(),
+		bytesRecvd: metrics.NewCtx(ctx, "recv_bytes",
+			"Bytes of blocks received from the peer.").Counter(),
+		dupBlocks: metrics.NewCtx(ctx, "recv_dup_blocks",
+			"Number of duplicate blocks received from the peer.").Counter(),
+		wantlistSize: metrics.NewCtx(ctx, "wantlist_size",
+			"Number of wants in the peer's wantlist with us.").Gauge(),
+	}
+}
+
+// bitswapMetrics keeps the metrics of the peers we exchange blocks with and
+// of bitswap's queues. Metrics systems handle a bounded number of series
+// best, so there are only as many peer_slot_<n> scopes as the limit. Each
+// connected peer takes a slot as long as there's one free, and gives it up
+// when it disconnects, for the next peer to reuse. The peers that find no
+// slot free are added up under the peer_other scope. Which peer each slot
+// currently describes is given by Bitswap.PeerMetricsSlots.
+type bitswapMetrics struct {
+	ctx   context.Context
+	limit int
+
+	lk    sync.Mutex
+	peers map[peer.ID]*peerMetrics
+	free  []*peerMetrics
+	slots int
+	other *peerMetrics
+
+	queuedRequests  metrics.Gauge
+	pendingMessages metrics.Gauge
+	provideQueue    metrics.Gauge
+	sessions        metrics.Gauge
+	sessionLifetime metrics.Histogram
+}
+
+func newBitswapMetrics(ctx context.Context, limit int) *bitswapMetrics {
+	return &bitswapMetrics{
+		ctx:   ctx,
+		limit: limit,
+		peers: make(map[peer.ID]*peerMetrics),
+		queuedRequests: metrics.NewCtx(ctx, "peer_request_queue_depth",
+			"Number of blocks and presences queued up for peers.").Gauge(),
+		pendingMessages: metrics.NewCtx(ctx, "msg_queue_pending",
+			"Number of peers with a message waiting to be sent to them.").Gauge(),
+		provideQueue: metrics.NewCtx(ctx, "provide_queue_depth",
+			"Number of blocks waiting to be provided.").Gauge(),
+		sessions: metrics.NewCtx(ctx, "sessions_active",
+			"Number of active sessions.").Gauge(),
+		sessionLifetime: metrics.NewCtx(ctx, "session_lifetime_seconds",
+			"Histogram of how long sessions last.").Histogram(sessionLifetimeBuckets),
+	}
+}
+
+// forPeer returns the metrics of the given peer, giving it a slot of its own
+// the first time it's seen if there's one free
+func (bm *bitswapMetrics) forPeer(p peer.ID) *peerMetrics {
+	bm.lk.Lock()
+	defer bm.lk.Unlock()
+	pm, _ := bm.forPeerLocked(p)
+	return pm
+}
+
+// forPeerLocked is forPeer, also returning false if the peer shares the
+// metrics of the other peers. bm.lk must be held.
+func (bm *bitswapMetrics) forPeerLocked(p peer.ID) (*peerMetrics, bool) {
+	if pm, ok := bm.peers[p]; ok {
+		return pm, true
+	}
+	if n := len(bm.free); n > 0 {
+		pm := bm.free[n-1]
+		bm.free = bm.free[:n-1]
+		bm.peers[p] = pm
+		log.Debugf("peer %s takes over metrics slot %d", p, pm.slot)
+		return pm, true
+	}
+	if bm.slots < bm.limit {
+		pm := newPeerMetrics(metrics.CtxSubScope(bm.ctx, fmt.Sprintf("peer_slot_%d", bm.slots)))
+		pm.slot = bm.slots
+		bm.slots++
+		bm.peers[p] = pm
+		log.Debugf("peer %s takes metrics slot %d", p, pm.slot)
+		return pm, true
+	}
+	if bm.other == nil {
+		bm.other = newPeerMetrics(metrics.CtxSubScope(bm.ctx, otherPeersScope))
+	}
+	return bm.other, false
+}
+
+// releasePeer frees the slot of a peer that went away for the next peer to
+// reuse. Its gauges are zeroed; the counters carry on from the peer's, so
+// it's their rates that describe whoever has the slot.
+func (bm *bitswapMetrics) releasePeer(p peer.ID) {
+	bm.lk.Lock()
+	defer bm.lk.Unlock()
+	pm, ok := bm.peers[p]
+	if !ok {
+		return
+	}
+	pm.wantlistSize.Set(0)
+	delete(bm.peers, p)
+	bm.free = append(bm.free, pm)
+}
+
+// slotsByPeer returns the slot of each peer that has one
+func (bm *bitswapMetrics) slotsByPeer() map[peer.ID]int {
+	bm.lk.Lock()
+	defer bm.lk.Unlock()
+	out := make(map[peer.ID]int, len(bm.peers))
+	for p, pm := range bm.peers {
+		out[p] = pm.slot
+	}
+	return out
+}
+
+// PeerMetricsSlots returns the number of the peer_slot_<n> metrics scope of
+// each peer that has one
+func (bs *Bitswap) PeerMetricsSlots() map[peer.ID]int {
+	return bs.metrics.slotsByPeer()
+}
+
+// sampleWantlists sets the wantlist size of each peer, and of the other peers
+// altogether. Peers that are gone are set to zero.
+func (bm *bitswapMetrics) sampleWantlists(sizes map[peer.ID]int) {
+	bm.lk.Lock()
+	defer bm.lk.Unlock()
+
+	var other int
+	for p, n := range sizes {
+		if pm, own := bm.forPeerLocked(p); own {
+			pm.wantlistSize.Set(float64(n))
+		} else {
+			other += n
+		}
+	}
+	for p, pm := range bm.peers {
+		if _, ok := sizes[p]; !ok {
+			pm.wantlistSize.Set(0)
+		}
+	}
+	if bm.other != nil {
+		bm.other.wantlistSize.Set(float64(other))
+	}
+}
+
+// sampleMetrics brings the gauges up to date
+func (bs *Bitswap) sampleMetrics() {
+	bm := bs.metrics
+	bm.sampleWantlists(bs.engine.WantlistSizes())
+	bm.queuedRequests.Set(float64(bs.engine.QueuedRequests()))
+	bm.pendingMessages.Set(float64(bs.wm.PendingMessages()))
+	bm.provideQueue.Set(float64(len(bs.newBlocks) + bs.provideQueue.len() + len(bs.provideKeys)))
+
+	bs.sessLk.Lock()
+	bm.sessions.Set(float64(len(bs.sessions)))
+	bs.sessLk.Unlock()
+}
@@ -0,0 +1,68 @@
+package bitswap
+
+import (
+	"context"
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestPeerMetricsBounded(t *testing.T) {
+	bm := newBitswapMetrics(context.Background(), 2)
+	a := bm.forPeer(peer.ID("a"))
+	b := bm.forPeer(peer.ID("b"))
+	c := bm.forPeer(peer.ID("c"))
+	d := bm.forPeer(peer.ID("d"))
+
+	if a == b || a == c || b == c {
+		t.Fatal("expected the peers within the limit to have metrics of their own")
+	}
+	if c != d {
+		t.Fatal("expected the peers past the limit to share metrics")
+	}
+	if bm.forPeer(peer.ID("a")) != a {
+		t.Fatal("expected a peer to keep its metrics")
+	}
+	if len(bm.peers) != 2 {
+		t.Fatal("expected only two peers to be tracked, got", len(bm.peers))
+	}
+
+	bm.sampleWantlists(map[peer.ID]int{"a": 1, "e": 2, "f": 3})
+	if len(bm.peers) != 2 {
+		t.Fatal("sampling shouldn't track more peers, got", len(bm.peers))
+	}
+
+	// a peer that goes away makes room for the next one, which reuses its
+	// series
+	bm.releasePeer(peer.ID("a"))
+	if e := bm.forPeer(peer.ID("e")); e != a {
+		t.Fatal("expected the next peer to take over the freed slot")
+	}
+	if slots := bm.slotsByPeer(); len(slots) != 2 || slots["e"] != 0 || slots["b"] != 1 {
+		t.Fatal("unexpected slots", slots)
+	}
+	if bm.forPeer(peer.ID("a")) != c {
+		t.Fatal("expected a peer coming back with no slot free to share metrics")
+	}
+}
+
+func TestSampleMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vnet := getVirtualNetwork()
+	sesgen := NewTestSessionGenerator(vnet)
+	defer sesgen.Close()
+	inst := sesgen.Instances(2)
+	a := inst[0]
+
+	a.Exchange.NewSession(ctx)
+	a.Exchange.sampleMetrics()
+
+	// the connected peer's wantlist was sampled
+	a.Exchange.metrics.lk.Lock()
+	defer a.Exchange.metrics.lk.Unlock()
+	if _, ok := a.Exchange.metrics.peers[inst[1].Peer]; !ok || len(a.Exchange.metrics.peers) != 1 {
+		t.Fatal("expected metrics for the connected peer only")
+	}
+}
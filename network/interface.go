@@ -2,6 +2,8 @@ package network
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	bsmsg "github.com/ipfs/go-bitswap/message"
 
@@ -16,7 +18,11 @@ var (
 	ProtocolBitswapOne    protocol.ID = "/ipfs/bitswap/1.0.0"
 	ProtocolBitswapNoVers protocol.ID = "/ipfs/bitswap"
 
-	ProtocolBitswap protocol.ID = "/ipfs/bitswap/1.1.0"
+	ProtocolBitswapOneOne protocol.ID = "/ipfs/bitswap/1.1.0"
+
+	// ProtocolBitswap adds want-have entries, the send-dont-have flag and
+	// HAVE / DONT_HAVE block presence responses
+	ProtocolBitswap protocol.ID = "/ipfs/bitswap/1.2.0"
 )
 
 // BitSwapNetwork provides network connectivity for BitSwap sessions
@@ -34,6 +40,9 @@ type BitSwapNetwork interface {
 
 	ConnectTo(context.Context, peer.ID) error
 
+	// DisconnectFrom closes our connections to the peer
+	DisconnectFrom(context.Context, peer.ID) error
+
 	NewMessageSender(context.Context, peer.ID) (MessageSender, error)
 
 	ConnectionManager() ifconnmgr.ConnManager
@@ -49,6 +58,14 @@ type MessageSender interface {
 	Reset() error
 }
 
+// HaveSupporter is implemented by MessageSenders that know which protocol the
+// peer speaks. Peers that predate ProtocolBitswap treat want-haves as
+// want-blocks, and never respond with HAVE or DONT_HAVE. Senders that don't
+// implement it are assumed to speak ProtocolBitswap.
+type HaveSupporter interface {
+	SupportsHave() bool
+}
+
 // Implement Receiver to receive messages from the BitSwapNetwork
 type Receiver interface {
 	ReceiveMessage(
@@ -63,6 +80,17 @@ type Receiver interface {
 	PeerDisconnected(peer.ID)
 }
 
+// MessageError is passed to Receiver.ReceiveError when a message from Peer
+// couldn't be read
+type MessageError struct {
+	Peer peer.ID
+	Err  error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("message from %s: %s", e.Peer, e.Err)
+}
+
 type Routing interface {
 	// FindProvidersAsync returns a channel of providers for the given key
 	FindProvidersAsync(context.Context, cid.Cid, int) <-chan peer.ID
@@ -71,6 +99,20 @@ type Routing interface {
 	Provide(context.Context, cid.Cid) error
 }
 
+// ManyProvider is implemented by networks, and the content routers under
+// them, that can provide many keys at once, which is much cheaper than
+// providing them one by one
+type ManyProvider interface {
+	// ProvideMany provides all the keys to the network. It returns
+	// ErrProvideManyUnsupported if the router can't provide in batches after
+	// all.
+	ProvideMany(context.Context, []cid.Cid) error
+}
+
+// ErrProvideManyUnsupported is returned by ProvideMany when the router doesn't
+// provide in batches, and the keys should be provided one by one instead
+var ErrProvideManyUnsupported = errors.New("router does not support providing in batches")
+
 // NetworkStats is a container for statistics about the bitswap network
 // the numbers inside are specific to bitswap, and not any other protocols
 // using the same underlying network.
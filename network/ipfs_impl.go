@@ -10,7 +10,6 @@ import (
 
 	bsmsg "github.com/ipfs/go-bitswap/message"
 
-	ggio "github.com/gogo/protobuf/io"
 	cid "github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
 	host "github.com/libp2p/go-libp2p-host"
@@ -33,6 +32,7 @@ func NewFromIpfsHost(host host.Host, r routing.ContentRouting) BitSwapNetwork {
 		routing: r,
 	}
 	host.SetStreamHandler(ProtocolBitswap, bitswapNetwork.handleNewStream)
+	host.SetStreamHandler(ProtocolBitswapOneOne, bitswapNetwork.handleNewStream)
 	host.SetStreamHandler(ProtocolBitswapOne, bitswapNetwork.handleNewStream)
 	host.SetStreamHandler(ProtocolBitswapNoVers, bitswapNetwork.handleNewStream)
 	host.Network().Notify((*netNotifiee)(&bitswapNetwork))
@@ -65,6 +65,11 @@ func (s *streamMessageSender) Reset() error {
 	return s.s.Reset()
 }
 
+// SupportsHave implements HaveSupporter
+func (s *streamMessageSender) SupportsHave() bool {
+	return s.s.Protocol() == ProtocolBitswap
+}
+
 func (s *streamMessageSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
 	return msgToStream(ctx, s.s, msg)
 }
@@ -81,7 +86,10 @@ func msgToStream(ctx context.Context, s inet.Stream, msg bsmsg.BitSwapMessage) e
 	w := bufio.NewWriter(s)
 
 	switch s.Protocol() {
-	case ProtocolBitswap:
+	case ProtocolBitswap, ProtocolBitswapOneOne:
+		// 1.1.0 peers drop the want types and take every want for a
+		// want-block, so the message queues leave want-haves out of what
+		// they send them (see HaveSupporter)
 		if err := msg.ToNetV1(w); err != nil {
 			log.Debugf("error: %s", err)
 			return err
@@ -116,7 +124,7 @@ func (bsnet *impl) NewMessageSender(ctx context.Context, p peer.ID) (MessageSend
 }
 
 func (bsnet *impl) newStreamToPeer(ctx context.Context, p peer.ID) (inet.Stream, error) {
-	return bsnet.host.NewStream(ctx, p, ProtocolBitswap, ProtocolBitswapOne, ProtocolBitswapNoVers)
+	return bsnet.host.NewStream(ctx, p, ProtocolBitswap, ProtocolBitswapOneOne, ProtocolBitswapOne, ProtocolBitswapNoVers)
 }
 
 func (bsnet *impl) SendMessage(
@@ -149,6 +157,10 @@ func (bsnet *impl) ConnectTo(ctx context.Context, p peer.ID) error {
 	return bsnet.host.Connect(ctx, pstore.PeerInfo{ID: p})
 }
 
+func (bsnet *impl) DisconnectFrom(ctx context.Context, p peer.ID) error {
+	return bsnet.host.Network().ClosePeer(p)
+}
+
 // FindProvidersAsync returns a channel of providers for the given key
 func (bsnet *impl) FindProvidersAsync(ctx context.Context, k cid.Cid, max int) <-chan peer.ID {
 
@@ -190,6 +202,16 @@ func (bsnet *impl) Provide(ctx context.Context, k cid.Cid) error {
 	return bsnet.routing.Provide(ctx, k, true)
 }
 
+// ProvideMany provides the keys to the network in one go, if the router is a
+// ManyProvider too
+func (bsnet *impl) ProvideMany(ctx context.Context, ks []cid.Cid) error {
+	pm, ok := bsnet.routing.(ManyProvider)
+	if !ok {
+		return ErrProvideManyUnsupported
+	}
+	return pm.ProvideMany(ctx, ks)
+}
+
 // handleNewStream receives a new stream from the network.
 func (bsnet *impl) handleNewStream(s inet.Stream) {
 	defer s.Close()
@@ -199,19 +221,19 @@ func (bsnet *impl) handleNewStream(s inet.Stream) {
 		return
 	}
 
-	reader := ggio.NewDelimitedReader(s, inet.MessageSizeMax)
+	reader := bsmsg.NewReader(s, inet.MessageSizeMax)
+	p := s.Conn().RemotePeer()
 	for {
-		received, err := bsmsg.FromPBReader(reader)
+		received, err := reader.ReadMsg()
 		if err != nil {
 			if err != io.EOF {
 				s.Reset()
-				go bsnet.receiver.ReceiveError(err)
-				log.Debugf("bitswap net handleNewStream from %s error: %s", s.Conn().RemotePeer(), err)
+				go bsnet.receiver.ReceiveError(&MessageError{Peer: p, Err: err})
+				log.Debugf("bitswap net handleNewStream from %s error: %s", p, err)
 			}
 			return
 		}
 
-		p := s.Conn().RemotePeer()
 		ctx := context.Background()
 		log.Debugf("bitswap net handleNewStream from %s", s.Conn().RemotePeer())
 		bsnet.receiver.ReceiveMessage(ctx, p, received)
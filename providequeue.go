@@ -0,0 +1,251 @@
+package bitswap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	namespace "github.com/ipfs/go-datastore/namespace"
+	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+// provideQueuePrefix is the namespace the provide queue is kept under in the
+// datastore
+var provideQueuePrefix = ds.NewKey("/bitswap/provide-queue")
+
+// provideQueue holds the blocks waiting to be provided in a datastore, so
+// that they are still provided after a restart. Entries are keyed by their
+// position in the queue, and only deleted once they have been provided;
+// entries handed out but not provided yet are provided again on restart, and
+// entries that failed to be provided are retried with a backoff.
+type provideQueue struct {
+	ds    ds.Datastore
+	clock clock.Clock
+
+	lk sync.Mutex
+	// waiting are the positions of the entries to hand out, in order, and
+	// tail the position the next entry is added at
+	waiting []uint64
+	tail    uint64
+	// retries are the entries that failed to be provided, by when they're
+	// due to be handed out again
+	retries []provideRetry
+	// next is the entry peek returned, and nextRetry whether it's a retry
+	next      queueEntry
+	nextRetry bool
+	// inflight are the entries handed out, by cid
+	inflight map[cid.Cid][]queueEntry
+
+	// retried is signalled when an entry is queued up to be retried
+	retried chan struct{}
+}
+
+// queueEntry is the position of an entry, and the number of times it failed
+// to be provided
+type queueEntry struct {
+	pos      uint64
+	failures int
+}
+
+type provideRetry struct {
+	queueEntry
+	at time.Time
+}
+
+const (
+	// provideRetryDelay is how long an entry that failed to be provided
+	// waits to be retried, doubling with each failure up to
+	// provideRetryMaxDelay
+	provideRetryDelay    = time.Minute
+	provideRetryMaxDelay = time.Hour
+)
+
+// newProvideQueue opens the queue kept in the given datastore
+func newProvideQueue(d ds.Datastore, clk clock.Clock) (*provideQueue, error) {
+	q := &provideQueue{
+		ds:       namespace.Wrap(d, provideQueuePrefix),
+		clock:    clk,
+		inflight: make(map[cid.Cid][]queueEntry),
+		retried:  make(chan struct{}, 1),
+	}
+
+	res, err := q.ds.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		pos, err := strconv.ParseUint(strings.TrimPrefix(e.Key, "/"), 10, 64)
+		if err != nil {
+			log.Warningf("ignoring unexpected key %s in the provide queue", e.Key)
+			continue
+		}
+		q.waiting = append(q.waiting, pos)
+		if pos >= q.tail {
+			q.tail = pos + 1
+		}
+	}
+	sort.Slice(q.waiting, func(i, j int) bool { return q.waiting[i] < q.waiting[j] })
+	if len(q.waiting) > 0 {
+		log.Infof("resuming provide queue of %d blocks", len(q.waiting))
+	}
+	return q, nil
+}
+
+// openProvideQueue opens the provide queue in the datastore it's configured
+// with, falling back to one kept in memory
+func (bs *Bitswap) openProvideQueue() *provideQueue {
+	if bs.provideQueueDs != nil {
+		q, err := newProvideQueue(bs.provideQueueDs, bs.clock)
+		if err == nil {
+			return q
+		}
+		log.Errorf("failed to open the provide queue, keeping it in memory: %s", err)
+	}
+	q, _ := newProvideQueue(dssync.MutexWrap(ds.NewMapDatastore()), bs.clock)
+	return q
+}
+
+func queueKey(pos uint64) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/%020d", pos))
+}
+
+// enqueue adds the cid to the end of the queue
+func (q *provideQueue) enqueue(c cid.Cid) error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if err := q.ds.Put(queueKey(q.tail), c.Bytes()); err != nil {
+		return err
+	}
+	q.waiting = append(q.waiting, q.tail)
+	q.tail++
+	return nil
+}
+
+// peek returns the cid of the next entry to hand out, and false if there's
+// none. Retries that are due go first.
+func (q *provideQueue) peek() (cid.Cid, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	now := q.clock.Now()
+	for {
+		switch {
+		case len(q.retries) > 0 && !q.retries[0].at.After(now):
+			q.next, q.nextRetry = q.retries[0].queueEntry, true
+		case len(q.waiting) > 0:
+			q.next, q.nextRetry = queueEntry{pos: q.waiting[0]}, false
+		default:
+			return cid.Cid{}, false
+		}
+		c, err := q.get(q.next.pos)
+		if err == nil {
+			return c, true
+		}
+		// drop entries that can't be read rather than getting stuck on them
+		log.Warningf("dropping unreadable provide queue entry %d: %s", q.next.pos, err)
+		q.ds.Delete(queueKey(q.next.pos))
+		q.remove()
+	}
+}
+
+// remove takes the entry peek returned off the queue. q.lk must be held.
+func (q *provideQueue) remove() {
+	if !q.nextRetry {
+		q.waiting = q.waiting[1:]
+		return
+	}
+	for i, r := range q.retries {
+		if r.pos == q.next.pos {
+			q.retries = append(q.retries[:i], q.retries[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextRetryAt returns when the next retry is due, and false if there's none
+func (q *provideQueue) nextRetryAt() (time.Time, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if len(q.retries) == 0 {
+		return time.Time{}, false
+	}
+	return q.retries[0].at, true
+}
+
+// get reads the cid at the position. q.lk must be held.
+func (q *provideQueue) get(pos uint64) (cid.Cid, error) {
+	b, err := q.ds.Get(queueKey(pos))
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	return cid.Cast(b)
+}
+
+// pop hands out the cid of the entry peek returned
+func (q *provideQueue) pop(c cid.Cid) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.inflight[c] = append(q.inflight[c], q.next)
+	q.remove()
+}
+
+// done removes the cid handed out from the queue once it was provided. If it
+// couldn't be, it's queued up to be retried once its backoff has passed.
+func (q *provideQueue) done(c cid.Cid, provided bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	entries, ok := q.inflight[c]
+	if !ok {
+		return
+	}
+	delete(q.inflight, c)
+	for _, e := range entries {
+		if !provided {
+			q.retry(e)
+			continue
+		}
+		if err := q.ds.Delete(queueKey(e.pos)); err != nil {
+			log.Warningf("failed to remove %s from the provide queue: %s", c, err)
+		}
+	}
+}
+
+// retry queues up the entry to be handed out again, after a delay doubling
+// with each failure. q.lk must be held.
+func (q *provideQueue) retry(e queueEntry) {
+	e.failures++
+	delay := provideRetryDelay
+	for i := 1; i < e.failures && delay < provideRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > provideRetryMaxDelay {
+		delay = provideRetryMaxDelay
+	}
+	r := provideRetry{queueEntry: e, at: q.clock.Now().Add(delay)}
+	i := sort.Search(len(q.retries), func(i int) bool { return q.retries[i].at.After(r.at) })
+	q.retries = append(q.retries, provideRetry{})
+	copy(q.retries[i+1:], q.retries[i:])
+	q.retries[i] = r
+	select {
+	case q.retried <- struct{}{}:
+	default:
+	}
+}
+
+// len returns the number of cids waiting to be handed out, retries included
+func (q *provideQueue) len() int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return len(q.waiting) + len(q.retries)
+}
@@ -0,0 +1,210 @@
+package bitswap
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+	bsnet "github.com/ipfs/go-bitswap/network"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+const (
+	// defaultMaxProviderQueries bounds the provider queries running at once
+	defaultMaxProviderQueries = 16
+	// defaultProviderCacheTTL is how long the providers found for a cid are
+	// handed out again rather than searched for anew
+	defaultProviderCacheTTL = 30 * time.Second
+)
+
+// providerQuery is a search for the providers of a cid, shared by everyone
+// that asks for them while it runs, and until its results expire
+type providerQuery struct {
+	c      cid.Cid
+	ctx    context.Context
+	cancel func()
+
+	// the fields below are guarded by the manager's lock. updated is closed
+	// and replaced whenever a provider is found, and when the query finishes
+	providers []peer.ID
+	updated   chan struct{}
+	finished  bool
+	// subs is the number of requests waiting on the query
+	subs int
+}
+
+// providerQueryManager runs the searches for providers of the cids we want,
+// bounding how many run at once and how long each runs for. Requests for the
+// same cid share a single search, and are handed the providers it found for a
+// short while after it finished.
+type providerQueryManager struct {
+	ctx     context.Context
+	network bsnet.BitSwapNetwork
+	clock   clock.Clock
+	tracer  Tracer
+
+	maxProviders int
+	timeout      time.Duration
+	cacheTTL     time.Duration
+
+	// limit holds a token for each query running
+	limit chan struct{}
+
+	lk      sync.Mutex
+	queries map[cid.Cid]*providerQuery
+}
+
+func newProviderQueryManager(ctx context.Context, network bsnet.BitSwapNetwork, clk clock.Clock, tracer Tracer,
+	maxQueries, maxProviders int, timeout, cacheTTL time.Duration) *providerQueryManager {
+	if maxQueries <= 0 {
+		maxQueries = defaultMaxProviderQueries
+	}
+	if timeout <= 0 {
+		timeout = providerRequestTimeout
+	}
+	return &providerQueryManager{
+		ctx:          ctx,
+		network:      network,
+		clock:        clk,
+		tracer:       tracer,
+		maxProviders: maxProviders,
+		timeout:      timeout,
+		cacheTTL:     cacheTTL,
+		limit:        make(chan struct{}, maxQueries),
+		queries:      make(map[cid.Cid]*providerQuery),
+	}
+}
+
+// FindProvidersAsync returns the providers of the cid, found by the search in
+// progress or one started on behalf of the given session. The channel is
+// closed once the search is over, or the context is cancelled.
+func (pqm *providerQueryManager) FindProvidersAsync(ctx context.Context, c cid.Cid, ses uint64) <-chan peer.ID {
+	pqm.lk.Lock()
+	q, ok := pqm.queries[c]
+	if !ok || (!q.finished && q.ctx.Err() != nil) {
+		// there's no query to join, or it's being cancelled
+		q = pqm.startQuery(c, ses)
+	}
+	q.subs++
+	pqm.lk.Unlock()
+
+	out := make(chan peer.ID)
+	go pqm.subscribe(ctx, q, out)
+	return out
+}
+
+// startQuery starts a query for the cid. pqm.lk must be held.
+func (pqm *providerQueryManager) startQuery(c cid.Cid, ses uint64) *providerQuery {
+	ctx, cancel := context.WithCancel(pqm.ctx)
+	q := &providerQuery{
+		c:       c,
+		ctx:     ctx,
+		cancel:  cancel,
+		updated: make(chan struct{}),
+	}
+	pqm.queries[c] = q
+	go pqm.runQuery(q, ses)
+	return q
+}
+
+// subscribe sends the providers the query finds on the channel, starting with
+// those it already found
+func (pqm *providerQueryManager) subscribe(ctx context.Context, q *providerQuery, out chan<- peer.ID) {
+	defer close(out)
+
+	var sent int
+	for {
+		pqm.lk.Lock()
+		found := q.providers[sent:]
+		finished := q.finished
+		updated := q.updated
+		pqm.lk.Unlock()
+
+		for _, p := range found {
+			select {
+			case out <- p:
+				sent++
+			case <-ctx.Done():
+				pqm.unsubscribe(q)
+				return
+			}
+		}
+		if len(found) > 0 {
+			continue
+		}
+		if finished {
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			pqm.unsubscribe(q)
+			return
+		}
+	}
+}
+
+// unsubscribe gives up on the query, which is cancelled once nobody is
+// waiting on it anymore
+func (pqm *providerQueryManager) unsubscribe(q *providerQuery) {
+	pqm.lk.Lock()
+	defer pqm.lk.Unlock()
+	q.subs--
+	if q.subs == 0 && !q.finished {
+		q.cancel()
+	}
+}
+
+func (pqm *providerQueryManager) runQuery(q *providerQuery, ses uint64) {
+	defer q.cancel()
+
+	select {
+	case pqm.limit <- struct{}{}:
+		defer func() { <-pqm.limit }()
+		pqm.search(q, ses)
+	case <-q.ctx.Done():
+	}
+
+	pqm.lk.Lock()
+	defer pqm.lk.Unlock()
+	q.finished = true
+	close(q.updated)
+
+	// keep the providers found around for a while, unless there are none or
+	// the search was cut short
+	if len(q.providers) == 0 || q.ctx.Err() != nil {
+		if pqm.queries[q.c] == q {
+			delete(pqm.queries, q.c)
+		}
+		return
+	}
+	pqm.clock.AfterFunc(pqm.cacheTTL, func() {
+		pqm.lk.Lock()
+		defer pqm.lk.Unlock()
+		if pqm.queries[q.c] == q {
+			delete(pqm.queries, q.c)
+		}
+	})
+}
+
+// search runs the query against the network
+func (pqm *providerQueryManager) search(q *providerQuery, ses uint64) {
+	ctx, cancel := context.WithTimeout(q.ctx, pqm.timeout)
+	defer cancel()
+
+	traceEvent(pqm.tracer, Event{Type: EventProviderSearchStarted, Cid: q.c, Session: ses})
+	found := 0
+	for p := range pqm.network.FindProvidersAsync(ctx, q.c, pqm.maxProviders) {
+		found++
+		pqm.lk.Lock()
+		q.providers = append(q.providers, p)
+		close(q.updated)
+		q.updated = make(chan struct{})
+		pqm.lk.Unlock()
+	}
+	traceEvent(pqm.tracer, Event{Type: EventProviderSearchFinished, Cid: q.c, Session: ses, Providers: found})
+}
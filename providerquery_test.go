@@ -0,0 +1,185 @@
+package bitswap
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+	bsnet "github.com/ipfs/go-bitswap/network"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+	tu "github.com/libp2p/go-testutil"
+)
+
+// providersNetwork answers provider searches with its providers once
+// released, or never if it has none
+type providersNetwork struct {
+	bsnet.BitSwapNetwork
+	providers []peer.ID
+	release   chan struct{}
+
+	lk       sync.Mutex
+	searches int
+	running  int
+	maxRun   int
+}
+
+func (pn *providersNetwork) FindProvidersAsync(ctx context.Context, c cid.Cid, max int) <-chan peer.ID {
+	pn.lk.Lock()
+	pn.searches++
+	pn.running++
+	if pn.running > pn.maxRun {
+		pn.maxRun = pn.running
+	}
+	pn.lk.Unlock()
+
+	out := make(chan peer.ID)
+	go func() {
+		defer close(out)
+		defer func() {
+			pn.lk.Lock()
+			pn.running--
+			pn.lk.Unlock()
+		}()
+		if len(pn.providers) == 0 {
+			<-ctx.Done()
+			return
+		}
+		select {
+		case <-pn.release:
+		case <-ctx.Done():
+			return
+		}
+		for _, p := range pn.providers {
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (pn *providersNetwork) status() (searches, running, maxRun int) {
+	pn.lk.Lock()
+	defer pn.lk.Unlock()
+	return pn.searches, pn.running, pn.maxRun
+}
+
+func collectProviders(ch <-chan peer.ID) chan []peer.ID {
+	res := make(chan []peer.ID, 1)
+	go func() {
+		var ps []peer.ID
+		for p := range ch {
+			ps = append(ps, p)
+		}
+		res <- ps
+	}()
+	return res
+}
+
+func TestProviderQueriesShared(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clk := clock.NewMock()
+	pn := &providersNetwork{
+		providers: []peer.ID{tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)},
+		release:   make(chan struct{}),
+	}
+	pqm := newProviderQueryManager(ctx, pn, clk, nil, 4, 10, time.Minute, time.Second)
+	c := testCids(1)[0]
+
+	// requests while the search runs share it
+	first := collectProviders(pqm.FindProvidersAsync(ctx, c, 1))
+	second := collectProviders(pqm.FindProvidersAsync(ctx, c, 2))
+	waitFor(t, func() bool { _, running, _ := pn.status(); return running == 1 })
+	close(pn.release)
+	for _, res := range []chan []peer.ID{first, second} {
+		if ps := <-res; len(ps) != 2 {
+			t.Fatal("expected both providers, got", ps)
+		}
+	}
+
+	// and so do requests shortly after, until the results expire
+	if ps := <-collectProviders(pqm.FindProvidersAsync(ctx, c, 3)); len(ps) != 2 {
+		t.Fatal("expected the cached providers, got", ps)
+	}
+	if searches, _, _ := pn.status(); searches != 1 {
+		t.Fatal("expected a single search, got", searches)
+	}
+	clk.Add(time.Second)
+	if ps := <-collectProviders(pqm.FindProvidersAsync(ctx, c, 3)); len(ps) != 2 {
+		t.Fatal("expected the providers to be found again, got", ps)
+	}
+	if searches, _, _ := pn.status(); searches != 2 {
+		t.Fatal("expected a new search once the results expired, got", searches)
+	}
+}
+
+func TestProviderQueriesLimited(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pn := &providersNetwork{}
+	pqm := newProviderQueryManager(ctx, pn, clock.New(), nil, 2, 10, 50*time.Millisecond, time.Second)
+
+	// no more than the limit run at once, and each is cut short by the
+	// timeout
+	var results []chan []peer.ID
+	for _, c := range testCids(5) {
+		results = append(results, collectProviders(pqm.FindProvidersAsync(ctx, c, 0)))
+	}
+	for _, res := range results {
+		if ps := <-res; len(ps) != 0 {
+			t.Fatal("expected no providers, got", ps)
+		}
+	}
+	if searches, _, maxRun := pn.status(); searches != 5 || maxRun != 2 {
+		t.Fatalf("expected 5 searches, 2 at a time, got %d, %d at a time", searches, maxRun)
+	}
+}
+
+func TestProviderQueryLimitsDefaulted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pn := &providersNetwork{providers: []peer.ID{tu.RandPeerIDFatal(t)}, release: make(chan struct{})}
+	close(pn.release)
+	pqm := newProviderQueryManager(ctx, pn, clock.New(), nil, 0, 10, 0, time.Second)
+
+	// a zero limit and timeout neither hold the search back nor cut it short
+	if ps := <-collectProviders(pqm.FindProvidersAsync(ctx, testCids(1)[0], 0)); len(ps) != 1 {
+		t.Fatal("expected the provider to be found, got", ps)
+	}
+}
+
+func TestProviderQueryCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pn := &providersNetwork{}
+	pqm := newProviderQueryManager(ctx, pn, clock.New(), nil, 2, 10, time.Minute, time.Second)
+	c := testCids(1)[0]
+
+	// the search goes on while anyone is waiting on it
+	rctx1, rcancel1 := context.WithCancel(ctx)
+	rctx2, rcancel2 := context.WithCancel(ctx)
+	first := collectProviders(pqm.FindProvidersAsync(rctx1, c, 0))
+	second := collectProviders(pqm.FindProvidersAsync(rctx2, c, 0))
+	waitFor(t, func() bool { _, running, _ := pn.status(); return running == 1 })
+
+	rcancel1()
+	<-first
+	time.Sleep(20 * time.Millisecond)
+	if _, running, _ := pn.status(); running != 1 {
+		t.Fatal("expected the search to go on for the other request")
+	}
+	rcancel2()
+	<-second
+	waitFor(t, func() bool { _, running, _ := pn.status(); return running == 0 })
+}
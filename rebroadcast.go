@@ -0,0 +1,156 @@
+package bitswap
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+	wantlist "github.com/ipfs/go-bitswap/wantlist"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	// defaultRebroadcastBudget is the number of provider searches started
+	// for stale wants every rebroadcast interval
+	defaultRebroadcastBudget = 4
+	// maxRebroadcastBackoff bounds the time between searches for the
+	// providers of a want
+	maxRebroadcastBackoff = time.Hour
+)
+
+// ScheduledWant is a want in the rebroadcast schedule
+type ScheduledWant struct {
+	Cid cid.Cid
+	// Added is when the want was first seen in the wantlist
+	Added time.Time
+	// Searches is the number of provider searches started for the want, the
+	// latest at LastSearch
+	Searches   int
+	LastSearch time.Time
+	// NextSearch is when the want is next due a search, budget permitting
+	NextSearch time.Time
+}
+
+// rebroadcastSchedule decides which wants get a provider search each
+// rebroadcast interval. Wants are due a search once they have gone unanswered
+// for an interval, and then after twice as long each time, up to
+// maxRebroadcastBackoff. Of the wants due, the oldest are searched for first,
+// up to the budget.
+type rebroadcastSchedule struct {
+	clock    clock.Clock
+	interval time.Duration
+	budget   int
+
+	lk    sync.Mutex
+	wants map[cid.Cid]*ScheduledWant
+}
+
+func newRebroadcastSchedule(clk clock.Clock, interval time.Duration, budget int) *rebroadcastSchedule {
+	return &rebroadcastSchedule{
+		clock:    clk,
+		interval: interval,
+		budget:   budget,
+		wants:    make(map[cid.Cid]*ScheduledWant),
+	}
+}
+
+// sync brings the schedule in line with the wantlist, adding the new wants
+// and dropping the ones no longer wanted
+func (rs *rebroadcastSchedule) sync(entries []*wantlist.Entry) {
+	now := rs.clock.Now()
+
+	rs.lk.Lock()
+	defer rs.lk.Unlock()
+	wanted := make(map[cid.Cid]struct{}, len(entries))
+	for _, e := range entries {
+		wanted[e.Cid] = struct{}{}
+		if _, ok := rs.wants[e.Cid]; !ok {
+			rs.wants[e.Cid] = &ScheduledWant{
+				Cid:        e.Cid,
+				Added:      now,
+				NextSearch: now.Add(rs.interval),
+			}
+		}
+	}
+	for c := range rs.wants {
+		if _, ok := wanted[c]; !ok {
+			delete(rs.wants, c)
+		}
+	}
+}
+
+// due returns the wants to search for providers of now, and schedules their
+// next search
+func (rs *rebroadcastSchedule) due() []cid.Cid {
+	now := rs.clock.Now()
+
+	rs.lk.Lock()
+	defer rs.lk.Unlock()
+	var due []*ScheduledWant
+	for _, w := range rs.wants {
+		if !w.NextSearch.After(now) {
+			due = append(due, w)
+		}
+	}
+	sortScheduledWants(due)
+	if len(due) > rs.budget {
+		due = due[:rs.budget]
+	}
+
+	out := make([]cid.Cid, 0, len(due))
+	for _, w := range due {
+		w.Searches++
+		w.LastSearch = now
+		w.NextSearch = now.Add(rs.backoff(w.Searches))
+		out = append(out, w.Cid)
+	}
+	return out
+}
+
+// backoff returns how long to wait before searching again for a want after
+// the given number of searches
+func (rs *rebroadcastSchedule) backoff(searches int) time.Duration {
+	d := rs.interval
+	for i := 0; i < searches && d < maxRebroadcastBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRebroadcastBackoff {
+		d = maxRebroadcastBackoff
+	}
+	return d
+}
+
+// snapshot returns the wants in the schedule, oldest first
+func (rs *rebroadcastSchedule) snapshot() []ScheduledWant {
+	rs.lk.Lock()
+	ws := make([]*ScheduledWant, 0, len(rs.wants))
+	for _, w := range rs.wants {
+		ws = append(ws, w)
+	}
+	sortScheduledWants(ws)
+	out := make([]ScheduledWant, len(ws))
+	for i, w := range ws {
+		out[i] = *w
+	}
+	rs.lk.Unlock()
+	return out
+}
+
+// sortScheduledWants sorts the wants oldest first, breaking ties by cid so
+// that the order is stable
+func sortScheduledWants(ws []*ScheduledWant) {
+	sort.Slice(ws, func(i, j int) bool {
+		if !ws[i].Added.Equal(ws[j].Added) {
+			return ws[i].Added.Before(ws[j].Added)
+		}
+		return ws[i].Cid.KeyString() < ws[j].Cid.KeyString()
+	})
+}
+
+// RebroadcastSchedule returns the wants tracked for provider searches, oldest
+// first, for debugging
+func (bs *Bitswap) RebroadcastSchedule() []ScheduledWant {
+	return bs.rebroadcast.snapshot()
+}
@@ -0,0 +1,99 @@
+package bitswap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+	wantlist "github.com/ipfs/go-bitswap/wantlist"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+func wantEntries(ks ...cid.Cid) []*wantlist.Entry {
+	var es []*wantlist.Entry
+	for _, k := range ks {
+		es = append(es, &wantlist.Entry{Cid: k})
+	}
+	return es
+}
+
+func TestRebroadcastSchedule(t *testing.T) {
+	clk := clock.NewMock()
+	rs := newRebroadcastSchedule(clk, time.Minute, 2)
+	ks := testCids(3)
+
+	rs.sync(wantEntries(ks[0]))
+	clk.Add(10 * time.Second)
+	rs.sync(wantEntries(ks...))
+
+	// wants are only searched for once they're stale, oldest first
+	if due := rs.due(); len(due) != 0 {
+		t.Fatal("expected no wants due yet, got", due)
+	}
+	clk.Add(50 * time.Second)
+	assertCids(t, rs.due(), ks[:1])
+	clk.Add(10 * time.Second)
+	if due := rs.due(); len(due) != 2 || due[0].Equals(ks[0]) || due[1].Equals(ks[0]) {
+		t.Fatal("expected the newer wants due, got", due)
+	}
+
+	// and then backed off from, within the budget
+	clk.Add(time.Minute)
+	if due := rs.due(); len(due) != 0 {
+		t.Fatal("expected the searches to back off, got", due)
+	}
+	clk.Add(50 * time.Second)
+	assertCids(t, rs.due(), ks[:1])
+
+	sched := rs.snapshot()
+	if len(sched) != 3 || !sched[0].Cid.Equals(ks[0]) {
+		t.Fatal("expected the oldest want first, got", sched)
+	}
+	if w := sched[0]; w.Searches != 2 || !w.NextSearch.Equal(w.LastSearch.Add(4*time.Minute)) {
+		t.Fatalf("unexpected schedule %+v", w)
+	}
+
+	// wants no longer in the wantlist are dropped
+	rs.sync(wantEntries(ks[1:]...))
+	if sched := rs.snapshot(); len(sched) != 2 {
+		t.Fatal("expected the dropped want to be gone, got", sched)
+	}
+
+	if d := rs.backoff(100); d != maxRebroadcastBackoff {
+		t.Fatal("expected the backoff to be bounded, got", d)
+	}
+}
+
+func TestRebroadcastScheduleTracksWantlist(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clk := clock.NewMock()
+	sg := NewTestSessionGenerator(getVirtualNetwork(), Clock(clk), ProviderSearchDelay(time.Hour))
+	defer sg.Close()
+	bs := sg.Next().Exchange
+
+	k := testCids(1)[0]
+	if _, err := bs.GetBlocks(ctx, []cid.Cid{k}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(bs.GetWantlist()) == 1 })
+	waitFor(t, func() bool {
+		clk.Add(10 * time.Second)
+		sched := bs.RebroadcastSchedule()
+		return len(sched) == 1 && sched[0].Cid.Equals(k)
+	})
+
+	// the want is searched for once it's gone unanswered for an interval
+	added := bs.RebroadcastSchedule()[0].Added
+	waitFor(t, func() bool {
+		clk.Add(10 * time.Second)
+		sched := bs.RebroadcastSchedule()
+		return len(sched) == 1 && sched[0].Searches == 1
+	})
+	if sched := bs.RebroadcastSchedule(); sched[0].LastSearch.Sub(added) < time.Minute {
+		t.Fatalf("expected the want to be searched for once stale, got %+v", sched[0])
+	}
+}
@@ -0,0 +1,244 @@
+// Package replay records the messages a live bitswap node exchanges, and
+// replays the request pattern of a recording in the virtual testnet.
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	bsnet "github.com/ipfs/go-bitswap/network"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Direction is whether a recorded message was sent or received
+type Direction string
+
+const (
+	// Sent is a message sent by the recording node
+	Sent Direction = "sent"
+	// Received is a message received by the recording node
+	Received Direction = "received"
+)
+
+// Record is a single message sent or received by the Local node. Only the
+// metadata of blocks is kept, not their data.
+type Record struct {
+	Time  time.Time `json:"time"`
+	Dir   Direction `json:"dir"`
+	Local string    `json:"local"`
+	Peer  string    `json:"peer"`
+
+	Full      bool     `json:"full,omitempty"`
+	Wants     []Want   `json:"wants,omitempty"`
+	Blocks    []Block  `json:"blocks,omitempty"`
+	Haves     []string `json:"haves,omitempty"`
+	DontHaves []string `json:"dontHaves,omitempty"`
+}
+
+// Want is a recorded wantlist entry. WantType is "block" or "have".
+type Want struct {
+	Cid          string `json:"cid"`
+	Priority     int    `json:"priority"`
+	WantType     string `json:"wantType"`
+	Cancel       bool   `json:"cancel,omitempty"`
+	SendDontHave bool   `json:"sendDontHave,omitempty"`
+}
+
+// Block is a recorded block
+type Block struct {
+	Cid  string `json:"cid"`
+	Size int    `json:"size"`
+}
+
+// newRecord captures the given message
+func newRecord(t time.Time, dir Direction, local, p peer.ID, m bsmsg.BitSwapMessage) Record {
+	rec := Record{
+		Time:  t,
+		Dir:   dir,
+		Local: local.Pretty(),
+		Peer:  p.Pretty(),
+		Full:  m.Full(),
+	}
+	for _, e := range m.Wantlist() {
+		w := Want{
+			Cid:          e.Cid.String(),
+			Priority:     e.Priority,
+			WantType:     "block",
+			Cancel:       e.Cancel,
+			SendDontHave: e.SendDontHave,
+		}
+		if e.WantType == pb.Message_Wantlist_Have {
+			w.WantType = "have"
+		}
+		rec.Wants = append(rec.Wants, w)
+	}
+	for _, b := range m.Blocks() {
+		rec.Blocks = append(rec.Blocks, Block{Cid: b.Cid().String(), Size: len(b.RawData())})
+	}
+	for _, c := range m.Haves() {
+		rec.Haves = append(rec.Haves, c.String())
+	}
+	for _, c := range m.DontHaves() {
+		rec.DontHaves = append(rec.DontHaves, c.String())
+	}
+	return rec
+}
+
+// LoadRecording reads the recording in the file at the given path
+func LoadRecording(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecording(f)
+}
+
+// ReadRecording reads a recording of one JSON encoded Record per line, as
+// written by a Recorder
+func ReadRecording(r io.Reader) ([]Record, error) {
+	var recs []Record
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// Recorder wraps the network of a live bitswap node, and writes a Record of
+// every message the node sends and receives
+type Recorder struct {
+	bsnet.BitSwapNetwork
+	self peer.ID
+
+	lk     sync.Mutex
+	w      io.Writer
+	enc    *json.Encoder
+	err    error
+	closed bool
+}
+
+// NewRecorder returns a Recorder of the messages the node with the given
+// peer ID exchanges over the given network, writing to the given writer.
+// Pass it to bitswap.New in place of the network.
+func NewRecorder(self peer.ID, network bsnet.BitSwapNetwork, w io.Writer) *Recorder {
+	return &Recorder{
+		BitSwapNetwork: network,
+		self:           self,
+		w:              w,
+		enc:            json.NewEncoder(w),
+	}
+}
+
+// NewFileRecorder returns a Recorder appending to the file at the given
+// path, creating it if necessary
+func NewFileRecorder(self peer.ID, network bsnet.BitSwapNetwork, path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(self, network, f), nil
+}
+
+func (r *Recorder) record(t time.Time, dir Direction, p peer.ID, m bsmsg.BitSwapMessage) {
+	rec := newRecord(t, dir, r.self, p, m)
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.closed {
+		return
+	}
+	if err := r.enc.Encode(rec); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Close stops recording, and closes the underlying writer if it is an
+// io.Closer. Records that failed to be written are dropped, and the first
+// error is returned.
+func (r *Recorder) Close() error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.closed {
+		return r.err
+	}
+	r.closed = true
+	if c, ok := r.w.(io.Closer); ok {
+		if err := c.Close(); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+	return r.err
+}
+
+// SendMessage implements bsnet.BitSwapNetwork
+func (r *Recorder) SendMessage(ctx context.Context, p peer.ID, m bsmsg.BitSwapMessage) error {
+	now := time.Now()
+	if err := r.BitSwapNetwork.SendMessage(ctx, p, m); err != nil {
+		return err
+	}
+	r.record(now, Sent, p, m)
+	return nil
+}
+
+// NewMessageSender implements bsnet.BitSwapNetwork
+func (r *Recorder) NewMessageSender(ctx context.Context, p peer.ID) (bsnet.MessageSender, error) {
+	s, err := r.BitSwapNetwork.NewMessageSender(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingSender{MessageSender: s, r: r, p: p}, nil
+}
+
+// SetDelegate implements bsnet.BitSwapNetwork
+func (r *Recorder) SetDelegate(rcv bsnet.Receiver) {
+	r.BitSwapNetwork.SetDelegate(&recordingReceiver{Receiver: rcv, r: r})
+}
+
+type recordingSender struct {
+	bsnet.MessageSender
+	r *Recorder
+	p peer.ID
+}
+
+func (s *recordingSender) SendMsg(ctx context.Context, m bsmsg.BitSwapMessage) error {
+	now := time.Now()
+	if err := s.MessageSender.SendMsg(ctx, m); err != nil {
+		return err
+	}
+	s.r.record(now, Sent, s.p, m)
+	return nil
+}
+
+// SupportsHave passes on whether the wrapped sender's peer supports
+// want-haves
+func (s *recordingSender) SupportsHave() bool {
+	if hs, ok := s.MessageSender.(bsnet.HaveSupporter); ok {
+		return hs.SupportsHave()
+	}
+	return true
+}
+
+type recordingReceiver struct {
+	bsnet.Receiver
+	r *Recorder
+}
+
+func (rr *recordingReceiver) ReceiveMessage(ctx context.Context, p peer.ID, m bsmsg.BitSwapMessage) {
+	rr.r.record(time.Now(), Received, p, m)
+	rr.Receiver.ReceiveMessage(ctx, p, m)
+}
@@ -0,0 +1,304 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bitswap "github.com/ipfs/go-bitswap"
+	tn "github.com/ipfs/go-bitswap/testnet"
+
+	blocks "github.com/ipfs/go-block-format"
+	delay "github.com/ipfs/go-ipfs-delay"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
+)
+
+// Scenario is the topology, block distribution and request pattern
+// reconstructed from a recording. Peers and cids are the strings they were
+// recorded as.
+type Scenario struct {
+	// Peers are all the peers seen in the recording
+	Peers []string
+	// Links are the pairs of peers that exchanged messages
+	Links [][2]string
+	// Have are the blocks each peer had before it was first sent them
+	Have map[string][]string
+	// Sizes are the sizes of the recorded blocks
+	Sizes map[string]int
+	// Wants are the first want of each peer for each block someone had, in
+	// the order they were made
+	Wants []TimedWant
+	// Skipped is the number of wants left out because no peer was seen to
+	// have the block
+	Skipped int
+}
+
+// TimedWant is a want for Cid made by Peer, At after the recording started
+type TimedWant struct {
+	Peer string
+	Cid  string
+	At   time.Duration
+}
+
+type peerCid struct {
+	p string
+	c string
+}
+
+// Reconstruct works out the scenario of the given recording, which may be
+// the concatenation of the recordings of several nodes. A peer is taken to
+// have had a block if it sent it before it received it, and to want a block
+// if it sent a want for it.
+func Reconstruct(recs []Record) *Scenario {
+	recs = append([]Record(nil), recs...)
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].Time.Before(recs[j].Time)
+	})
+
+	sc := &Scenario{
+		Have:  make(map[string][]string),
+		Sizes: make(map[string]int),
+	}
+	if len(recs) == 0 {
+		return sc
+	}
+	start := recs[0].Time
+
+	peers := make(map[string]struct{})
+	links := make(map[[2]string]struct{})
+	held := make(map[peerCid]bool)
+	got := make(map[peerCid]bool)
+	wanted := make(map[peerCid]bool)
+	holders := make(map[string]int)
+	var wants []TimedWant
+
+	for _, rec := range recs {
+		from, to := rec.Local, rec.Peer
+		if rec.Dir == Received {
+			from, to = to, from
+		}
+		for _, p := range []string{from, to} {
+			if _, ok := peers[p]; !ok {
+				peers[p] = struct{}{}
+				sc.Peers = append(sc.Peers, p)
+			}
+		}
+		link := [2]string{from, to}
+		if to < from {
+			link = [2]string{to, from}
+		}
+		if _, ok := links[link]; !ok {
+			links[link] = struct{}{}
+			sc.Links = append(sc.Links, link)
+		}
+
+		for _, b := range rec.Blocks {
+			sc.Sizes[b.Cid] = b.Size
+			k := peerCid{from, b.Cid}
+			if !got[k] && !held[k] {
+				held[k] = true
+				holders[b.Cid]++
+				sc.Have[from] = append(sc.Have[from], b.Cid)
+			}
+			got[peerCid{to, b.Cid}] = true
+		}
+		for _, w := range rec.Wants {
+			k := peerCid{from, w.Cid}
+			if w.Cancel || wanted[k] {
+				continue
+			}
+			wanted[k] = true
+			wants = append(wants, TimedWant{Peer: from, Cid: w.Cid, At: rec.Time.Sub(start)})
+		}
+	}
+
+	for _, w := range wants {
+		if held[peerCid{w.Peer, w.Cid}] {
+			continue
+		}
+		if holders[w.Cid] == 0 {
+			sc.Skipped++
+			continue
+		}
+		sc.Wants = append(sc.Wants, w)
+	}
+	sort.Strings(sc.Peers)
+	return sc
+}
+
+// Options configure a replay
+type Options struct {
+	// Latency is the delay of the virtual network. Defaults to 10ms.
+	Latency time.Duration
+	// Speedup divides the time between recorded wants. Zero replays them
+	// at the recorded pace.
+	Speedup float64
+	// BitswapOptions are passed to every node
+	BitswapOptions []bitswap.Option
+}
+
+// Stats summarizes a replay. Message and duplicate counts are totals over
+// all nodes.
+type Stats struct {
+	Nodes   int
+	Wants   int
+	Fetched int
+	Dups    uint64
+	MsgSent uint64
+	MsgRecd uint64
+	Time    time.Duration
+
+	// MeanLatency and MaxLatency are of the time from a want being made to
+	// the block arriving
+	MeanLatency time.Duration
+	MaxLatency  time.Duration
+}
+
+// FetchError is returned by Replay, along with the stats, when some wants
+// weren't fetched
+type FetchError struct {
+	// Failed are the wants not fetched, in the order they were made
+	Failed []TimedWant
+	// Err is what the first of them failed with
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	names := make([]string, len(e.Failed))
+	for i, w := range e.Failed {
+		names[i] = w.Peer + " " + w.Cid
+	}
+	return fmt.Sprintf("%d wants not fetched (%s): %s", len(e.Failed), strings.Join(names, ", "), e.Err)
+}
+
+// Replay sets up a node for each peer of the scenario in a virtual network,
+// connects them and gives them their blocks, then makes the scenario's
+// wants through a session per node. It returns once all wants are fetched
+// or failed, with a *FetchError and the stats so far if any failed. Wants
+// not yet fetched fail once the context is done.
+func Replay(ctx context.Context, sc *Scenario, opts Options) (*Stats, error) {
+	if opts.Latency == 0 {
+		opts.Latency = 10 * time.Millisecond
+	}
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(opts.Latency))
+	sg := bitswap.NewTestSessionGenerator(net, opts.BitswapOptions...)
+	defer sg.Close()
+
+	instances := make(map[string]bitswap.Instance, len(sc.Peers))
+	for _, p := range sc.Peers {
+		instances[p] = sg.Next()
+	}
+	defer func() {
+		for _, inst := range instances {
+			inst.Exchange.Close()
+		}
+	}()
+	for _, l := range sc.Links {
+		a, b := instances[l[0]], instances[l[1]]
+		if err := a.ConnectTo(ctx, b.Peer); err != nil {
+			return nil, err
+		}
+	}
+
+	// the recorded blocks can't be recreated, so stand-ins of the same
+	// size are made up for them
+	blks := make(map[string]blocks.Block, len(sc.Sizes))
+	for c, size := range sc.Sizes {
+		data := make([]byte, size)
+		if size < len(c) {
+			data = make([]byte, len(c))
+		}
+		copy(data, c)
+		blks[c] = blocks.NewBlock(data)
+	}
+	for p, cids := range sc.Have {
+		for _, c := range cids {
+			if err := instances[p].Exchange.HasBlock(blks[c]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sessions := make(map[string]exchange.Fetcher, len(sc.Peers))
+	for p, inst := range instances {
+		sessions[p] = inst.Exchange.NewSession(ctx)
+	}
+
+	speedup := opts.Speedup
+	if speedup <= 0 {
+		speedup = 1
+	}
+
+	st := &Stats{
+		Nodes: len(sc.Peers),
+		Wants: len(sc.Wants),
+	}
+	var lk sync.Mutex
+	var total time.Duration
+	var failed []TimedWant
+	var failErr error
+	fail := func(w TimedWant, err error) {
+		lk.Lock()
+		defer lk.Unlock()
+		if failErr == nil {
+			failErr = err
+		}
+		failed = append(failed, w)
+	}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, w := range sc.Wants {
+		wg.Add(1)
+		go func(w TimedWant) {
+			defer wg.Done()
+			timer := time.NewTimer(time.Duration(float64(w.At) / speedup))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				fail(w, ctx.Err())
+				return
+			}
+
+			requested := time.Now()
+			if _, err := sessions[w.Peer].GetBlock(ctx, blks[w.Cid].Cid()); err != nil {
+				fail(w, err)
+				return
+			}
+			latency := time.Since(requested)
+
+			lk.Lock()
+			defer lk.Unlock()
+			st.Fetched++
+			total += latency
+			if latency > st.MaxLatency {
+				st.MaxLatency = latency
+			}
+		}(w)
+	}
+	wg.Wait()
+	st.Time = time.Since(start)
+	if st.Fetched > 0 {
+		st.MeanLatency = total / time.Duration(st.Fetched)
+	}
+
+	for _, inst := range instances {
+		bst, err := inst.Exchange.Stat()
+		if err != nil {
+			return nil, err
+		}
+		nst := inst.NetworkStats()
+		st.Dups += bst.DupBlksReceived
+		st.MsgSent += nst.MessagesSent
+		st.MsgRecd += nst.MessagesRecvd
+	}
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].At < failed[j].At })
+		return st, &FetchError{Failed: failed, Err: failErr}
+	}
+	return st, nil
+}
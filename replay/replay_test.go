@@ -0,0 +1,166 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	bitswap "github.com/ipfs/go-bitswap"
+	tn "github.com/ipfs/go-bitswap/testnet"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	delay "github.com/ipfs/go-ipfs-delay"
+	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
+	p2ptestutil "github.com/libp2p/go-libp2p-netutil"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(10*time.Millisecond))
+	sg := bitswap.NewTestSessionGenerator(net)
+	defer sg.Close()
+	server := sg.Next()
+
+	id, err := p2ptestutil.RandTestBogusIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rec := NewRecorder(id.ID(), net.Adapter(id), &buf)
+	bstore := blockstore.NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	client := bitswap.New(ctx, rec, bstore).(*bitswap.Bitswap)
+	defer client.Close()
+	if err := rec.ConnectTo(ctx, server.Peer); err != nil {
+		t.Fatal(err)
+	}
+
+	bg := blocksutil.NewBlockGenerator()
+	blks := bg.Blocks(5)
+	var ks []cid.Cid
+	for _, blk := range blks {
+		if err := server.Exchange.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, blk.Cid())
+	}
+	out, err := client.NewSession(ctx).GetBlocks(ctx, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range blks {
+		if _, ok := <-out; !ok {
+			t.Fatal("didn't fetch all blocks")
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent, received bool
+	for _, r := range recs {
+		if r.Local != id.ID().Pretty() || r.Peer != server.Peer.Pretty() {
+			t.Fatal("unexpected peers in record", r)
+		}
+		sent = sent || (r.Dir == Sent && len(r.Wants) > 0)
+		received = received || (r.Dir == Received && len(r.Blocks) > 0)
+	}
+	if !sent || !received {
+		t.Fatal("expected wants sent and blocks received to be recorded")
+	}
+
+	sc := Reconstruct(recs)
+	if len(sc.Peers) != 2 || len(sc.Links) != 1 {
+		t.Fatal("expected two linked peers, got", sc.Peers, sc.Links)
+	}
+	if have := sc.Have[server.Peer.Pretty()]; len(have) != len(blks) {
+		t.Fatal("expected the server to have all blocks, got", have)
+	}
+	if len(sc.Wants) != len(blks) || sc.Skipped != 0 {
+		t.Fatalf("expected %d wants, got %d (%d skipped)", len(blks), len(sc.Wants), sc.Skipped)
+	}
+	for _, w := range sc.Wants {
+		if w.Peer != id.ID().Pretty() {
+			t.Fatal("expected wants to be made by the client", w)
+		}
+		if size := sc.Sizes[w.Cid]; size == 0 {
+			t.Fatal("expected the size of wanted blocks to be known")
+		}
+	}
+
+	st, err := Replay(ctx, sc, Options{Speedup: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Nodes != 2 || st.Fetched != len(blks) {
+		t.Fatalf("expected all blocks fetched between 2 nodes, got %+v", st)
+	}
+	if st.Dups != 0 || st.MsgSent == 0 || st.MeanLatency == 0 || st.MaxLatency < st.MeanLatency {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestReconstructSkipsUnknownBlocks(t *testing.T) {
+	start := time.Now()
+	recs := []Record{
+		{Time: start, Dir: Sent, Local: "a", Peer: "b", Wants: []Want{{Cid: "x"}, {Cid: "y"}}},
+		{Time: start.Add(time.Second), Dir: Received, Local: "a", Peer: "b", Blocks: []Block{{Cid: "x", Size: 10}}},
+		{Time: start.Add(2 * time.Second), Dir: Received, Local: "a", Peer: "c", Wants: []Want{{Cid: "x"}}},
+		{Time: start.Add(3 * time.Second), Dir: Sent, Local: "a", Peer: "c", Blocks: []Block{{Cid: "x", Size: 10}}},
+	}
+
+	sc := Reconstruct(recs)
+	if len(sc.Peers) != 3 || len(sc.Links) != 2 {
+		t.Fatal("expected three peers in two links, got", sc.Peers, sc.Links)
+	}
+	if len(sc.Have["b"]) != 1 || len(sc.Have["a"]) != 0 {
+		t.Fatal("only b should have had x, got", sc.Have)
+	}
+	if sc.Skipped != 1 {
+		t.Fatal("the want for y should have been skipped")
+	}
+	exp := []TimedWant{{"a", "x", 0}, {"c", "x", 2 * time.Second}}
+	if len(sc.Wants) != len(exp) {
+		t.Fatal("unexpected wants", sc.Wants)
+	}
+	for i, w := range sc.Wants {
+		if w != exp[i] {
+			t.Fatalf("expected want %v, got %v", exp[i], w)
+		}
+	}
+}
+
+func TestReplayReportsFailedWants(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// nobody has y
+	sc := &Scenario{
+		Peers: []string{"a", "b"},
+		Links: [][2]string{{"a", "b"}},
+		Have:  map[string][]string{"b": {"x"}},
+		Sizes: map[string]int{"x": 10, "y": 10},
+		Wants: []TimedWant{{"a", "x", 0}, {"a", "y", 0}},
+	}
+	st, err := Replay(ctx, sc, Options{})
+	ferr, ok := err.(*FetchError)
+	if !ok {
+		t.Fatal("expected a fetch error, got", err)
+	}
+	if len(ferr.Failed) != 1 || ferr.Failed[0] != sc.Wants[1] || ferr.Err != context.DeadlineExceeded {
+		t.Fatalf("expected only the want for y to fail, got %+v", ferr)
+	}
+	if st == nil || st.Fetched != 1 {
+		t.Fatalf("expected the stats of the want fetched, got %+v", st)
+	}
+}
@@ -0,0 +1,234 @@
+package bitswap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+const (
+	// defaultReprovideInterval is how often everything is provided again,
+	// well within the lifetime of provider records
+	defaultReprovideInterval = 12 * time.Hour
+	// reprovideInitialDelay is how long after starting up the first reprovide
+	// runs, to give the node a chance to connect to the network
+	reprovideInitialDelay = time.Minute
+)
+
+// KeyChanFunc returns the keys to provide again when reproviding
+type KeyChanFunc func(context.Context) (<-chan cid.Cid, error)
+
+// NewBlockstoreProvider returns a KeyChanFunc reproviding every block in the
+// blockstore
+func NewBlockstoreProvider(bstore blockstore.Blockstore) KeyChanFunc {
+	return bstore.AllKeysChan
+}
+
+// Pinner lists the pins whose content is reprovided
+type Pinner interface {
+	DirectKeys() []cid.Cid
+	RecursiveKeys() []cid.Cid
+}
+
+// NewPinnedRootsProvider returns a KeyChanFunc reproviding only the roots of
+// the pins, which is enough for peers to find the rest of the content once
+// connected to us
+func NewPinnedRootsProvider(pins Pinner) KeyChanFunc {
+	return func(ctx context.Context) (<-chan cid.Cid, error) {
+		out := make(chan cid.Cid)
+		go func() {
+			defer close(out)
+			set := cid.NewSet()
+			for _, keys := range [][]cid.Cid{pins.DirectKeys(), pins.RecursiveKeys()} {
+				for _, c := range keys {
+					if !set.Visit(c) {
+						continue
+					}
+					select {
+					case out <- c:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// LinkGetter returns the cids a block links to
+type LinkGetter func(context.Context, cid.Cid) ([]cid.Cid, error)
+
+// NewPinnedProvider returns a KeyChanFunc reproviding the roots of the pins
+// and, for recursive pins, every block below them, found with getLinks
+func NewPinnedProvider(pins Pinner, getLinks LinkGetter) KeyChanFunc {
+	return func(ctx context.Context) (<-chan cid.Cid, error) {
+		out := make(chan cid.Cid)
+		go func() {
+			defer close(out)
+			set := cid.NewSet()
+			send := func(c cid.Cid) bool {
+				select {
+				case out <- c:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+			for _, c := range pins.DirectKeys() {
+				if set.Visit(c) && !send(c) {
+					return
+				}
+			}
+			// walk the pinned dags breadth first, skipping the parts we can't
+			// read
+			queue := pins.RecursiveKeys()
+			for len(queue) > 0 {
+				c := queue[0]
+				queue = queue[1:]
+				if !set.Visit(c) {
+					continue
+				}
+				if !send(c) {
+					return
+				}
+				links, err := getLinks(ctx, c)
+				if err != nil {
+					log.Warningf("failed to get the links of %s to reprovide: %s", c, err)
+					continue
+				}
+				queue = append(queue, links...)
+			}
+		}()
+		return out, nil
+	}
+}
+
+// ReprovideStat is the progress of the latest reprovide run
+type ReprovideStat struct {
+	// LastRun is when the latest run started, and Running is set until it
+	// has handed all its keys to the provide workers
+	LastRun time.Time
+	Running bool
+	// Keys is the number of keys handed to the provide workers
+	Keys int
+	// Err is the error that ended the run early, if any
+	Err string
+}
+
+// reprovider keeps track of the reprovide runs
+type reprovider struct {
+	keys     KeyChanFunc
+	interval time.Duration
+
+	// reqs triggers a run, which reports the error that ended it on the
+	// channel sent
+	reqs chan chan error
+
+	lk   sync.Mutex
+	stat ReprovideStat
+}
+
+func (rp *reprovider) update(f func(st *ReprovideStat)) {
+	rp.lk.Lock()
+	f(&rp.stat)
+	rp.lk.Unlock()
+}
+
+func (rp *reprovider) snapshot() ReprovideStat {
+	rp.lk.Lock()
+	defer rp.lk.Unlock()
+	return rp.stat
+}
+
+var errReprovideDisabled = errors.New("reproviding is not enabled")
+
+// Reprovide provides all the keys of the reprovider again right away. It
+// returns once they have all been handed to the provide workers, or the run
+// failed.
+func (bs *Bitswap) Reprovide(ctx context.Context) error {
+	if bs.reprovider == nil || !bs.provideEnabled {
+		return errReprovideDisabled
+	}
+	done := make(chan error, 1)
+	select {
+	case bs.reprovider.reqs <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-bs.process.Closing():
+		return errors.New("bitswap is closed")
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (bs *Bitswap) reprovideWorker(ctx context.Context) {
+	rp := bs.reprovider
+	timer := bs.clock.NewTimer(reprovideInitialDelay)
+	defer timer.Stop()
+
+	for {
+		var done chan error
+		select {
+		case <-timer.C:
+		case done = <-rp.reqs:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		err := bs.reprovide(ctx)
+		if err != nil {
+			log.Warningf("reprovide failed: %s", err)
+		}
+		if done != nil {
+			done <- err
+		}
+		timer.Reset(rp.interval)
+	}
+}
+
+// reprovide hands every key of the key source to the provide workers
+func (bs *Bitswap) reprovide(ctx context.Context) error {
+	rp := bs.reprovider
+	rp.update(func(st *ReprovideStat) {
+		*st = ReprovideStat{LastRun: bs.clock.Now(), Running: true}
+	})
+
+	err := func() error {
+		keys, err := rp.keys(ctx)
+		if err != nil {
+			return err
+		}
+		for c := range keys {
+			select {
+			case bs.reprovideKeys <- c:
+				rp.update(func(st *ReprovideStat) { st.Keys++ })
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}()
+
+	rp.update(func(st *ReprovideStat) {
+		st.Running = false
+		if err != nil {
+			st.Err = err.Error()
+		}
+	})
+	return err
+}
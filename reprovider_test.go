@@ -0,0 +1,431 @@
+package bitswap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+	bsnet "github.com/ipfs/go-bitswap/network"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	p2ptestutil "github.com/libp2p/go-libp2p-netutil"
+)
+
+func testCids(n int) []cid.Cid {
+	bgen := blocksutil.NewBlockGenerator()
+	var ks []cid.Cid
+	for _, blk := range bgen.Blocks(n) {
+		ks = append(ks, blk.Cid())
+	}
+	return ks
+}
+
+func TestProvideQueuePersists(t *testing.T) {
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	clk := clock.NewMock()
+	q, err := newProvideQueue(d, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := testCids(3)
+	for _, k := range ks {
+		if err := q.enqueue(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, provided := range []bool{true, false} {
+		c, ok := q.peek()
+		if !ok || !c.Equals(ks[i]) {
+			t.Fatal("expected the queue to be in order")
+		}
+		q.pop(c)
+		q.done(c, provided)
+	}
+	if q.len() != 2 {
+		t.Fatal("expected a cid waiting and one to retry, got", q.len())
+	}
+
+	// the cid that wasn't provided is retried once its backoff has passed
+	if c, ok := q.peek(); !ok || !c.Equals(ks[2]) {
+		t.Fatal("expected the retry to wait")
+	}
+	clk.Add(provideRetryDelay)
+	if c, ok := q.peek(); !ok || !c.Equals(ks[1]) {
+		t.Fatal("expected the retry to be due")
+	}
+
+	// and comes back after a restart
+	q, err = newProvideQueue(d, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.len() != 2 {
+		t.Fatal("expected two cids left, got", q.len())
+	}
+	for _, k := range ks[1:] {
+		c, ok := q.peek()
+		if !ok || !c.Equals(k) {
+			t.Fatal("expected the queue to resume in order")
+		}
+		q.pop(c)
+	}
+	if _, ok := q.peek(); ok {
+		t.Fatal("expected the queue to be empty")
+	}
+}
+
+func TestProvideQueueResumesAcrossGaps(t *testing.T) {
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	ks := testCids(2)
+	// the entries in between were provided before the restart
+	for i, pos := range []uint64{0, 1 << 40} {
+		if err := d.Put(provideQueuePrefix.Child(queueKey(pos)), ks[i].Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err := newProvideQueue(d, clock.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range ks {
+		c, ok := q.peek()
+		if !ok || !c.Equals(k) {
+			t.Fatal("expected the queue to resume in order")
+		}
+		q.pop(c)
+	}
+	if _, ok := q.peek(); ok {
+		t.Fatal("expected the queue to be empty")
+	}
+}
+
+// failingNetwork fails the first provides made over it
+type failingNetwork struct {
+	bsnet.BitSwapNetwork
+
+	lk       sync.Mutex
+	failures int
+}
+
+func (fn *failingNetwork) Provide(ctx context.Context, k cid.Cid) error {
+	fn.lk.Lock()
+	defer fn.lk.Unlock()
+	if fn.failures > 0 {
+		fn.failures--
+		return errors.New("provide failed")
+	}
+	return fn.BitSwapNetwork.Provide(ctx, k)
+}
+
+func TestFailedProvideRetried(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id, err := p2ptestutil.RandTestBogusIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := &failingNetwork{BitSwapNetwork: getVirtualNetwork().Adapter(id), failures: 2}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	clk := clock.NewMock()
+	bs := New(ctx, fn, bstore, Clock(clk)).(*Bitswap)
+	defer bs.Close()
+
+	bgen := blocksutil.NewBlockGenerator()
+	blk := bgen.Next()
+	if err := bs.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+	stat := func() *Stat {
+		st, _ := bs.Stat()
+		return st
+	}
+	waitFor(t, func() bool { return stat().ProvideFailures == 1 })
+	if st := stat(); st.Provided != 0 || st.ProvideQueueLen != 1 {
+		t.Fatalf("expected the block to wait to be retried, got %+v", st)
+	}
+
+	// the second attempt fails too, and the third waits twice as long
+	clk.Add(provideRetryDelay)
+	waitFor(t, func() bool { return stat().ProvideFailures == 2 })
+	clk.Add(provideRetryDelay)
+	if st := stat(); st.Provided != 0 {
+		t.Fatal("expected the retry to back off")
+	}
+	clk.Add(provideRetryDelay)
+	waitFor(t, func() bool { return stat().Provided == 1 })
+	if st := stat(); st.ProvideQueueLen != 0 {
+		t.Fatal("expected the queue to be empty once provided, got", st.ProvideQueueLen)
+	}
+}
+
+type testPinner struct {
+	direct, recursive []cid.Cid
+}
+
+func (tp *testPinner) DirectKeys() []cid.Cid    { return tp.direct }
+func (tp *testPinner) RecursiveKeys() []cid.Cid { return tp.recursive }
+
+func collectKeys(t *testing.T, keys KeyChanFunc) []cid.Cid {
+	ch, err := keys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []cid.Cid
+	for c := range ch {
+		out = append(out, c)
+	}
+	return out
+}
+
+func assertCids(t *testing.T, got, exp []cid.Cid) {
+	t.Helper()
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d cids, got %d", len(exp), len(got))
+	}
+	for i := range got {
+		if !got[i].Equals(exp[i]) {
+			t.Fatalf("unexpected cid at %d", i)
+		}
+	}
+}
+
+func TestPinnedProviders(t *testing.T) {
+	ks := testCids(6)
+	// ks[1] links to ks[2] and ks[3], which links to ks[4]; ks[0] is pinned
+	// directly and ks[5] isn't pinned at all
+	links := map[cid.Cid][]cid.Cid{
+		ks[1]: {ks[2], ks[3]},
+		ks[3]: {ks[4], ks[2]},
+		ks[0]: {ks[5]},
+	}
+	getLinks := func(_ context.Context, c cid.Cid) ([]cid.Cid, error) {
+		return links[c], nil
+	}
+	pins := &testPinner{direct: []cid.Cid{ks[0]}, recursive: []cid.Cid{ks[1], ks[0]}}
+
+	assertCids(t, collectKeys(t, NewPinnedRootsProvider(pins)), []cid.Cid{ks[0], ks[1]})
+	assertCids(t, collectKeys(t, NewPinnedProvider(pins, getLinks)), []cid.Cid{ks[0], ks[1], ks[2], ks[3], ks[4]})
+}
+
+func TestReprovide(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ks := testCids(5)
+	keys := func(ctx context.Context) (<-chan cid.Cid, error) {
+		out := make(chan cid.Cid, len(ks))
+		for _, k := range ks {
+			out <- k
+		}
+		close(out)
+		return out, nil
+	}
+	failing := func(ctx context.Context) (<-chan cid.Cid, error) {
+		return nil, errors.New("no keys")
+	}
+
+	vnet := getVirtualNetwork()
+	sg := NewTestSessionGenerator(vnet, Reprovide(keys, time.Hour))
+	defer sg.Close()
+	bs := sg.Next().Exchange
+
+	if err := bs.Reprovide(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		st, _ := bs.Stat()
+		return st.Provided == uint64(len(ks))
+	})
+	st, _ := bs.Stat()
+	if st.Reprovide.Running || st.Reprovide.Keys != len(ks) || st.Reprovide.Err != "" {
+		t.Fatalf("unexpected reprovide stats %+v", st.Reprovide)
+	}
+
+	sg = NewTestSessionGenerator(vnet, Reprovide(failing, time.Hour))
+	defer sg.Close()
+	bs = sg.Next().Exchange
+	if err := bs.Reprovide(ctx); err == nil {
+		t.Fatal("expected the reprovide to fail")
+	}
+	if st, _ := bs.Stat(); st.Reprovide.Err == "" {
+		t.Fatal("expected the failure to be reported")
+	}
+
+	sg = NewTestSessionGenerator(vnet)
+	defer sg.Close()
+	if err := sg.Next().Exchange.Reprovide(ctx); err != errReprovideDisabled {
+		t.Fatal("expected reproviding to be disabled by default")
+	}
+}
+
+func TestProvideQueueResumes(t *testing.T) {
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	q, err := newProvideQueue(d, clock.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := testCids(3)
+	for _, k := range ks {
+		if err := q.enqueue(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vnet := getVirtualNetwork()
+	sg := NewTestSessionGenerator(vnet, ProvideQueueDatastore(d))
+	defer sg.Close()
+	bs := sg.Next().Exchange
+
+	waitFor(t, func() bool {
+		st, _ := bs.Stat()
+		return st.Provided == uint64(len(ks))
+	})
+	if q, err := newProvideQueue(d, clock.New()); err != nil || q.len() != 0 {
+		t.Fatal("expected the queue to be emptied once provided")
+	}
+}
+
+// batchingNetwork records the batches of keys provided over it
+type batchingNetwork struct {
+	bsnet.BitSwapNetwork
+	unsupported bool
+
+	lk      sync.Mutex
+	batches [][]cid.Cid
+}
+
+func (bn *batchingNetwork) ProvideMany(ctx context.Context, ks []cid.Cid) error {
+	bn.lk.Lock()
+	defer bn.lk.Unlock()
+	bn.batches = append(bn.batches, ks)
+	if bn.unsupported {
+		return bsnet.ErrProvideManyUnsupported
+	}
+	return nil
+}
+
+func (bn *batchingNetwork) batchSizes() []int {
+	bn.lk.Lock()
+	defer bn.lk.Unlock()
+	var sizes []int
+	for _, b := range bn.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func newBatchingBitswap(t *testing.T, ctx context.Context, unsupported bool, options ...Option) (*Bitswap, *batchingNetwork) {
+	id, err := p2ptestutil.RandTestBogusIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bn := &batchingNetwork{BitSwapNetwork: getVirtualNetwork().Adapter(id), unsupported: unsupported}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	return New(ctx, bn, bstore, options...).(*Bitswap), bn
+}
+
+func TestProvideBatching(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clk := clock.NewMock()
+	bs, bn := newBatchingBitswap(t, ctx, false, ProvideBatching(4, time.Second), Clock(clk))
+	defer bs.Close()
+
+	bgen := blocksutil.NewBlockGenerator()
+	for _, blk := range bgen.Blocks(10) {
+		if err := bs.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// full batches go out right away, and the rest once the window passes
+	waitFor(t, func() bool { return len(bn.batchSizes()) == 2 })
+	waitFor(t, func() bool {
+		clk.Add(time.Second)
+		return len(bn.batchSizes()) == 3
+	})
+	sizes := bn.batchSizes()
+	if sizes[0] != 4 || sizes[1] != 4 || sizes[2] != 2 {
+		t.Fatal("unexpected batches", sizes)
+	}
+	waitFor(t, func() bool {
+		st, _ := bs.Stat()
+		return st.Provided == 10
+	})
+}
+
+func TestProvideBatchFlushedOnClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clk := clock.NewMock()
+	bs, bn := newBatchingBitswap(t, ctx, false, ProvideBatching(4, time.Second), Clock(clk))
+
+	bgen := blocksutil.NewBlockGenerator()
+	for _, blk := range bgen.Blocks(2) {
+		if err := bs.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the keys are being collected into a batch that isn't full, and whose
+	// window never passes
+	waitFor(t, func() bool {
+		bs.provideQueue.lk.Lock()
+		handedOut := len(bs.provideQueue.inflight)
+		bs.provideQueue.lk.Unlock()
+		return handedOut == 2 && len(bs.provideKeys) == 0
+	})
+	if sizes := bn.batchSizes(); len(sizes) != 0 {
+		t.Fatal("expected the batch to wait for more keys, got", sizes)
+	}
+
+	bs.Close()
+	if sizes := bn.batchSizes(); len(sizes) != 1 || sizes[0] != 2 {
+		t.Fatal("expected the batch to be flushed on close, got", sizes)
+	}
+}
+
+func TestProvideBatchingUnsupported(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bs, bn := newBatchingBitswap(t, ctx, true, ProvideBatching(2, time.Millisecond))
+	defer bs.Close()
+
+	bgen := blocksutil.NewBlockGenerator()
+	blks := bgen.Blocks(6)
+	for _, blk := range blks[:2] {
+		if err := bs.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		st, _ := bs.Stat()
+		return st.Provided == 2
+	})
+
+	// once the router turns out not to batch, keys are provided one by one
+	for _, blk := range blks[2:] {
+		if err := bs.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		st, _ := bs.Stat()
+		return st.Provided == 6
+	})
+	if sizes := bn.batchSizes(); len(sizes) != 1 {
+		t.Fatal("expected a single attempt at batching, got", sizes)
+	}
+}
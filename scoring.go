@@ -0,0 +1,233 @@
+package bitswap
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// Misbehavior is something a peer did that counts against its score
+type Misbehavior int
+
+const (
+	// UnwantedBlock is a block sent to us that neither we nor any of our
+	// sessions wanted
+	UnwantedBlock Misbehavior = iota
+	// MalformedMessage is a message that couldn't be parsed
+	MalformedMessage
+	// UnknownCancel is a cancel for a want the peer never made
+	UnknownCancel
+)
+
+func (m Misbehavior) String() string {
+	switch m {
+	case UnwantedBlock:
+		return "unwanted-block"
+	case MalformedMessage:
+		return "malformed-message"
+	case UnknownCancel:
+		return "unknown-cancel"
+	default:
+		return "unknown"
+	}
+}
+
+// ScoreAction is what is done to peers whose score reaches the threshold
+type ScoreAction int
+
+const (
+	// ScoreDeprioritize serves the peer's wants after everyone else's
+	ScoreDeprioritize ScoreAction = iota
+	// ScoreDisconnect disconnects from the peer, and again whenever it
+	// reconnects
+	ScoreDisconnect
+	// ScoreTrackOnly only keeps track of scores
+	ScoreTrackOnly
+)
+
+// ScoreConfig configures peer scoring. A peer's score is the sum of the
+// penalties for its misbehavior, each halving every HalfLife. Once it reaches
+// Threshold, Action is taken against the peer until its score decays to half
+// the threshold.
+type ScoreConfig struct {
+	Penalties map[Misbehavior]float64
+	// HalfLife of zero means penalties never decay
+	HalfLife  time.Duration
+	Threshold float64
+	Action    ScoreAction
+}
+
+// DefaultScoreConfig returns the scoring bitswap uses unless configured
+// otherwise. Unwanted blocks and unknown cancels are penalized lightly, as
+// blocks and cancels crossing in flight are normal.
+func DefaultScoreConfig() ScoreConfig {
+	return ScoreConfig{
+		Penalties: map[Misbehavior]float64{
+			UnwantedBlock:    1,
+			MalformedMessage: 10,
+			UnknownCancel:    1,
+		},
+		HalfLife:  10 * time.Minute,
+		Threshold: 100,
+		Action:    ScoreDeprioritize,
+	}
+}
+
+// PeerScore is a snapshot of a peer's score
+type PeerScore struct {
+	Score float64
+	// Counts are the number of times the peer misbehaved in each way
+	Counts map[Misbehavior]uint64
+	// Penalized is set while action is taken against the peer
+	Penalized bool
+}
+
+// forgetScore is the score below which peers that aren't penalized are
+// forgotten
+const forgetScore = 0.01
+
+type peerScore struct {
+	score     float64
+	updated   time.Time
+	counts    map[Misbehavior]uint64
+	penalized bool
+}
+
+// peerScorer keeps the scores of misbehaving peers. penalize is called when a
+// peer's score reaches the threshold, and release once it decays back, both
+// without the scorer's lock held.
+type peerScorer struct {
+	cfg   ScoreConfig
+	clock clock.Clock
+
+	penalize func(peer.ID)
+	release  func(peer.ID)
+
+	lk    sync.Mutex
+	peers map[peer.ID]*peerScore
+}
+
+func newPeerScorer(cfg ScoreConfig, clk clock.Clock, penalize, release func(peer.ID)) *peerScorer {
+	return &peerScorer{
+		cfg:      cfg,
+		clock:    clk,
+		penalize: penalize,
+		release:  release,
+		peers:    make(map[peer.ID]*peerScore),
+	}
+}
+
+// decay brings the score up to date. ps.lk must be held.
+func (ps *peerScorer) decay(s *peerScore, now time.Time) {
+	if ps.cfg.HalfLife > 0 {
+		if elapsed := now.Sub(s.updated); elapsed > 0 {
+			s.score *= math.Exp2(-float64(elapsed) / float64(ps.cfg.HalfLife))
+		}
+	}
+	s.updated = now
+}
+
+// record counts the misbehavior against the peer
+func (ps *peerScorer) record(p peer.ID, m Misbehavior) {
+	now := ps.clock.Now()
+
+	ps.lk.Lock()
+	s, ok := ps.peers[p]
+	if !ok {
+		s = &peerScore{updated: now, counts: make(map[Misbehavior]uint64)}
+		ps.peers[p] = s
+	}
+	ps.decay(s, now)
+	s.score += ps.cfg.Penalties[m]
+	s.counts[m]++
+	penalize := !s.penalized && ps.cfg.Threshold > 0 && s.score >= ps.cfg.Threshold
+	if penalize {
+		s.penalized = true
+	}
+	ps.lk.Unlock()
+
+	log.Debugf("peer %s misbehaved: %s", p, m)
+	if penalize {
+		log.Infof("penalizing misbehaving peer %s", p)
+		ps.penalize(p)
+	}
+}
+
+// sweep decays all scores, releases the peers whose score has decayed to half
+// the threshold and forgets the ones whose score has decayed away
+func (ps *peerScorer) sweep() {
+	now := ps.clock.Now()
+
+	var released []peer.ID
+	ps.lk.Lock()
+	for p, s := range ps.peers {
+		ps.decay(s, now)
+		if s.penalized && s.score < ps.cfg.Threshold/2 {
+			s.penalized = false
+			released = append(released, p)
+		}
+		if !s.penalized && s.score < forgetScore {
+			delete(ps.peers, p)
+		}
+	}
+	ps.lk.Unlock()
+
+	for _, p := range released {
+		ps.release(p)
+	}
+}
+
+// reset forgets the peer's score, releasing it if it was penalized
+func (ps *peerScorer) reset(p peer.ID) {
+	ps.lk.Lock()
+	s, ok := ps.peers[p]
+	delete(ps.peers, p)
+	ps.lk.Unlock()
+
+	if ok && s.penalized {
+		ps.release(p)
+	}
+}
+
+func (ps *peerScorer) isPenalized(p peer.ID) bool {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	s, ok := ps.peers[p]
+	return ok && s.penalized
+}
+
+// snapshot returns the peer's score. ps.lk must be held.
+func (ps *peerScorer) snapshot(s *peerScore, now time.Time) PeerScore {
+	ps.decay(s, now)
+	counts := make(map[Misbehavior]uint64, len(s.counts))
+	for m, n := range s.counts {
+		counts[m] = n
+	}
+	return PeerScore{Score: s.score, Counts: counts, Penalized: s.penalized}
+}
+
+func (ps *peerScorer) score(p peer.ID) PeerScore {
+	now := ps.clock.Now()
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	s, ok := ps.peers[p]
+	if !ok {
+		return PeerScore{Counts: map[Misbehavior]uint64{}}
+	}
+	return ps.snapshot(s, now)
+}
+
+func (ps *peerScorer) scores() map[peer.ID]PeerScore {
+	now := ps.clock.Now()
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	out := make(map[peer.ID]PeerScore, len(ps.peers))
+	for p, s := range ps.peers {
+		out[p] = ps.snapshot(s, now)
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package bitswap
+
+import (
+	"testing"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestPeerScorerPenalizesAndReleases(t *testing.T) {
+	clk := clock.NewMock()
+	var penalized, released []peer.ID
+	cfg := ScoreConfig{
+		Penalties: map[Misbehavior]float64{UnwantedBlock: 1, MalformedMessage: 4},
+		HalfLife:  time.Minute,
+		Threshold: 8,
+	}
+	ps := newPeerScorer(cfg, clk,
+		func(p peer.ID) { penalized = append(penalized, p) },
+		func(p peer.ID) { released = append(released, p) })
+	a := peer.ID("a")
+	b := peer.ID("b")
+
+	ps.record(a, MalformedMessage)
+	ps.record(a, UnwantedBlock)
+	ps.record(b, UnwantedBlock)
+	if s := ps.score(a); s.Score != 5 || s.Penalized {
+		t.Fatalf("expected a score of 5 without a penalty, got %+v", s)
+	}
+	ps.record(a, MalformedMessage)
+	if len(penalized) != 1 || penalized[0] != a {
+		t.Fatal("expected a to be penalized once it reached the threshold, got", penalized)
+	}
+	ps.record(a, UnwantedBlock)
+	if len(penalized) != 1 {
+		t.Fatal("expected a to be penalized only once")
+	}
+	if s := ps.score(a); s.Counts[MalformedMessage] != 2 || s.Counts[UnwantedBlock] != 2 || !s.Penalized {
+		t.Fatalf("unexpected score %+v", s)
+	}
+
+	// scores halve every half life, and a is released at half the threshold
+	clk.Add(time.Minute)
+	ps.sweep()
+	if s := ps.score(a); s.Score != 5 || !s.Penalized {
+		t.Fatalf("expected a's score to have halved to 5, got %+v", s)
+	}
+	clk.Add(time.Minute)
+	ps.sweep()
+	if len(released) != 1 || released[0] != a {
+		t.Fatal("expected a to be released, got", released)
+	}
+
+	// b's score decays away, and it's forgotten
+	clk.Add(10 * time.Minute)
+	ps.sweep()
+	if _, ok := ps.scores()[b]; ok {
+		t.Fatal("expected b to be forgotten")
+	}
+
+	ps.record(a, MalformedMessage)
+	ps.record(a, MalformedMessage)
+	ps.reset(a)
+	if len(penalized) != 2 || len(released) != 2 {
+		t.Fatal("expected resetting a penalized peer to release it")
+	}
+	if s := ps.score(a); s.Score != 0 || len(s.Counts) != 0 {
+		t.Fatalf("expected a reset score, got %+v", s)
+	}
+}
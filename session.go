@@ -3,8 +3,10 @@ package bitswap
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
 	notifications "github.com/ipfs/go-bitswap/notifications"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -18,30 +20,90 @@ import (
 
 const activeWantsLimit = 16
 
+const (
+	// initialSplit is the number of groups a session's live wants are split
+	// into to begin with. Each group is sent to a different set of peers.
+	initialSplit = 2
+	// maxSplit bounds how far the live wants are split up
+	maxSplit = 16
+	// maxSessionPeers is the number of best performing peers a session sends
+	// want-blocks to
+	maxSessionPeers = 32
+
+	// splitAdjustWindow is the number of received blocks, duplicates
+	// included, after which the split is adjusted
+	splitAdjustWindow = 8
+	// maxAcceptableDupes is the ratio of duplicate blocks above which the
+	// live wants are split further
+	maxAcceptableDupes = 0.4
+	// minDupesToTryLessSplits is the ratio of duplicate blocks below which
+	// the live wants are sent to more peers
+	minDupesToTryLessSplits = 0.2
+)
+
 // Session holds state for an individual bitswap transfer operation.
 // This allows bitswap to make smarter decisions about who to send wantlist
 // info to, and who to request blocks from
 type Session struct {
 	ctx            context.Context
 	tofetch        *cidQueue
-	activePeers    map[peer.ID]struct{}
+	activePeers    map[peer.ID]*sessionPeer
 	activePeersArr []peer.ID
 
 	bs           *Bitswap
 	incoming     chan blkRecv
-	newReqs      chan []cid.Cid
+	duplicates   chan blkRecv
+	presences    chan blkPresence
+	newReqs      chan fetchReq
 	cancelKeys   chan []cid.Cid
 	interestReqs chan interestReq
+	priorityReqs chan fetchReq
+	statReqs     chan chan *SessionStat
+	newpeers     chan peer.ID
 
 	interest  *lru.Cache
 	liveWants map[cid.Cid]time.Time
-
-	tick          *time.Timer
-	baseTickDelay time.Duration
-
+	// priorities holds the priorities given to the wanted cids that were
+	// asked for with one
+	priorities map[cid.Cid]int
+
+	// sentWantBlocks tracks which peers we have asked to send us the block
+	// for each live want, so that every HAVE doesn't turn into a duplicate
+	// block
+	sentWantBlocks map[cid.Cid]map[peer.ID]struct{}
+	// dontHaves tracks which of those peers told us they don't have a cid
+	dontHaves map[cid.Cid]map[peer.ID]struct{}
+
+	// split is the number of groups live wants are split into, and
+	// splitOffset rotates which group of peers the next want goes to
+	split       int
+	splitOffset int
+	// uniqRecvd and dupRecvd count the blocks received since the split was
+	// last adjusted
+	uniqRecvd int
+	dupRecvd  int
+
+	tick            *clock.Timer
+	baseTickDelay   time.Duration
+	provSearchDelay time.Duration
+	orderedWindow   int
+
+	// latTotal is summed over the latcnt blocks that were live wants, out of
+	// the fetchcnt received
 	latTotal time.Duration
+	latcnt   int
 	fetchcnt int
 
+	// dupTotal and bytesRecvd count the duplicate blocks and the bytes of
+	// the blocks received over the session's life, and latencies holds the
+	// latest latencies of live wants
+	dupTotal   int
+	bytesRecvd uint64
+	latencies  []time.Duration
+	latNext    int
+
+	started time.Time
+
 	notif notifications.PubSub
 
 	uuid logging.Loggable
@@ -51,26 +113,47 @@ type Session struct {
 }
 
 // NewSession creates a new bitswap session whose lifetime is bounded by the
-// given context
+// given context. Once bitswap has started shutting down, its fetches fail.
 func (bs *Bitswap) NewSession(ctx context.Context) exchange.Fetcher {
 	s := &Session{
-		activePeers:   make(map[peer.ID]struct{}),
-		liveWants:     make(map[cid.Cid]time.Time),
-		newReqs:       make(chan []cid.Cid),
-		cancelKeys:    make(chan []cid.Cid),
-		tofetch:       newCidQueue(),
-		interestReqs:  make(chan interestReq),
-		ctx:           ctx,
-		bs:            bs,
-		incoming:      make(chan blkRecv),
-		notif:         notifications.New(),
-		uuid:          loggables.Uuid("GetBlockRequest"),
-		baseTickDelay: time.Millisecond * 500,
-		id:            bs.getNextSessionID(),
+		activePeers:     make(map[peer.ID]*sessionPeer),
+		liveWants:       make(map[cid.Cid]time.Time),
+		sentWantBlocks:  make(map[cid.Cid]map[peer.ID]struct{}),
+		dontHaves:       make(map[cid.Cid]map[peer.ID]struct{}),
+		priorities:      make(map[cid.Cid]int),
+		newReqs:         make(chan fetchReq),
+		cancelKeys:      make(chan []cid.Cid),
+		tofetch:         newCidQueue(),
+		interestReqs:    make(chan interestReq),
+		priorityReqs:    make(chan fetchReq),
+		statReqs:        make(chan chan *SessionStat),
+		ctx:             ctx,
+		bs:              bs,
+		incoming:        make(chan blkRecv),
+		duplicates:      make(chan blkRecv, 16),
+		presences:       make(chan blkPresence),
+		newpeers:        make(chan peer.ID, 16),
+		notif:           notifications.New(),
+		uuid:            loggables.Uuid("GetBlockRequest"),
+		baseTickDelay:   time.Millisecond * 500,
+		provSearchDelay: bs.provSearchDelay,
+		orderedWindow:   bs.orderedWindow,
+		split:           initialSplit,
+		id:              bs.getNextSessionID(),
+		started:         bs.clock.Now(),
 	}
 
 	s.tag = fmt.Sprint("bs-ses-", s.id)
 
+	if bs.isClosing() {
+		// the session is never run, and its fetches fail
+		sctx, cancel := context.WithCancel(ctx)
+		cancel()
+		s.ctx = sctx
+		s.notif.Shutdown()
+		return s
+	}
+
 	cache, _ := lru.New(2048)
 	s.interest = cache
 
@@ -85,6 +168,7 @@ func (bs *Bitswap) NewSession(ctx context.Context) exchange.Fetcher {
 
 func (bs *Bitswap) removeSession(s *Session) {
 	s.notif.Shutdown()
+	bs.metrics.sessionLifetime.Observe(bs.clock.Since(s.started).Seconds())
 
 	live := make([]cid.Cid, 0, len(s.liveWants))
 	for c := range s.liveWants {
@@ -115,6 +199,29 @@ func (s *Session) receiveBlockFrom(from peer.ID, blk blocks.Block) {
 	}
 }
 
+// receiveDuplicateFrom lets the session know that a block it already has was
+// sent to us again. Duplicates only tune the split, so if the session is too
+// busy to take them they're dropped rather than holding up the caller.
+func (s *Session) receiveDuplicateFrom(from peer.ID, blk blocks.Block) {
+	select {
+	case s.duplicates <- blkRecv{from: from, blk: blk}:
+	default:
+	}
+}
+
+type blkPresence struct {
+	from peer.ID
+	c    cid.Cid
+	have bool
+}
+
+func (s *Session) receiveBlockPresence(from peer.ID, c cid.Cid, have bool) {
+	select {
+	case s.presences <- blkPresence{from: from, c: c, have: have}:
+	case <-s.ctx.Done():
+	}
+}
+
 type interestReq struct {
 	c    cid.Cid
 	resp chan bool
@@ -150,12 +257,11 @@ func (s *Session) interestedIn(c cid.Cid) bool {
 	return s.interest.Contains(c) || s.isLiveWant(c)
 }
 
-const provSearchDelay = time.Second * 10
-
 func (s *Session) addActivePeer(p peer.ID) {
 	if _, ok := s.activePeers[p]; !ok {
-		s.activePeers[p] = struct{}{}
+		s.activePeers[p] = &sessionPeer{}
 		s.activePeersArr = append(s.activePeersArr, p)
+		traceEvent(s.bs.tracer, Event{Type: EventSessionPeerAdded, Peer: p, Session: s.id})
 
 		cmgr := s.bs.network.ConnectionManager()
 		cmgr.TagPeer(p, s.tag, 10)
@@ -164,16 +270,15 @@ func (s *Session) addActivePeer(p peer.ID) {
 
 func (s *Session) resetTick() {
 	if s.latTotal == 0 {
-		s.tick.Reset(provSearchDelay)
+		s.tick.Reset(s.provSearchDelay)
 	} else {
-		avLat := s.latTotal / time.Duration(s.fetchcnt)
+		avLat := s.latTotal / time.Duration(s.latcnt)
 		s.tick.Reset(s.baseTickDelay + (3 * avLat))
 	}
 }
 
 func (s *Session) run(ctx context.Context) {
-	s.tick = time.NewTimer(provSearchDelay)
-	newpeers := make(chan peer.ID, 16)
+	s.tick = s.bs.clock.NewTimer(s.provSearchDelay)
 	for {
 		select {
 		case blk := <-s.incoming:
@@ -183,12 +288,20 @@ func (s *Session) run(ctx context.Context) {
 				s.addActivePeer(blk.from)
 			}
 
-			s.receiveBlock(ctx, blk.blk)
+			s.receiveBlock(ctx, blk.from, blk.blk)
 
 			s.resetTick()
-		case keys := <-s.newReqs:
+		case <-s.duplicates:
+			s.recordReceived(true)
+		case bp := <-s.presences:
+			s.handleBlockPresence(ctx, bp)
+		case req := <-s.newReqs:
+			keys := req.keys
 			for _, k := range keys {
 				s.interest.Add(k, nil)
+				if req.prioritized {
+					s.priorities[k] = req.priority
+				}
 			}
 			if len(s.liveWants) < activeWantsLimit {
 				toadd := activeWantsLimit - len(s.liveWants)
@@ -206,35 +319,38 @@ func (s *Session) run(ctx context.Context) {
 			}
 		case keys := <-s.cancelKeys:
 			s.cancel(keys)
+		case req := <-s.priorityReqs:
+			s.updatePriority(ctx, req.keys, req.priority)
 
 		case <-s.tick.C:
+			if len(s.liveWants) > 0 {
+				// wants timed out, so spread them over more peers
+				s.split = (s.split + 1) / 2
+			}
+
 			live := make([]cid.Cid, 0, len(s.liveWants))
-			now := time.Now()
+			now := s.bs.clock.Now()
 			for c := range s.liveWants {
 				live = append(live, c)
 				s.liveWants[c] = now
+				// whoever we asked hasn't come through, so let the next HAVE
+				// we hear about trigger a new want-block
+				delete(s.sentWantBlocks, c)
 			}
 
-			// Broadcast these keys to everyone we're connected to
-			s.bs.wm.WantBlocks(ctx, live, nil, s.id)
+			// Ask everyone we're connected to whether they have these keys
+			s.bs.wm.WantHaves(ctx, live, nil, s.id, s.prioritiesFor(live)...)
 
 			if len(live) > 0 {
-				go func(k cid.Cid) {
-					// TODO: have a task queue setup for this to:
-					// - rate limit
-					// - manage timeouts
-					// - ensure two 'findprovs' calls for the same block don't run concurrently
-					// - share peers between sessions based on interest set
-					for p := range s.bs.network.FindProvidersAsync(ctx, k, 10) {
-						newpeers <- p
-					}
-				}(live[0])
+				s.findMorePeers(ctx, live[0])
 			}
 			s.resetTick()
-		case p := <-newpeers:
+		case p := <-s.newpeers:
 			s.addActivePeer(p)
 		case lwchk := <-s.interestReqs:
 			lwchk.resp <- s.cidIsWanted(lwchk.c)
+		case resp := <-s.statReqs:
+			resp <- s.stat()
 		case <-ctx.Done():
 			s.tick.Stop()
 			s.bs.removeSession(s)
@@ -248,6 +364,67 @@ func (s *Session) run(ctx context.Context) {
 	}
 }
 
+// findMorePeers searches for providers of the given cid in the background and
+// adds them to the session's active peers
+func (s *Session) findMorePeers(ctx context.Context, c cid.Cid) {
+	go func(k cid.Cid) {
+		for p := range s.bs.pqm.FindProvidersAsync(ctx, k, s.id) {
+			select {
+			case s.newpeers <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(c)
+}
+
+// handleBlockPresence routes a live want according to a HAVE or DONT_HAVE
+// response, rather than waiting for the tick to time it out
+func (s *Session) handleBlockPresence(ctx context.Context, bp blkPresence) {
+	if _, ok := s.liveWants[bp.c]; !ok {
+		return
+	}
+
+	if bp.have {
+		s.addActivePeer(bp.from)
+		if len(s.sentWantBlocks[bp.c]) > 0 {
+			return
+		}
+		s.sendWantBlocks(ctx, []cid.Cid{bp.c}, []peer.ID{bp.from})
+		return
+	}
+
+	// only the peers we asked for the block itself need to answer before we
+	// give up on them, and of those only the ones that can answer at all
+	sent := s.sentWantBlocks[bp.c]
+	if _, ok := sent[bp.from]; !ok {
+		return
+	}
+	dh, ok := s.dontHaves[bp.c]
+	if !ok {
+		dh = make(map[peer.ID]struct{})
+		s.dontHaves[bp.c] = dh
+	}
+	if _, ok := dh[bp.from]; ok {
+		return
+	}
+	dh[bp.from] = struct{}{}
+
+	waiting := 0
+	for p := range sent {
+		if s.bs.wm.SupportsHave(p) {
+			waiting++
+		}
+	}
+	if len(dh) >= waiting {
+		// none of the peers we asked have it, ask around right away
+		delete(s.sentWantBlocks, bp.c)
+		delete(s.dontHaves, bp.c)
+		s.bs.wm.WantHaves(ctx, []cid.Cid{bp.c}, nil, s.id, s.prioritiesFor([]cid.Cid{bp.c})...)
+		s.findMorePeers(ctx, bp.c)
+	}
+}
+
 func (s *Session) cidIsWanted(c cid.Cid) bool {
 	_, ok := s.liveWants[c]
 	if !ok {
@@ -257,36 +434,239 @@ func (s *Session) cidIsWanted(c cid.Cid) bool {
 	return ok
 }
 
-func (s *Session) receiveBlock(ctx context.Context, blk blocks.Block) {
+func (s *Session) receiveBlock(ctx context.Context, from peer.ID, blk blocks.Block) {
 	c := blk.Cid()
-	if s.cidIsWanted(c) {
-		tval, ok := s.liveWants[c]
-		if ok {
-			s.latTotal += time.Since(tval)
-			delete(s.liveWants, c)
-		} else {
-			s.tofetch.Remove(c)
+	if !s.cidIsWanted(c) {
+		// blocks we added ourselves aren't duplicates
+		if from != "" {
+			s.recordReceived(true)
 		}
-		s.fetchcnt++
-		s.notif.Publish(blk)
+		return
+	}
 
-		if next := s.tofetch.Pop(); next.Defined() {
-			s.wantBlocks(ctx, []cid.Cid{next})
+	tval, ok := s.liveWants[c]
+	if ok {
+		lat := s.bs.clock.Since(tval)
+		s.latTotal += lat
+		s.latcnt++
+		s.recordLatency(lat)
+		if sp, ok := s.activePeers[from]; ok {
+			sp.recordBlock(lat)
 		}
+		delete(s.liveWants, c)
+		delete(s.sentWantBlocks, c)
+		delete(s.dontHaves, c)
+	} else {
+		s.tofetch.Remove(c)
+	}
+	delete(s.priorities, c)
+	s.fetchcnt++
+	s.bytesRecvd += uint64(len(blk.RawData()))
+	if from != "" {
+		s.recordReceived(false)
+	}
+	s.notif.Publish(blk)
+
+	if next := s.tofetch.Pop(); next.Defined() {
+		s.wantBlocks(ctx, []cid.Cid{next})
 	}
 }
 
+// recordReceived counts a block received from the network, and splits the
+// live wants up further if too many of them are duplicates, or sends them to
+// more peers if hardly any are
+func (s *Session) recordReceived(dup bool) {
+	if dup {
+		s.dupRecvd++
+		s.dupTotal++
+	} else {
+		s.uniqRecvd++
+	}
+
+	total := s.uniqRecvd + s.dupRecvd
+	if total < splitAdjustWindow {
+		return
+	}
+
+	dupRatio := float64(s.dupRecvd) / float64(total)
+	if dupRatio > maxAcceptableDupes && s.split < maxSplit {
+		s.split++
+	} else if dupRatio < minDupesToTryLessSplits && s.split > 1 {
+		s.split--
+	}
+	s.uniqRecvd = 0
+	s.dupRecvd = 0
+}
+
 func (s *Session) wantBlocks(ctx context.Context, ks []cid.Cid) {
-	now := time.Now()
+	now := s.bs.clock.Now()
 	for _, c := range ks {
 		s.liveWants[c] = now
 	}
-	s.bs.wm.WantBlocks(ctx, ks, s.activePeersArr, s.id)
+
+	if len(s.activePeersArr) == 0 {
+		// we don't know who has these yet. Ask everyone, but only whether
+		// they have them, so that we don't get sent duplicate blocks
+		s.bs.wm.WantHaves(ctx, ks, nil, s.id, s.prioritiesFor(ks)...)
+		return
+	}
+
+	// split the wants into groups, and send each group to a different set
+	// of peers, so that each block is only requested from some of them
+	peers := s.sortedPeers()
+	split := s.split
+	if split > len(peers) {
+		split = len(peers)
+	}
+	groups := make([][]cid.Cid, split)
+	for i, c := range ks {
+		g := (s.splitOffset + i) % split
+		groups[g] = append(groups[g], c)
+	}
+	s.splitOffset = (s.splitOffset + len(ks)) % split
+
+	for g, gks := range groups {
+		if len(gks) == 0 {
+			continue
+		}
+		var gpeers []peer.ID
+		for i := g; i < len(peers); i += split {
+			gpeers = append(gpeers, peers[i])
+		}
+		s.sendWantBlocks(ctx, gks, gpeers)
+	}
+}
+
+func (s *Session) sendWantBlocks(ctx context.Context, ks []cid.Cid, peers []peer.ID) {
+	for _, c := range ks {
+		sent, ok := s.sentWantBlocks[c]
+		if !ok {
+			sent = make(map[peer.ID]struct{})
+			s.sentWantBlocks[c] = sent
+		}
+		for _, p := range peers {
+			sent[p] = struct{}{}
+		}
+	}
+	for _, p := range peers {
+		if sp, ok := s.activePeers[p]; ok {
+			sp.requested += len(ks)
+		}
+	}
+	s.bs.wm.WantBlocks(ctx, ks, peers, s.id, s.prioritiesFor(ks)...)
+}
+
+// prioritiesFor returns the priorities to ask for the given cids with, or nil
+// if none of them were given one, in which case they are prioritized in order
+func (s *Session) prioritiesFor(ks []cid.Cid) []int {
+	var priorities []int
+	for i, c := range ks {
+		p, ok := s.priorities[c]
+		if !ok {
+			continue
+		}
+		if priorities == nil {
+			priorities = make([]int, len(ks))
+			for j := range priorities {
+				priorities[j] = DefaultPriority - j
+			}
+		}
+		priorities[i] = p
+	}
+	return priorities
+}
+
+// updatePriority records the new priority of the given cids, if they are
+// still wanted, and updates the live wants among them
+func (s *Session) updatePriority(ctx context.Context, ks []cid.Cid, priority int) {
+	var live []cid.Cid
+	for _, c := range ks {
+		if !s.cidIsWanted(c) {
+			continue
+		}
+		s.priorities[c] = priority
+		if _, ok := s.liveWants[c]; ok {
+			live = append(live, c)
+		}
+	}
+	if len(live) > 0 {
+		s.bs.wm.UpdatePriority(ctx, live, priority)
+	}
+}
+
+// sortedPeers returns the session's best performing peers, the ones expected
+// to respond the fastest first
+func (s *Session) sortedPeers() []peer.ID {
+	peers := make([]peer.ID, len(s.activePeersArr))
+	copy(peers, s.activePeersArr)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return s.activePeers[peers[i]].faster(s.activePeers[peers[j]])
+	})
+	if len(peers) > maxSessionPeers {
+		peers = peers[:maxSessionPeers]
+	}
+	return peers
+}
+
+// maxLatencySamples bounds the latencies a session keeps to work out
+// percentiles from
+const maxLatencySamples = 512
+
+// recordLatency keeps the latency of a live want, replacing the oldest one
+// once there are enough
+func (s *Session) recordLatency(lat time.Duration) {
+	if len(s.latencies) < maxLatencySamples {
+		s.latencies = append(s.latencies, lat)
+		return
+	}
+	s.latencies[s.latNext] = lat
+	s.latNext = (s.latNext + 1) % maxLatencySamples
+}
+
+// sessionPeer tracks how well a peer has been responding to a session's wants
+type sessionPeer struct {
+	// latency is a moving average of the time it took the peer to send us
+	// the blocks we wanted
+	latency time.Duration
+	// requested and received are the numbers of blocks we have asked the
+	// peer for, and that it has sent us first
+	requested int
+	received  int
+}
+
+func (sp *sessionPeer) recordBlock(lat time.Duration) {
+	if sp.received == 0 {
+		sp.latency = lat
+	} else {
+		sp.latency += (lat - sp.latency) / 4
+	}
+	sp.received++
+}
+
+// expectedLatency is the peer's latency scaled by how often it comes through
+// when asked for a block
+func (sp *sessionPeer) expectedLatency() time.Duration {
+	if sp.received >= sp.requested {
+		return sp.latency
+	}
+	return time.Duration(float64(sp.latency) * float64(sp.requested) / float64(sp.received))
+}
+
+// faster returns true if the peer is expected to respond faster than the
+// other. Peers we haven't received anything from yet come last.
+func (sp *sessionPeer) faster(other *sessionPeer) bool {
+	if sp.received == 0 || other.received == 0 {
+		return sp.received > other.received
+	}
+	return sp.expectedLatency() < other.expectedLatency()
 }
 
 func (s *Session) cancel(keys []cid.Cid) {
 	for _, c := range keys {
 		s.tofetch.Remove(c)
+		if _, ok := s.liveWants[c]; !ok {
+			delete(s.priorities, c)
+		}
 	}
 }
 
@@ -297,9 +677,20 @@ func (s *Session) cancelWants(keys []cid.Cid) {
 	}
 }
 
+// fetchReq is a request for keys, with the given priority if prioritized
+type fetchReq struct {
+	keys        []cid.Cid
+	priority    int
+	prioritized bool
+}
+
 func (s *Session) fetch(ctx context.Context, keys []cid.Cid) {
+	s.sendFetchReq(ctx, s.newReqs, fetchReq{keys: keys})
+}
+
+func (s *Session) sendFetchReq(ctx context.Context, ch chan fetchReq, req fetchReq) {
 	select {
-	case s.newReqs <- keys:
+	case ch <- req:
 	case <-ctx.Done():
 	case <-s.ctx.Done():
 	}
@@ -307,17 +698,151 @@ func (s *Session) fetch(ctx context.Context, keys []cid.Cid) {
 
 // GetBlocks fetches a set of blocks within the context of this session and
 // returns a channel that found blocks will be returned on. No order is
-// guaranteed on the returned blocks.
+// guaranteed on the returned blocks, use GetBlocksOrdered for that.
 func (s *Session) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks.Block, error) {
+	if s.bs.isClosing() {
+		return nil, errBitswapClosed
+	}
 	ctx = logging.ContextWithLoggable(ctx, s.uuid)
 	return getBlocksImpl(ctx, keys, s.notif, s.fetch, s.cancelWants)
 }
 
+// GetBlocksWithPriority is GetBlocks, asking for all the keys with the given
+// priority, as Bitswap.GetBlocksWithPriority does
+func (s *Session) GetBlocksWithPriority(ctx context.Context, keys []cid.Cid, priority int) (<-chan blocks.Block, error) {
+	if s.bs.isClosing() {
+		return nil, errBitswapClosed
+	}
+	ctx = logging.ContextWithLoggable(ctx, s.uuid)
+	fetch := func(ctx context.Context, keys []cid.Cid) {
+		s.sendFetchReq(ctx, s.newReqs, fetchReq{keys: keys, priority: clampPriority(priority), prioritized: true})
+	}
+	return getBlocksImpl(ctx, keys, s.notif, fetch, s.cancelWants)
+}
+
+// UpdatePriority changes the priority of the given keys, if the session still
+// wants them
+func (s *Session) UpdatePriority(keys []cid.Cid, priority int) {
+	if len(keys) == 0 {
+		return
+	}
+	s.sendFetchReq(s.ctx, s.priorityReqs, fetchReq{keys: keys, priority: clampPriority(priority), prioritized: true})
+}
+
 // GetBlock fetches a single block
 func (s *Session) GetBlock(parent context.Context, k cid.Cid) (blocks.Block, error) {
 	return getBlock(parent, k, s.GetBlocks)
 }
 
+// GetBlocksOrdered fetches a set of blocks within the context of this session
+// like GetBlocks, but returns them in the order of keys, repeats included.
+// Only the blocks within the session's ordered window of the next one to be
+// returned are asked for, so that's as many as are held waiting for the ones
+// before them, and no more are asked for while the caller isn't receiving.
+func (s *Session) GetBlocksOrdered(ctx context.Context, keys []cid.Cid) (<-chan blocks.Block, error) {
+	if s.bs.isClosing() {
+		return nil, errBitswapClosed
+	}
+	ctx = logging.ContextWithLoggable(ctx, s.uuid)
+	out := make(chan blocks.Block)
+	go s.fetchOrdered(ctx, keys, out)
+	return out, nil
+}
+
+func (s *Session) fetchOrdered(ctx context.Context, keys []cid.Cid, out chan<- blocks.Block) {
+	// cancelling the context cancels the wants of the blocks asked for but
+	// not received yet
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer close(out)
+
+	window := s.orderedWindow
+	if window < 1 {
+		window = 1
+	}
+	// wait for a quarter of the window to free up before asking for more,
+	// rather than asking for blocks one at a time
+	refill := window / 4
+	if refill < 1 {
+		refill = 1
+	}
+
+	in := make(chan blocks.Block)
+	// buffered holds the blocks received for keys that haven't been
+	// returned yet, and pending counts those keys for each cid
+	buffered := make(map[cid.Cid]blocks.Block)
+	pending := make(map[cid.Cid]int)
+	// fetched are the cids we've asked for before. They are in the
+	// blockstore if they come up again.
+	fetched := cid.NewSet()
+
+	next, requested := 0, 0
+	for next < len(keys) {
+		if requested < len(keys) && next+window-requested >= refill {
+			end := next + window
+			if end > len(keys) {
+				end = len(keys)
+			}
+			var batch []cid.Cid
+			for _, k := range keys[requested:end] {
+				pending[k]++
+				if pending[k] > 1 {
+					continue
+				}
+				if fetched.Has(k) {
+					if blk, err := s.bs.blockstore.Get(k); err == nil {
+						buffered[k] = blk
+						continue
+					}
+				}
+				fetched.Add(k)
+				batch = append(batch, k)
+			}
+			requested = end
+
+			if len(batch) > 0 {
+				blks, err := s.GetBlocks(ctx, batch)
+				if err != nil {
+					return
+				}
+				go func() {
+					for blk := range blks {
+						select {
+						case in <- blk:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}()
+			}
+		}
+
+		k := keys[next]
+		blk, ok := buffered[k]
+		var send chan<- blocks.Block
+		if ok {
+			send = out
+		}
+		select {
+		case send <- blk:
+			next++
+			pending[k]--
+			if pending[k] == 0 {
+				delete(pending, k)
+				delete(buffered, k)
+			}
+		case blk := <-in:
+			if pending[blk.Cid()] > 0 {
+				buffered[blk.Cid()] = blk
+			}
+		case <-ctx.Done():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
 type cidQueue struct {
 	elems []cid.Cid
 	eset  *cid.Set
@@ -3,12 +3,19 @@ package bitswap
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	notifications "github.com/ipfs/go-bitswap/notifications"
+	tn "github.com/ipfs/go-bitswap/testnet"
+
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	peer "github.com/libp2p/go-libp2p-peer"
 	tu "github.com/libp2p/go-testutil"
 )
 
@@ -103,8 +110,8 @@ func TestSessionBetweenPeers(t *testing.T) {
 		}
 	}
 	for _, is := range inst[2:] {
-		if is.Exchange.counters.messagesRecvd > 2 {
-			t.Fatal("uninvolved nodes should only receive two messages", is.Exchange.counters.messagesRecvd)
+		if n := atomic.LoadUint64(&is.Exchange.counters.messagesRecvd); n > 2 {
+			t.Fatal("uninvolved nodes should only receive two messages", n)
 		}
 	}
 }
@@ -323,3 +330,283 @@ func TestWantlistClearsOnCancel(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSessionPeersOrderedByExpectedLatency(t *testing.T) {
+	fast := peer.ID("fast")
+	slow := peer.ID("slow")
+	flaky := peer.ID("flaky")
+	unknown := peer.ID("unknown")
+
+	s := &Session{activePeers: map[peer.ID]*sessionPeer{
+		unknown: {requested: 4},
+		slow:    {requested: 2},
+		flaky:   {requested: 4},
+		fast:    {requested: 2},
+	}}
+	s.activePeersArr = []peer.ID{unknown, slow, flaky, fast}
+
+	s.activePeers[slow].recordBlock(50 * time.Millisecond)
+	s.activePeers[slow].recordBlock(50 * time.Millisecond)
+	s.activePeers[fast].recordBlock(10 * time.Millisecond)
+	s.activePeers[fast].recordBlock(10 * time.Millisecond)
+	// quick to respond, but only sends one in four of the blocks it's asked for
+	s.activePeers[flaky].recordBlock(20 * time.Millisecond)
+
+	exp := []peer.ID{fast, slow, flaky, unknown}
+	got := s.sortedPeers()
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("expected peers in order %s, got %s", exp, got)
+		}
+	}
+}
+
+func TestSessionStatMeanLatencyOverAllBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := clock.NewMock()
+	s := &Session{
+		bs:             &Bitswap{clock: clk},
+		liveWants:      make(map[cid.Cid]time.Time),
+		sentWantBlocks: make(map[cid.Cid]map[peer.ID]struct{}),
+		dontHaves:      make(map[cid.Cid]map[peer.ID]struct{}),
+		priorities:     make(map[cid.Cid]int),
+		tofetch:        newCidQueue(),
+		notif:          notifications.New(),
+	}
+	defer s.notif.Shutdown()
+	bgen := blocksutil.NewBlockGenerator()
+	receive := func(n int, lat time.Duration) {
+		blks := bgen.Blocks(n)
+		for _, blk := range blks {
+			s.liveWants[blk.Cid()] = clk.Now()
+		}
+		clk.Add(lat)
+		for _, blk := range blks {
+			s.receiveBlock(ctx, "", blk)
+		}
+	}
+
+	// a block that was never asked for has no latency to count
+	queued := bgen.Next()
+	s.tofetch.Push(queued.Cid())
+	s.receiveBlock(ctx, "", queued)
+	receive(maxLatencySamples, 3*time.Second)
+	// pushes all the slow blocks out of the samples
+	receive(maxLatencySamples, time.Second)
+
+	st := s.stat()
+	if st.BlocksReceived != 2*maxLatencySamples+1 {
+		t.Fatal("expected all the blocks to be counted, got", st.BlocksReceived)
+	}
+	if st.MeanLatency != 2*time.Second {
+		t.Fatal("expected the mean over all the blocks asked for, got", st.MeanLatency)
+	}
+	if st.P95Latency != time.Second {
+		t.Fatal("expected the p95 over the latest blocks, got", st.P95Latency)
+	}
+}
+
+// oldProtocolNetwork is a network whose peers all predate want-haves
+type oldProtocolNetwork struct {
+	tn.Network
+}
+
+func (n oldProtocolNetwork) Adapter(id tu.Identity) bsnet.BitSwapNetwork {
+	return oldProtocolAdapter{n.Network.Adapter(id)}
+}
+
+type oldProtocolAdapter struct {
+	bsnet.BitSwapNetwork
+}
+
+func (a oldProtocolAdapter) NewMessageSender(ctx context.Context, p peer.ID) (bsnet.MessageSender, error) {
+	ms, err := a.BitSwapNetwork.NewMessageSender(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return oldProtocolSender{ms}, nil
+}
+
+type oldProtocolSender struct {
+	bsnet.MessageSender
+}
+
+func (oldProtocolSender) SupportsHave() bool { return false }
+
+func TestSessionFetchesFromOldPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	vnet := getVirtualNetwork()
+	sesgen := NewTestSessionGenerator(oldProtocolNetwork{vnet})
+	defer sesgen.Close()
+	bgen := blocksutil.NewBlockGenerator()
+
+	inst := sesgen.Instances(2)
+	server := inst[0]
+	client := inst[1]
+	blk := bgen.Next()
+	if err := server.Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	// with no active peers, the session only asks around with want-haves
+	ses := client.Exchange.NewSession(ctx)
+	if _, err := ses.GetBlock(ctx, blk.Cid()); err != nil {
+		t.Fatal("expected the block to be fetched from a peer without want-haves:", err)
+	}
+}
+
+func TestSessionSplitAdjustsToDuplicates(t *testing.T) {
+	s := &Session{split: initialSplit}
+
+	for i := 0; i < splitAdjustWindow; i++ {
+		s.recordReceived(i%2 == 0)
+	}
+	if s.split != initialSplit+1 {
+		t.Fatal("expected a high duplicate ratio to split the wants further, split is", s.split)
+	}
+
+	for i := 0; i < splitAdjustWindow*maxSplit; i++ {
+		s.recordReceived(true)
+	}
+	if s.split != maxSplit {
+		t.Fatal("expected the split to be capped, split is", s.split)
+	}
+
+	for i := 0; i < splitAdjustWindow; i++ {
+		s.recordReceived(false)
+	}
+	if s.split != maxSplit-1 {
+		t.Fatal("expected no duplicates to send the wants to more peers, split is", s.split)
+	}
+}
+
+func TestSessionOrderedFetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	vnet := getVirtualNetwork()
+	sesgen := NewTestSessionGenerator(vnet, SessionOrderedWindow(4))
+	defer sesgen.Close()
+	bgen := blocksutil.NewBlockGenerator()
+
+	inst := sesgen.Instances(2)
+	server := inst[0]
+	client := inst[1]
+
+	blks := bgen.Blocks(20)
+	if err := server.Blockstore().PutMany(blks); err != nil {
+		t.Fatal(err)
+	}
+	var cids []cid.Cid
+	for _, blk := range blks {
+		cids = append(cids, blk.Cid())
+	}
+	// repeats are returned again
+	cids = append(cids, blks[3].Cid(), blks[0].Cid())
+
+	ses := client.Exchange.NewSession(ctx).(*Session)
+	out, err := ses.GetBlocksOrdered(ctx, cids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while nothing is received, no more than the window is fetched
+	time.Sleep(200 * time.Millisecond)
+	var held int
+	for _, blk := range blks {
+		if has, _ := client.Blockstore().Has(blk.Cid()); has {
+			held++
+		}
+	}
+	if held == 0 || held > 4 {
+		t.Fatalf("expected between 1 and 4 blocks fetched ahead, got %d", held)
+	}
+
+	for i, c := range cids {
+		select {
+		case blk, ok := <-out:
+			if !ok {
+				t.Fatal("channel closed after", i, "blocks")
+			}
+			if !blk.Cid().Equals(c) {
+				t.Fatalf("block %d out of order", i)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for block", i)
+		}
+	}
+	if _, ok := <-out; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+}
+
+func TestSessionStat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	vnet := getVirtualNetwork()
+	sesgen := NewTestSessionGenerator(vnet)
+	defer sesgen.Close()
+	bgen := blocksutil.NewBlockGenerator()
+
+	inst := sesgen.Instances(2)
+	server := inst[0]
+	client := inst[1]
+
+	blks := bgen.Blocks(10)
+	var size uint64
+	var cids []cid.Cid
+	for _, blk := range blks {
+		if err := server.Exchange.HasBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+		size += uint64(len(blk.RawData()))
+		cids = append(cids, blk.Cid())
+	}
+
+	sctx, scancel := context.WithCancel(ctx)
+	ses := client.Exchange.NewSession(sctx).(*Session)
+	if sess := client.Exchange.Sessions(); len(sess) != 1 || sess[0] != ses {
+		t.Fatal("expected the session to be listed, got", sess)
+	}
+
+	out, err := ses.GetBlocks(ctx, cids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range blks {
+		if _, ok := <-out; !ok {
+			t.Fatal("didn't fetch all blocks")
+		}
+	}
+
+	st, err := ses.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != ses.ID() || st.BlocksReceived != len(blks) || st.DataReceived != size {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.LiveWants != 0 || st.Queued != 0 {
+		t.Fatalf("expected no wants left, got %d live and %d queued", st.LiveWants, st.Queued)
+	}
+	if st.MeanLatency <= 0 || st.P95Latency < st.MeanLatency/2 {
+		t.Fatalf("unexpected latencies, mean %s and p95 %s", st.MeanLatency, st.P95Latency)
+	}
+	if len(st.Peers) != 1 || st.Peers[0].Peer != server.Peer {
+		t.Fatal("expected the server to be the only peer, got", st.Peers)
+	}
+	if st.Peers[0].Received == 0 || st.Peers[0].Requested < st.Peers[0].Received {
+		t.Fatalf("unexpected contribution from the server %+v", st.Peers[0])
+	}
+
+	scancel()
+	waitFor(t, func() bool { return len(client.Exchange.Sessions()) == 0 })
+	if _, err := ses.Stat(); err == nil {
+		t.Fatal("expected the stats of a closed session to fail")
+	}
+}
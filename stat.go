@@ -1,9 +1,13 @@
 package bitswap
 
 import (
+	"errors"
 	"sort"
+	"sync/atomic"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
 )
 
 type Stat struct {
@@ -17,6 +21,19 @@ type Stat struct {
 	DupBlksReceived  uint64
 	DupDataReceived  uint64
 	MessagesReceived uint64
+	// ThrottleTime is the total time spent waiting on the bandwidth limits
+	// before sending blocks
+	ThrottleTime time.Duration
+	// DeniedWants is the number of wants the serve policy didn't allow us to
+	// serve
+	DeniedWants uint64
+	// ProvideQueueLen is the number of blocks queued up to be provided, and
+	// Provided and ProvideFailures count the provides made and failed
+	ProvideQueueLen int
+	Provided        uint64
+	ProvideFailures uint64
+	// Reprovide is the progress of the latest reprovide run
+	Reprovide ReprovideStat
 }
 
 func (bs *Bitswap) Stat() (*Stat, error) {
@@ -31,8 +48,17 @@ func (bs *Bitswap) Stat() (*Stat, error) {
 	st.BlocksSent = c.blocksSent
 	st.DataSent = c.dataSent
 	st.DataReceived = c.dataRecvd
-	st.MessagesReceived = c.messagesRecvd
+	// messagesRecvd is counted atomically, outside of the lock
+	st.MessagesReceived = atomic.LoadUint64(&c.messagesRecvd)
+	st.ThrottleTime = c.throttleTime
+	st.Provided = c.provided
+	st.ProvideFailures = c.provideFailures
 	bs.counterLk.Unlock()
+	st.ProvideQueueLen = bs.provideQueue.len()
+	if bs.reprovider != nil {
+		st.Reprovide = bs.reprovider.snapshot()
+	}
+	st.DeniedWants = bs.engine.DeniedWants()
 
 	peers := bs.engine.Peers()
 	st.Peers = make([]string, 0, len(peers))
@@ -44,3 +70,107 @@ func (bs *Bitswap) Stat() (*Stat, error) {
 
 	return st, nil
 }
+
+// SessionStat is a snapshot of a session's progress
+type SessionStat struct {
+	ID      uint64
+	Started time.Time
+
+	// BlocksReceived and DataReceived count the wanted blocks received,
+	// and DupBlksReceived the blocks received again
+	BlocksReceived  int
+	DataReceived    uint64
+	DupBlksReceived int
+
+	// MeanLatency and P95Latency are of the time from a block being asked
+	// for to it arriving, the former over all the blocks received and the
+	// latter over the latest ones only
+	MeanLatency time.Duration
+	P95Latency  time.Duration
+
+	// LiveWants are the wants sent out, and Queued the ones waiting to be
+	// sent out
+	LiveWants int
+	Queued    int
+
+	// Peers are the session's active peers, the ones expected to respond
+	// the fastest first
+	Peers []SessionPeerStat
+}
+
+// SessionPeerStat is a peer's contribution to a session
+type SessionPeerStat struct {
+	Peer peer.ID
+	// Requested is the number of blocks asked of the peer, and Received
+	// the number it sent us first
+	Requested int
+	Received  int
+	// Latency is a moving average of the time it took the peer to send us
+	// the blocks
+	Latency time.Duration
+}
+
+// Stat returns a snapshot of the session's progress, or an error once the
+// session is over
+func (s *Session) Stat() (*SessionStat, error) {
+	resp := make(chan *SessionStat, 1)
+	select {
+	case s.statReqs <- resp:
+	case <-s.ctx.Done():
+		return nil, errSessionClosed
+	}
+	select {
+	case st := <-resp:
+		return st, nil
+	case <-s.ctx.Done():
+		return nil, errSessionClosed
+	}
+}
+
+// ID returns the session's ID, unique within its Bitswap instance
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+var errSessionClosed = errors.New("session is closed")
+
+// stat is run by the session's run loop
+func (s *Session) stat() *SessionStat {
+	st := &SessionStat{
+		ID:              s.id,
+		Started:         s.started,
+		BlocksReceived:  s.fetchcnt,
+		DataReceived:    s.bytesRecvd,
+		DupBlksReceived: s.dupTotal,
+		LiveWants:       len(s.liveWants),
+		Queued:          s.tofetch.Len(),
+	}
+	if s.latcnt > 0 {
+		st.MeanLatency = s.latTotal / time.Duration(s.latcnt)
+	}
+	if len(s.latencies) > 0 {
+		sorted := make([]time.Duration, len(s.latencies))
+		copy(sorted, s.latencies)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		st.P95Latency = sorted[(len(sorted)*95-1)/100]
+	}
+	for _, p := range s.sortedPeers() {
+		sp := s.activePeers[p]
+		st.Peers = append(st.Peers, SessionPeerStat{
+			Peer:      p,
+			Requested: sp.requested,
+			Received:  sp.received,
+			Latency:   sp.latency,
+		})
+	}
+	return st
+}
+
+// Sessions returns the sessions currently running
+func (bs *Bitswap) Sessions() []*Session {
+	bs.sessLk.Lock()
+	defer bs.sessLk.Unlock()
+	out := make([]*Session, len(bs.sessions))
+	copy(out, bs.sessions)
+	return out
+}
@@ -1,7 +1,11 @@
 package bitswap
 
 import (
+	"time"
+
 	bsnet "github.com/ipfs/go-bitswap/network"
+
+	delay "github.com/ipfs/go-ipfs-delay"
 	peer "github.com/libp2p/go-libp2p-peer"
 	"github.com/libp2p/go-testutil"
 )
@@ -11,3 +15,47 @@ type Network interface {
 
 	HasPeer(peer.ID) bool
 }
+
+// ConditionedNetwork is a Network whose links can be made slow or lossy, and
+// whose peers can be disconnected and partitioned from each other
+type ConditionedNetwork interface {
+	Network
+
+	// SetLink sets the conditions of the link between two peers, in both
+	// directions
+	SetLink(a, b peer.ID, lc LinkConfig)
+	// SetDefaultLink sets the conditions of the links SetLink wasn't
+	// called for
+	SetDefaultLink(lc LinkConfig)
+
+	// DisconnectPeers closes the connection between two peers, dropping the
+	// messages in flight between them and telling both of the disconnect
+	DisconnectPeers(a, b peer.ID) error
+	// Partition disconnects every peer in a from every peer in b, and
+	// keeps them from reconnecting or sending each other messages until the
+	// returned function is called. Healing the partition reconnects the
+	// peers it disconnected.
+	Partition(a, b []peer.ID) (heal func())
+	// SchedulePartition partitions a from b after the given delay, and heals
+	// the partition after the given duration
+	SchedulePartition(after, duration time.Duration, a, b []peer.ID)
+
+	// SetSeed seeds the random numbers that decide which messages lossy
+	// links drop, so that lossy runs can be reproduced. Unless it's called,
+	// the seed is the time the network was created at.
+	SetSeed(seed int64)
+}
+
+// LinkConfig sets the conditions messages are sent under on a link
+type LinkConfig struct {
+	// Latency is the delay of each message. Use delay.VariableUniform or
+	// delay.VariableNormal for jitter. Nil means the delay the network was
+	// created with.
+	Latency delay.D
+	// Bandwidth is the number of bytes per second that can be sent over the
+	// link in each direction. Messages queue up behind each other to be sent
+	// at it. Zero means unlimited.
+	Bandwidth int
+	// Loss is the probability of a message being silently dropped
+	Loss float64
+}
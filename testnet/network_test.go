@@ -4,6 +4,7 @@ import (
 	"context"
 	"sync"
 	"testing"
+	"time"
 
 	bsmsg "github.com/ipfs/go-bitswap/message"
 	bsnet "github.com/ipfs/go-bitswap/network"
@@ -96,3 +97,216 @@ func (lam *lambdaImpl) PeerConnected(p peer.ID) {
 func (lam *lambdaImpl) PeerDisconnected(peer.ID) {
 	// TODO
 }
+
+// eventReceiver is a Receiver that reports what it receives on channels
+type eventReceiver struct {
+	messages     chan bsmsg.BitSwapMessage
+	connected    chan peer.ID
+	disconnected chan peer.ID
+}
+
+func newEventReceiver() *eventReceiver {
+	return &eventReceiver{
+		messages:     make(chan bsmsg.BitSwapMessage, 16),
+		connected:    make(chan peer.ID, 16),
+		disconnected: make(chan peer.ID, 16),
+	}
+}
+
+func (er *eventReceiver) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) {
+	er.messages <- incoming
+}
+
+func (er *eventReceiver) ReceiveError(err error) {}
+
+func (er *eventReceiver) PeerConnected(p peer.ID) {
+	er.connected <- p
+}
+
+func (er *eventReceiver) PeerDisconnected(p peer.ID) {
+	er.disconnected <- p
+}
+
+func expectPeer(t *testing.T, ch <-chan peer.ID, p peer.ID) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != p {
+			t.Fatal("expected", p, "got", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for", p)
+	}
+}
+
+func expectNoMessage(t *testing.T, er *eventReceiver, wait time.Duration) {
+	t.Helper()
+	select {
+	case <-er.messages:
+		t.Fatal("expected no message to be delivered")
+	case <-time.After(wait):
+	}
+}
+
+// lossSeed seeds the losses of the test networks, so that failures can be
+// reproduced
+const lossSeed = 1
+
+func newConditionedPair(t *testing.T, d delay.D) (ConditionedNetwork, []testutil.Identity, []bsnet.BitSwapNetwork, []*eventReceiver) {
+	net := ConditionedVirtualNetwork(mockrouting.NewServer(), d)
+	net.SetSeed(lossSeed)
+	var ids []testutil.Identity
+	var adapters []bsnet.BitSwapNetwork
+	var receivers []*eventReceiver
+	for i := 0; i < 2; i++ {
+		id := testutil.RandIdentityOrFatal(t)
+		adapter := net.Adapter(id)
+		er := newEventReceiver()
+		adapter.SetDelegate(er)
+		ids = append(ids, id)
+		adapters = append(adapters, adapter)
+		receivers = append(receivers, er)
+	}
+	return net, ids, adapters, receivers
+}
+
+func TestLossyLinkDropsMessages(t *testing.T) {
+	net, ids, adapters, receivers := newConditionedPair(t, delay.Fixed(0))
+	ctx := context.Background()
+
+	net.SetLink(ids[0].ID(), ids[1].ID(), LinkConfig{Loss: 1})
+	if err := adapters[0].SendMessage(ctx, ids[1].ID(), bsmsg.New(true)); err != nil {
+		t.Fatal(err)
+	}
+	expectNoMessage(t, receivers[1], 50*time.Millisecond)
+
+	net.SetLink(ids[0].ID(), ids[1].ID(), LinkConfig{})
+	if err := adapters[0].SendMessage(ctx, ids[1].ID(), bsmsg.New(true)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-receivers[1].messages:
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be delivered once the link stopped dropping")
+	}
+}
+
+// lossPattern sends as many messages as the receiver buffers over a link
+// that loses half of them, and returns which were delivered
+func lossPattern(t *testing.T) []int {
+	net, ids, adapters, receivers := newConditionedPair(t, delay.Fixed(0))
+	ctx := context.Background()
+	net.SetLink(ids[0].ID(), ids[1].ID(), LinkConfig{Loss: 0.5})
+
+	c := blocks.NewBlock([]byte("lossy")).Cid()
+	for i := 0; i < cap(receivers[1].messages); i++ {
+		m := bsmsg.New(false)
+		m.AddEntry(c, i+1)
+		if err := adapters[0].SendMessage(ctx, ids[1].ID(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var delivered []int
+	for {
+		select {
+		case m := <-receivers[1].messages:
+			delivered = append(delivered, m.Wantlist()[0].Priority)
+		case <-time.After(50 * time.Millisecond):
+			return delivered
+		}
+	}
+}
+
+func TestLossReproducibleWithSeed(t *testing.T) {
+	first := lossPattern(t)
+	second := lossPattern(t)
+	if len(first) != len(second) {
+		t.Fatalf("expected the same messages to be lost, got %v and %v", first, second)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected the same messages to be lost, got %v and %v", first, second)
+		}
+	}
+}
+
+func TestLinkBandwidth(t *testing.T) {
+	net, ids, adapters, receivers := newConditionedPair(t, delay.Fixed(0))
+	ctx := context.Background()
+	net.SetDefaultLink(LinkConfig{Bandwidth: 10000})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		m := bsmsg.New(false)
+		m.AddBlock(blocks.NewBlock(make([]byte, 1000+i)))
+		if err := adapters[0].SendMessage(ctx, ids[1].ID(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		<-receivers[1].messages
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatal("expected 3kB at 10kB/s to take at least 300ms, took", elapsed)
+	}
+}
+
+func TestDisconnectDropsMessagesInFlight(t *testing.T) {
+	net, ids, adapters, receivers := newConditionedPair(t, delay.Fixed(50*time.Millisecond))
+	ctx := context.Background()
+	a, b := ids[0].ID(), ids[1].ID()
+
+	if err := adapters[0].ConnectTo(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	expectPeer(t, receivers[1].connected, a)
+	expectPeer(t, receivers[0].connected, b)
+
+	if err := adapters[0].SendMessage(ctx, b, bsmsg.New(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := net.DisconnectPeers(a, b); err != nil {
+		t.Fatal(err)
+	}
+	expectPeer(t, receivers[1].disconnected, a)
+	expectPeer(t, receivers[0].disconnected, b)
+	expectNoMessage(t, receivers[1], 100*time.Millisecond)
+
+	if err := net.DisconnectPeers(a, b); err == nil {
+		t.Fatal("expected disconnecting peers that aren't connected to fail")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	net, ids, adapters, receivers := newConditionedPair(t, delay.Fixed(0))
+	ctx := context.Background()
+	a, b := ids[0].ID(), ids[1].ID()
+
+	if err := adapters[0].ConnectTo(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	expectPeer(t, receivers[1].connected, a)
+	expectPeer(t, receivers[0].connected, b)
+
+	heal := net.Partition([]peer.ID{a}, []peer.ID{b})
+	expectPeer(t, receivers[1].disconnected, a)
+	expectPeer(t, receivers[0].disconnected, b)
+	if err := adapters[0].SendMessage(ctx, b, bsmsg.New(true)); err == nil {
+		t.Fatal("expected sending across the partition to fail")
+	}
+	if err := adapters[1].ConnectTo(ctx, a); err == nil {
+		t.Fatal("expected connecting across the partition to fail")
+	}
+
+	heal()
+	expectPeer(t, receivers[1].connected, a)
+	expectPeer(t, receivers[0].connected, b)
+	if err := adapters[0].SendMessage(ctx, b, bsmsg.New(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	net.SchedulePartition(10*time.Millisecond, 20*time.Millisecond, []peer.ID{a}, []peer.ID{b})
+	expectPeer(t, receivers[0].disconnected, b)
+	expectPeer(t, receivers[0].connected, b)
+}
@@ -3,10 +3,12 @@ package bitswap
 import (
 	"context"
 	"errors"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
 	bsmsg "github.com/ipfs/go-bitswap/message"
 	bsnet "github.com/ipfs/go-bitswap/network"
 
@@ -22,37 +24,81 @@ import (
 
 var log = logging.Logger("bstestnet")
 
+var errLinkCut = errors.New("link to peer is partitioned")
+
 func VirtualNetwork(rs mockrouting.Server, d delay.D) Network {
+	return ConditionedVirtualNetwork(rs, d)
+}
+
+// ConditionedVirtualNetwork returns a virtual network whose links start out
+// with the given delay, never dropping messages nor limiting bandwidth
+func ConditionedVirtualNetwork(rs mockrouting.Server, d delay.D) ConditionedNetwork {
+	return VirtualNetworkWithClock(rs, d, clock.New())
+}
+
+// VirtualNetworkWithClock returns a ConditionedVirtualNetwork whose delays
+// and scheduled partitions run on the given clock
+func VirtualNetworkWithClock(rs mockrouting.Server, d delay.D, clk clock.Clock) ConditionedNetwork {
 	return &network{
-		clients:       make(map[peer.ID]*receiverQueue),
+		clients:       make(map[peer.ID]*networkClient),
 		delay:         d,
 		routingserver: rs,
 		conns:         make(map[string]struct{}),
+		links:         make(map[string]LinkConfig),
+		queues:        make(map[linkKey]*receiverQueue),
+		cut:           make(map[string]int),
+		rng:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		clock:         clk,
 	}
 }
 
 type network struct {
 	mu            sync.Mutex
-	clients       map[peer.ID]*receiverQueue
+	clients       map[peer.ID]*networkClient
 	routingserver mockrouting.Server
 	delay         delay.D
 	conns         map[string]struct{}
+
+	// links are the conditions of each link, keyed by tagForPeers
+	links       map[string]LinkConfig
+	defaultLink LinkConfig
+	// queues are the messages in flight on each link, per direction
+	queues map[linkKey]*receiverQueue
+	// cut counts the partitions each link is cut by
+	cut map[string]int
+	rng *rand.Rand
+
+	clock clock.Clock
+}
+
+// linkKey is a direction of a link
+type linkKey struct {
+	from peer.ID
+	to   peer.ID
 }
 
 type message struct {
 	from       peer.ID
 	msg        bsmsg.BitSwapMessage
 	shouldSend time.Time
+	gen        int
 }
 
-// receiverQueue queues up a set of messages to be sent, and sends them *in
-// order* with their delays respected as much as sending them in order allows
-// for
+// receiverQueue queues up a set of messages to be sent over a link, and sends
+// them *in order* with their delays respected as much as sending them in
+// order allows for
 type receiverQueue struct {
 	receiver *networkClient
 	queue    []*message
 	active   bool
 	lk       sync.Mutex
+
+	// gen is bumped when the link disconnects, so that messages in flight
+	// are dropped
+	gen int
+	// busyUntil is when the link is done sending the queued messages at
+	// its bandwidth. It's guarded by the network's lock.
+	busyUntil time.Time
 }
 
 func (n *network) Adapter(p testutil.Identity) bsnet.BitSwapNetwork {
@@ -64,7 +110,7 @@ func (n *network) Adapter(p testutil.Identity) bsnet.BitSwapNetwork {
 		network: n,
 		routing: n.routingserver.Client(p),
 	}
-	n.clients[p.ID()] = &receiverQueue{receiver: client}
+	n.clients[p.ID()] = client
 	return client
 }
 
@@ -76,6 +122,27 @@ func (n *network) HasPeer(p peer.ID) bool {
 	return found
 }
 
+// SetLink implements ConditionedNetwork
+func (n *network) SetLink(a, b peer.ID, lc LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[tagForPeers(a, b)] = lc
+}
+
+// SetSeed implements ConditionedNetwork
+func (n *network) SetSeed(seed int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rng = rand.New(rand.NewSource(seed))
+}
+
+// SetDefaultLink implements ConditionedNetwork
+func (n *network) SetDefaultLink(lc LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.defaultLink = lc
+}
+
 // TODO should this be completely asynchronous?
 // TODO what does the network layer do with errors received from services?
 func (n *network) SendMessage(
@@ -92,19 +159,203 @@ func (n *network) SendMessage(
 		return errors.New("cannot locate peer on network")
 	}
 
+	tag := tagForPeers(from, to)
+	if n.cut[tag] > 0 {
+		return errLinkCut
+	}
+	lc, ok := n.links[tag]
+	if !ok {
+		lc = n.defaultLink
+	}
+	if lc.Loss > 0 && n.rng.Float64() < lc.Loss {
+		return nil
+	}
+	d := n.delay
+	if lc.Latency != nil {
+		d = lc.Latency
+	}
+
+	rq := n.queue(from, receiver)
+	sent := n.clock.Now()
+	if lc.Bandwidth > 0 {
+		if rq.busyUntil.After(sent) {
+			sent = rq.busyUntil
+		}
+		sent = sent.Add(time.Duration(messageSize(mes)) * time.Second / time.Duration(lc.Bandwidth))
+		rq.busyUntil = sent
+	}
+
 	// nb: terminate the context since the context wouldn't actually be passed
 	// over the network in a real scenario
 
 	msg := &message{
 		from:       from,
 		msg:        mes,
-		shouldSend: time.Now().Add(n.delay.Get()),
+		shouldSend: sent.Add(d.Get()),
+	}
+	rq.enqueue(msg)
+
+	return nil
+}
+
+// queue returns the queue of messages from the given peer to the given
+// client, creating it if necessary. n.mu must be held.
+func (n *network) queue(from peer.ID, to *networkClient) *receiverQueue {
+	k := linkKey{from, to.local}
+	rq, ok := n.queues[k]
+	if !ok {
+		rq = &receiverQueue{receiver: to}
+		n.queues[k] = rq
+	}
+	return rq
+}
+
+// connect connects two peers, and tells both of them
+func (n *network) connect(a, b peer.ID) error {
+	n.mu.Lock()
+
+	ca, aok := n.clients[a]
+	cb, bok := n.clients[b]
+	if !aok || !bok {
+		n.mu.Unlock()
+		return errors.New("no such peer in network")
+	}
+
+	tag := tagForPeers(a, b)
+	if n.cut[tag] > 0 {
+		n.mu.Unlock()
+		return errLinkCut
+	}
+	if _, ok := n.conns[tag]; ok {
+		n.mu.Unlock()
+		log.Warning("ALREADY CONNECTED TO PEER (is this a reconnect? test lib needs fixing)")
+		return nil
+	}
+	n.conns[tag] = struct{}{}
+	n.mu.Unlock()
+
+	cb.PeerConnected(a)
+	ca.PeerConnected(b)
+	return nil
+}
+
+// disconnect closes the connection between two peers, and drops the messages
+// in flight between them. It returns false if they weren't connected. n.mu
+// must be held, and the peers told of the disconnect once it's released.
+func (n *network) disconnect(a, b peer.ID) bool {
+	tag := tagForPeers(a, b)
+	if _, ok := n.conns[tag]; !ok {
+		return false
 	}
-	receiver.enqueue(msg)
+	delete(n.conns, tag)
+	for _, k := range []linkKey{{a, b}, {b, a}} {
+		if rq, ok := n.queues[k]; ok {
+			rq.drop()
+		}
+	}
+	return true
+}
+
+// notifyDisconnected tells both peers of a disconnect
+func (n *network) notifyDisconnected(a, b peer.ID) {
+	n.mu.Lock()
+	ca := n.clients[a]
+	cb := n.clients[b]
+	n.mu.Unlock()
+
+	if cb != nil {
+		cb.PeerDisconnected(a)
+	}
+	if ca != nil {
+		ca.PeerDisconnected(b)
+	}
+}
 
+// DisconnectPeers implements ConditionedNetwork
+func (n *network) DisconnectPeers(a, b peer.ID) error {
+	n.mu.Lock()
+	ok := n.disconnect(a, b)
+	n.mu.Unlock()
+	if !ok {
+		return errors.New("peers are not connected")
+	}
+	n.notifyDisconnected(a, b)
 	return nil
 }
 
+// Partition implements ConditionedNetwork
+func (n *network) Partition(a, b []peer.ID) func() {
+	var tags []string
+	var disconnected [][2]peer.ID
+
+	n.mu.Lock()
+	for _, pa := range a {
+		for _, pb := range b {
+			if pa == pb {
+				continue
+			}
+			tag := tagForPeers(pa, pb)
+			tags = append(tags, tag)
+			n.cut[tag]++
+			if n.disconnect(pa, pb) {
+				disconnected = append(disconnected, [2]peer.ID{pa, pb})
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	for _, pair := range disconnected {
+		n.notifyDisconnected(pair[0], pair[1])
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			n.mu.Lock()
+			for _, tag := range tags {
+				n.cut[tag]--
+				if n.cut[tag] == 0 {
+					delete(n.cut, tag)
+				}
+			}
+			n.mu.Unlock()
+
+			for _, pair := range disconnected {
+				// fails if another partition still cuts the link
+				n.connect(pair[0], pair[1])
+			}
+		})
+	}
+}
+
+// SchedulePartition implements ConditionedNetwork
+func (n *network) SchedulePartition(after, duration time.Duration, a, b []peer.ID) {
+	n.clock.AfterFunc(after, func() {
+		heal := n.Partition(a, b)
+		n.clock.AfterFunc(duration, heal)
+	})
+}
+
+// messageSize returns the size of the message on the wire
+func messageSize(m bsmsg.BitSwapMessage) int {
+	var cw countingWriter
+	if err := m.ToNetV1(&cw); err != nil {
+		size := 0
+		for _, b := range m.Blocks() {
+			size += len(b.RawData())
+		}
+		return size
+	}
+	return int(cw)
+}
+
+type countingWriter int
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	*cw += countingWriter(len(p))
+	return len(p), nil
+}
+
 type networkClient struct {
 	local peer.ID
 	bsnet.Receiver
@@ -195,33 +446,17 @@ func (nc *networkClient) SetDelegate(r bsnet.Receiver) {
 }
 
 func (nc *networkClient) ConnectTo(_ context.Context, p peer.ID) error {
-	nc.network.mu.Lock()
-
-	otherClient, ok := nc.network.clients[p]
-	if !ok {
-		nc.network.mu.Unlock()
-		return errors.New("no such peer in network")
-	}
-
-	tag := tagForPeers(nc.local, p)
-	if _, ok := nc.network.conns[tag]; ok {
-		nc.network.mu.Unlock()
-		log.Warning("ALREADY CONNECTED TO PEER (is this a reconnect? test lib needs fixing)")
-		return nil
-	}
-	nc.network.conns[tag] = struct{}{}
-	nc.network.mu.Unlock()
-
-	// TODO: add handling for disconnects
+	return nc.network.connect(nc.local, p)
+}
 
-	otherClient.receiver.PeerConnected(nc.local)
-	nc.Receiver.PeerConnected(p)
-	return nil
+func (nc *networkClient) DisconnectFrom(_ context.Context, p peer.ID) error {
+	return nc.network.DisconnectPeers(nc.local, p)
 }
 
 func (rq *receiverQueue) enqueue(m *message) {
 	rq.lk.Lock()
 	defer rq.lk.Unlock()
+	m.gen = rq.gen
 	rq.queue = append(rq.queue, m)
 	if !rq.active {
 		rq.active = true
@@ -241,12 +476,27 @@ func (rq *receiverQueue) process() {
 		rq.queue = rq.queue[1:]
 		rq.lk.Unlock()
 
-		time.Sleep(time.Until(m.shouldSend))
+		clk := rq.receiver.network.clock
+		clk.Sleep(clk.Until(m.shouldSend))
+		rq.lk.Lock()
+		dropped := m.gen != rq.gen
+		rq.lk.Unlock()
+		if dropped {
+			continue
+		}
 		atomic.AddUint64(&rq.receiver.stats.MessagesRecvd, 1)
 		rq.receiver.ReceiveMessage(context.TODO(), m.from, m.msg)
 	}
 }
 
+// drop drops the queued messages, and the one being sent
+func (rq *receiverQueue) drop() {
+	rq.lk.Lock()
+	defer rq.lk.Unlock()
+	rq.queue = nil
+	rq.gen++
+}
+
 func tagForPeers(a, b peer.ID) string {
 	if a < b {
 		return string(a + b)
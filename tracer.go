@@ -0,0 +1,226 @@
+package bitswap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+
+	cid "github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// EventType identifies what a traced Event is about
+type EventType string
+
+const (
+	// EventWantSent is a want for Cid sent to Peer. WantType is "block" or
+	// "have".
+	EventWantSent EventType = "want-sent"
+	// EventCancelSent is a cancel for Cid sent to Peer
+	EventCancelSent EventType = "cancel-sent"
+	// EventBlockReceived is a block received from Peer. Duplicate is set if
+	// we already had it.
+	EventBlockReceived EventType = "block-received"
+	// EventBlockServed is a block sent to Peer
+	EventBlockServed EventType = "block-served"
+	// EventSessionPeerAdded is Peer being added to Session's active peers
+	EventSessionPeerAdded EventType = "session-peer-added"
+	// EventProviderSearchStarted is a search for providers of Cid, on behalf
+	// of Session if it's set
+	EventProviderSearchStarted EventType = "provider-search-started"
+	// EventProviderSearchFinished is the end of a search for providers of
+	// Cid, in which Providers were found
+	EventProviderSearchFinished EventType = "provider-search-finished"
+	// EventPeerConnected is Peer connecting to us
+	EventPeerConnected EventType = "peer-connected"
+	// EventPeerDisconnected is Peer disconnecting from us
+	EventPeerDisconnected EventType = "peer-disconnected"
+	// EventPeerPenalized is Peer's misbehavior score reaching the threshold
+	EventPeerPenalized EventType = "peer-penalized"
+	// EventPeerReleased is Peer's score decaying after it was penalized
+	EventPeerReleased EventType = "peer-released"
+)
+
+// Event is a protocol-level decision or occurrence in bitswap. Only the fields
+// relevant to its Type are set.
+type Event struct {
+	Time time.Time
+	Type EventType
+
+	Peer    peer.ID
+	Cid     cid.Cid
+	Session uint64
+
+	WantType  string
+	Size      int
+	Duplicate bool
+	Providers int
+}
+
+// Tracer receives the events bitswap emits. Trace is called from many
+// goroutines, and should return quickly.
+type Tracer interface {
+	Trace(ev Event)
+}
+
+// traceEvent passes the event on to the tracer, if there is one
+func traceEvent(t Tracer, ev Event) {
+	if t == nil {
+		return
+	}
+	t.Trace(ev)
+}
+
+// clockTracer stamps the events passed on to a Tracer with the time on
+// bitswap's clock
+type clockTracer struct {
+	Tracer
+	clock clock.Clock
+}
+
+func (t clockTracer) Trace(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = t.clock.Now()
+	}
+	t.Tracer.Trace(ev)
+}
+
+// jsonEvent is how an Event is written out by the JSONTracer
+type jsonEvent struct {
+	Time      time.Time `json:"time"`
+	Type      EventType `json:"type"`
+	Peer      string    `json:"peer,omitempty"`
+	Cid       string    `json:"cid,omitempty"`
+	Session   uint64    `json:"session,omitempty"`
+	WantType  string    `json:"wantType,omitempty"`
+	Size      int       `json:"size,omitempty"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+	Providers int       `json:"providers,omitempty"`
+}
+
+// jsonTracerBuffer is the number of events a JSONTracer queues up for writing
+// before dropping them
+const jsonTracerBuffer = 1024
+
+// JSONTracer is a Tracer that writes each event as a line of JSON. Events are
+// written out in the background, through a buffer that is flushed whenever
+// there are no more events to write. Events traced faster than they can be
+// written are dropped, rather than holding up bitswap.
+type JSONTracer struct {
+	dropped uint64 // accessed atomically, so kept first for alignment
+
+	lk     sync.RWMutex
+	closed bool
+	events chan jsonEvent
+	done   chan struct{}
+
+	w   io.Writer
+	bw  *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONTracer returns a JSONTracer writing to the given writer
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	bw := bufio.NewWriter(w)
+	jt := &JSONTracer{
+		events: make(chan jsonEvent, jsonTracerBuffer),
+		done:   make(chan struct{}),
+		w:      w,
+		bw:     bw,
+		enc:    json.NewEncoder(bw),
+	}
+	go jt.write()
+	return jt
+}
+
+// NewJSONFileTracer returns a JSONTracer appending to the file at the given
+// path, creating it if necessary
+func NewJSONFileTracer(path string) (*JSONTracer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONTracer(f), nil
+}
+
+// Trace implements Tracer. Events that fail to be written are dropped, and
+// the first error is returned by Close.
+func (jt *JSONTracer) Trace(ev Event) {
+	je := jsonEvent{
+		Time:      ev.Time,
+		Type:      ev.Type,
+		Session:   ev.Session,
+		WantType:  ev.WantType,
+		Size:      ev.Size,
+		Duplicate: ev.Duplicate,
+		Providers: ev.Providers,
+	}
+	if ev.Peer != "" {
+		je.Peer = ev.Peer.Pretty()
+	}
+	if ev.Cid.Defined() {
+		je.Cid = ev.Cid.String()
+	}
+
+	jt.lk.RLock()
+	defer jt.lk.RUnlock()
+	if jt.closed {
+		return
+	}
+	select {
+	case jt.events <- je:
+	default:
+		atomic.AddUint64(&jt.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because they were traced
+// faster than they could be written
+func (jt *JSONTracer) Dropped() uint64 {
+	return atomic.LoadUint64(&jt.dropped)
+}
+
+// write writes out the queued events until the tracer is closed, and then
+// closes the underlying writer
+func (jt *JSONTracer) write() {
+	defer close(jt.done)
+	for je := range jt.events {
+		jt.setErr(jt.enc.Encode(je))
+		if len(jt.events) == 0 {
+			jt.setErr(jt.bw.Flush())
+		}
+	}
+	jt.setErr(jt.bw.Flush())
+	if c, ok := jt.w.(io.Closer); ok {
+		jt.setErr(c.Close())
+	}
+}
+
+// setErr records the first error writing out the events. It's only called
+// from the write goroutine, which Close waits for before reading it.
+func (jt *JSONTracer) setErr(err error) {
+	if err != nil && jt.err == nil {
+		jt.err = err
+	}
+}
+
+// Close writes out the events traced so far, and closes the underlying
+// writer, if it is an io.Closer
+func (jt *JSONTracer) Close() error {
+	jt.lk.Lock()
+	if !jt.closed {
+		jt.closed = true
+		close(jt.events)
+	}
+	jt.lk.Unlock()
+
+	<-jt.done
+	return jt.err
+}
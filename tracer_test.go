@@ -0,0 +1,157 @@
+package bitswap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	tn "github.com/ipfs/go-bitswap/testnet"
+
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	delay "github.com/ipfs/go-ipfs-delay"
+	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
+)
+
+type recordingTracer struct {
+	lk     sync.Mutex
+	events []Event
+}
+
+func (rt *recordingTracer) Trace(ev Event) {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	rt.events = append(rt.events, ev)
+}
+
+func (rt *recordingTracer) find(typ EventType) (Event, bool) {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+	for _, ev := range rt.events {
+		if ev.Type == typ {
+			return ev, true
+		}
+	}
+	return Event{}, false
+}
+
+func TestTracerSeesTransfer(t *testing.T) {
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(kNetworkDelay))
+	tracer := &recordingTracer{}
+	sg := NewTestSessionGenerator(net, EventTracer(tracer))
+	defer sg.Close()
+	bg := blocksutil.NewBlockGenerator()
+
+	instances := sg.Instances(2)
+	server := instances[0]
+	client := instances[1]
+	blk := bg.Next()
+	if err := server.Exchange.HasBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := client.Exchange.GetBlock(ctx, blk.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		_, ok := tracer.find(EventBlockServed)
+		return ok
+	})
+	for _, exp := range []Event{
+		{Type: EventPeerConnected},
+		{Type: EventWantSent, Peer: server.Peer, Cid: blk.Cid(), WantType: "block"},
+		{Type: EventBlockReceived, Peer: server.Peer, Cid: blk.Cid(), Size: len(blk.RawData())},
+		{Type: EventBlockServed, Peer: client.Peer, Cid: blk.Cid(), Size: len(blk.RawData())},
+	} {
+		ev, ok := tracer.find(exp.Type)
+		if !ok {
+			t.Fatal("expected a", exp.Type, "event")
+		}
+		if ev.Time.IsZero() {
+			t.Fatal("expected events to be timestamped")
+		}
+		ev.Time = time.Time{}
+		if exp.Peer == "" {
+			continue
+		}
+		if ev != exp {
+			t.Fatalf("expected %+v, got %+v", exp, ev)
+		}
+	}
+}
+
+func TestJSONTracer(t *testing.T) {
+	var buf bytes.Buffer
+	jt := NewJSONTracer(&buf)
+	bg := blocksutil.NewBlockGenerator()
+	blk := bg.Next()
+
+	jt.Trace(Event{Time: time.Now(), Type: EventBlockReceived, Peer: "peer", Cid: blk.Cid(), Duplicate: true})
+	jt.Trace(Event{Time: time.Now(), Type: EventPeerDisconnected, Peer: "peer"})
+	if err := jt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatal("expected a line per event, got", len(lines))
+	}
+	if lines[0]["type"] != string(EventBlockReceived) || lines[0]["cid"] != blk.Cid().String() || lines[0]["duplicate"] != true {
+		t.Fatal("unexpected first event", lines[0])
+	}
+	if _, ok := lines[1]["cid"]; ok {
+		t.Fatal("unset fields should be left out", lines[1])
+	}
+}
+
+// stuckWriter blocks writes until it's released
+type stuckWriter struct {
+	release chan struct{}
+}
+
+func (sw *stuckWriter) Write(b []byte) (int, error) {
+	<-sw.release
+	return len(b), nil
+}
+
+func TestJSONTracerDropsWhenBehind(t *testing.T) {
+	sw := &stuckWriter{release: make(chan struct{})}
+	jt := NewJSONTracer(sw)
+
+	// the first events written out get stuck flushing, and the rest are
+	// queued until the queue is full
+	traced := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*jsonTracerBuffer; i++ {
+			jt.Trace(Event{Time: time.Now(), Type: EventPeerConnected, Peer: "peer"})
+		}
+		close(traced)
+	}()
+	select {
+	case <-traced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracing shouldn't wait on the writer")
+	}
+	if jt.Dropped() == 0 {
+		t.Fatal("expected events to be dropped while the writer was stuck")
+	}
+
+	close(sw.release)
+	if err := jt.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
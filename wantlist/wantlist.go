@@ -6,6 +6,8 @@ import (
 	"sort"
 	"sync"
 
+	pb "github.com/ipfs/go-bitswap/message/pb"
+
 	cid "github.com/ipfs/go-cid"
 )
 
@@ -23,9 +25,18 @@ type Entry struct {
 	Cid      cid.Cid
 	Priority int
 
+	// WantType is either a want for the block itself, or only for
+	// confirmation that the peer has it (want-have)
+	WantType pb.Message_Wantlist_WantType
+	// SendDontHave asks the peer to tell us explicitly if it doesn't have the
+	// block, instead of staying silent
+	SendDontHave bool
+
 	SesTrk map[uint64]struct{}
 	// Trash in a book-keeping field
 	Trash bool
+	// Size is a book-keeping field for the size of the wanted block
+	Size int
 }
 
 // NewRefEntry creates a new reference tracked wantlist entry
@@ -59,21 +70,38 @@ func New() *Wantlist {
 // by the session ID 'ses'.  if a cid is added under multiple session IDs, then
 // it must be removed by each of those sessions before it is no longer 'in the
 // wantlist'. Calls to Add are idempotent given the same arguments. Subsequent
-// calls with different values for priority will not update the priority
-// TODO: think through priority changes here
+// calls with different values for priority will not update the priority, use
+// SetPriority for that.
 // Add returns true if the cid did not exist in the wantlist before this call
 // (even if it was under a different session)
 func (w *ThreadSafe) Add(c cid.Cid, priority int, ses uint64) bool {
+	return w.AddTyped(c, priority, pb.Message_Wantlist_Block, ses)
+}
+
+// AddTyped is like Add, but also records the type of the want. A want-block
+// supersedes an existing want-have for the same cid (but not the other way
+// around), in which case AddTyped also returns true, as the upgrade needs to
+// be sent out.
+func (w *ThreadSafe) AddTyped(c cid.Cid, priority int, wantType pb.Message_Wantlist_WantType, ses uint64) bool {
 	w.lk.Lock()
 	defer w.lk.Unlock()
 	if e, ok := w.set[c]; ok {
 		e.SesTrk[ses] = struct{}{}
+		if e.WantType == pb.Message_Wantlist_Have && wantType == pb.Message_Wantlist_Block {
+			// entries may be shared with other wantlists, replace rather
+			// than mutate
+			ne := *e
+			ne.WantType = wantType
+			w.set[c] = &ne
+			return true
+		}
 		return false
 	}
 
 	w.set[c] = &Entry{
 		Cid:      c,
 		Priority: priority,
+		WantType: wantType,
 		SesTrk:   map[uint64]struct{}{ses: struct{}{}},
 	}
 
@@ -93,6 +121,23 @@ func (w *ThreadSafe) AddEntry(e *Entry, ses uint64) bool {
 	return true
 }
 
+// SetPriority changes the priority of the given cid, if it is in the
+// wantlist, and returns true if it changed
+func (w *ThreadSafe) SetPriority(c cid.Cid, priority int) bool {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	e, ok := w.set[c]
+	if !ok || e.Priority == priority {
+		return false
+	}
+	// entries may be shared with other wantlists, replace rather than
+	// mutate
+	ne := *e
+	ne.Priority = priority
+	w.set[c] = &ne
+	return true
+}
+
 // Remove removes the given cid from being tracked by the given session.
 // 'true' is returned if this call to Remove removed the final session ID
 // tracking the cid. (meaning true will be returned iff this call caused the
@@ -149,18 +194,44 @@ func (w *Wantlist) Len() int {
 }
 
 func (w *Wantlist) Add(c cid.Cid, priority int) bool {
-	if _, ok := w.set[c]; ok {
+	return w.AddTyped(c, priority, pb.Message_Wantlist_Block)
+}
+
+// AddTyped adds the given cid with the given want type. As with
+// ThreadSafe.AddTyped, a want-block upgrades an existing want-have.
+func (w *Wantlist) AddTyped(c cid.Cid, priority int, wantType pb.Message_Wantlist_WantType) bool {
+	if e, ok := w.set[c]; ok {
+		if e.WantType == pb.Message_Wantlist_Have && wantType == pb.Message_Wantlist_Block {
+			ne := *e
+			ne.WantType = wantType
+			w.set[c] = &ne
+			return true
+		}
 		return false
 	}
 
 	w.set[c] = &Entry{
 		Cid:      c,
 		Priority: priority,
+		WantType: wantType,
 	}
 
 	return true
 }
 
+// SetPriority changes the priority of the given cid, if it is in the
+// wantlist, and returns true if it changed
+func (w *Wantlist) SetPriority(c cid.Cid, priority int) bool {
+	e, ok := w.set[c]
+	if !ok || e.Priority == priority {
+		return false
+	}
+	ne := *e
+	ne.Priority = priority
+	w.set[c] = &ne
+	return true
+}
+
 func (w *Wantlist) AddEntry(e *Entry) bool {
 	if _, ok := w.set[e.Cid]; ok {
 		return false
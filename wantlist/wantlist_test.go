@@ -3,6 +3,8 @@ package wantlist
 import (
 	"testing"
 
+	pb "github.com/ipfs/go-bitswap/message/pb"
+
 	cid "github.com/ipfs/go-cid"
 )
 
@@ -102,3 +104,81 @@ func TestSesRefWantlist(t *testing.T) {
 	}
 	assertNotHasCid(t, wl, testcids[0])
 }
+
+func TestWantHaveUpgrade(t *testing.T) {
+	wl := NewThreadSafe()
+
+	if !wl.AddTyped(testcids[0], 5, pb.Message_Wantlist_Have, 1) {
+		t.Fatal("should have added")
+	}
+	if wl.AddTyped(testcids[0], 5, pb.Message_Wantlist_Have, 1) {
+		t.Fatal("shouldnt have added")
+	}
+	if !wl.AddTyped(testcids[0], 5, pb.Message_Wantlist_Block, 1) {
+		t.Fatal("want-block should upgrade a want-have")
+	}
+	if wl.AddTyped(testcids[0], 5, pb.Message_Wantlist_Have, 1) {
+		t.Fatal("want-have shouldnt downgrade a want-block")
+	}
+	e, _ := wl.Contains(testcids[0])
+	if e.WantType != pb.Message_Wantlist_Block {
+		t.Fatal("expected want-block")
+	}
+	if !wl.Remove(testcids[0], 1) {
+		t.Fatal("should have removed")
+	}
+}
+
+func TestWantHaveUpgradeKeepsEntry(t *testing.T) {
+	e := NewRefEntry(testcids[0], 5)
+	e.WantType = pb.Message_Wantlist_Have
+	e.SendDontHave = true
+	wl := NewThreadSafe()
+	wl.AddEntry(e, 1)
+	if !wl.AddTyped(testcids[0], 7, pb.Message_Wantlist_Block, 2) {
+		t.Fatal("want-block should upgrade a want-have")
+	}
+	ne, _ := wl.Contains(testcids[0])
+	if ne.WantType != pb.Message_Wantlist_Block || ne.Priority != 5 || !ne.SendDontHave || len(ne.SesTrk) != 2 {
+		t.Fatalf("expected only the want type to change, got %+v", ne)
+	}
+	if e.WantType != pb.Message_Wantlist_Have {
+		t.Fatal("the shared entry should be left alone")
+	}
+
+	lwl := New()
+	lwl.AddEntry(&Entry{Cid: testcids[0], Priority: 5, WantType: pb.Message_Wantlist_Have, SendDontHave: true})
+	if !lwl.AddTyped(testcids[0], 7, pb.Message_Wantlist_Block) {
+		t.Fatal("want-block should upgrade a want-have")
+	}
+	ne, _ = lwl.Contains(testcids[0])
+	if ne.WantType != pb.Message_Wantlist_Block || ne.Priority != 5 || !ne.SendDontHave {
+		t.Fatalf("expected only the want type to change, got %+v", ne)
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	wl := NewThreadSafe()
+
+	if wl.SetPriority(testcids[0], 5) {
+		t.Fatal("shouldnt have set the priority of a cid not in the wantlist")
+	}
+	wl.Add(testcids[0], 5, 1)
+	e, _ := wl.Contains(testcids[0])
+	if wl.SetPriority(testcids[0], 5) {
+		t.Fatal("shouldnt have changed the priority")
+	}
+	if !wl.SetPriority(testcids[0], 10) {
+		t.Fatal("should have changed the priority")
+	}
+	ne, _ := wl.Contains(testcids[0])
+	if ne.Priority != 10 {
+		t.Fatal("expected priority 10, got", ne.Priority)
+	}
+	if e.Priority != 5 {
+		t.Fatal("entries handed out shouldnt be mutated")
+	}
+	if !wl.Remove(testcids[0], 1) {
+		t.Fatal("updating the priority shouldnt affect sessions")
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"sync"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
 	engine "github.com/ipfs/go-bitswap/decision"
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
 	bsnet "github.com/ipfs/go-bitswap/network"
 	wantlist "github.com/ipfs/go-bitswap/wantlist"
 
+	lru "github.com/hashicorp/golang-lru"
 	cid "github.com/ipfs/go-cid"
 	metrics "github.com/ipfs/go-metrics-interface"
 	peer "github.com/libp2p/go-libp2p-peer"
@@ -20,6 +23,13 @@ type WantManager struct {
 	incoming     chan *wantSet
 	connectEvent chan peerStatus     // notification channel for peers connecting/disconnecting
 	peerReqs     chan chan []peer.ID // channel to request connected peers on
+	pendingReqs  chan chan int       // channel to request the pending message count on
+	stopReq      chan struct{}       // asks the Run loop to shut down
+
+	// stopped is closed once the Run loop has exited, and running tracks the
+	// Run loop and message queue goroutines
+	stopped chan struct{}
+	running sync.WaitGroup
 
 	// synchronized by Run loop, only touch inside there
 	peers map[peer.ID]*msgQueue
@@ -30,6 +40,22 @@ type WantManager struct {
 	ctx     context.Context
 	cancel  func()
 
+	// peerFilter decides which peers we send wants to, if set
+	peerFilter engine.PeerFilter
+
+	// tracer receives an event for every want and cancel sent, if set
+	tracer Tracer
+
+	// clock is what the message queues back off on
+	clock clock.Clock
+
+	// haveSupport records the peers found to predate want-haves
+	haveSupport *haveSupport
+
+	// canceled remembers when wants recently left the wantlist, so that
+	// blocks crossing our cancels in flight aren't held against the peer
+	canceled *lru.Cache
+
 	wantlistGauge metrics.Gauge
 	sentHistogram metrics.Histogram
 }
@@ -45,19 +71,29 @@ func NewWantManager(ctx context.Context, network bsnet.BitSwapNetwork) *WantMana
 		"Number of items in wantlist.").Gauge()
 	sentHistogram := metrics.NewCtx(ctx, "sent_all_blocks_bytes", "Histogram of blocks sent by"+
 		" this bitswap").Histogram(metricsBuckets)
-	return &WantManager{
+	canceled, _ := lru.New(canceledWantsSize)
+	wm := &WantManager{
 		incoming:      make(chan *wantSet, 10),
 		connectEvent:  make(chan peerStatus, 10),
 		peerReqs:      make(chan chan []peer.ID),
+		pendingReqs:   make(chan chan int),
+		stopReq:       make(chan struct{}),
+		stopped:       make(chan struct{}),
 		peers:         make(map[peer.ID]*msgQueue),
 		wl:            wantlist.NewThreadSafe(),
 		bcwl:          wantlist.NewThreadSafe(),
 		network:       network,
 		ctx:           ctx,
 		cancel:        cancel,
+		clock:         clock.New(),
+		haveSupport:   &haveSupport{old: make(map[peer.ID]struct{})},
+		canceled:      canceled,
 		wantlistGauge: wantlistGauge,
 		sentHistogram: sentHistogram,
 	}
+	// added up front, so that Shutdown can't wait before Run has started
+	wm.running.Add(1)
+	return wm
 }
 
 type msgQueue struct {
@@ -68,7 +104,17 @@ type msgQueue struct {
 	network bsnet.BitSwapNetwork
 	wl      *wantlist.ThreadSafe
 
+	// resendFull is set once a send failed, so that the full wantlist is
+	// sent next. It's guarded by outlk.
+	resendFull bool
+
 	sender bsnet.MessageSender
+	tracer Tracer
+	clock  clock.Clock
+
+	// haveSupport is told whether the peer supports want-haves once a
+	// stream is opened to it
+	haveSupport *haveSupport
 
 	refcnt int
 
@@ -76,45 +122,106 @@ type msgQueue struct {
 	done chan struct{}
 }
 
-// WantBlocks adds the given cids to the wantlist, tracked by the given session
-func (pm *WantManager) WantBlocks(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64) {
+// WantBlocks adds the given cids to the wantlist, tracked by the given session.
+// When sent to specific peers, they are asked to tell us if they don't have
+// the blocks. The priorities, if given, are those of each cid; otherwise the
+// cids are prioritized in the order given.
+func (pm *WantManager) WantBlocks(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64, priorities ...int) {
 	log.Infof("want blocks: %s", ks)
-	pm.addEntries(ctx, ks, peers, false, ses)
+	pm.addEntries(ctx, ks, priorities, peers, false, pb.Message_Wantlist_Block, len(peers) > 0, ses)
+}
+
+// WantHaves asks the given peers (or everyone, if peers is empty) whether they
+// have the given cids, without asking for the blocks themselves. Peers respond
+// with HAVE or DONT_HAVE. Priorities are as for WantBlocks.
+func (pm *WantManager) WantHaves(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64, priorities ...int) {
+	log.Infof("want haves: %s", ks)
+	pm.addEntries(ctx, ks, priorities, peers, false, pb.Message_Wantlist_Have, true, ses)
+}
+
+// SupportsHave returns false if the peer is known to predate want-haves, and
+// so never responds with HAVE or DONT_HAVE. Want-haves are sent to such peers
+// as want-blocks. Peers are assumed to support them until we've opened a
+// stream to them.
+func (pm *WantManager) SupportsHave(p peer.ID) bool {
+	return pm.haveSupport.supports(p)
 }
 
 // CancelWants removes the given cids from the wantlist, tracked by the given session
 func (pm *WantManager) CancelWants(ctx context.Context, ks []cid.Cid, peers []peer.ID, ses uint64) {
-	pm.addEntries(context.Background(), ks, peers, true, ses)
+	pm.addEntries(context.Background(), ks, nil, peers, true, pb.Message_Wantlist_Block, false, ses)
+}
+
+// UpdatePriority changes the priority of the given cids, if they are in the
+// wantlist, and lets the peers they were sent to know
+func (pm *WantManager) UpdatePriority(ctx context.Context, ks []cid.Cid, priority int) {
+	entries := make([]*bsmsg.Entry, 0, len(ks))
+	for _, k := range ks {
+		entries = append(entries, &bsmsg.Entry{Entry: wantlist.NewRefEntry(k, priority)})
+	}
+	pm.sendWantSet(ctx, &wantSet{entries: entries, update: true})
 }
 
 type wantSet struct {
 	entries []*bsmsg.Entry
 	targets []peer.ID
 	from    uint64
+	// update is set for priority changes to wants already made
+	update bool
 }
 
-func (pm *WantManager) addEntries(ctx context.Context, ks []cid.Cid, targets []peer.ID, cancel bool, ses uint64) {
+func (pm *WantManager) addEntries(ctx context.Context, ks []cid.Cid, priorities []int, targets []peer.ID, cancel bool,
+	wantType pb.Message_Wantlist_WantType, sendDontHave bool, ses uint64) {
 	entries := make([]*bsmsg.Entry, 0, len(ks))
 	for i, k := range ks {
+		priority := DefaultPriority - i
+		if i < len(priorities) {
+			priority = priorities[i]
+		}
+		e := wantlist.NewRefEntry(k, priority)
+		e.WantType = wantType
+		e.SendDontHave = sendDontHave
 		entries = append(entries, &bsmsg.Entry{
 			Cancel: cancel,
-			Entry:  wantlist.NewRefEntry(k, kMaxPriority-i),
+			Entry:  e,
 		})
 	}
+	pm.sendWantSet(ctx, &wantSet{entries: entries, targets: targets, from: ses})
+}
+
+func (pm *WantManager) sendWantSet(ctx context.Context, ws *wantSet) {
 	select {
-	case pm.incoming <- &wantSet{entries: entries, targets: targets, from: ses}:
+	case pm.incoming <- ws:
 	case <-pm.ctx.Done():
+	case <-pm.stopped:
 	case <-ctx.Done():
 	}
 }
 
 func (pm *WantManager) ConnectedPeers() []peer.ID {
 	resp := make(chan []peer.ID)
-	pm.peerReqs <- resp
-	return <-resp
+	select {
+	case pm.peerReqs <- resp:
+		return <-resp
+	case <-pm.stopped:
+		return nil
+	}
 }
 
-func (pm *WantManager) SendBlocks(ctx context.Context, env *engine.Envelope) {
+// PendingMessages returns the number of peers with a message waiting to be
+// sent to them
+func (pm *WantManager) PendingMessages() int {
+	resp := make(chan int)
+	select {
+	case pm.pendingReqs <- resp:
+		return <-resp
+	case <-pm.stopped:
+		return 0
+	}
+}
+
+// SendBlocks sends the blocks and block presences in the envelope to its peer
+func (pm *WantManager) SendBlocks(ctx context.Context, env *engine.Envelope) error {
 	// Blocks need to be sent synchronously to maintain proper backpressure
 	// throughout the network stack
 	defer env.Sent()
@@ -126,39 +233,64 @@ func (pm *WantManager) SendBlocks(ctx context.Context, env *engine.Envelope) {
 		msg.AddBlock(block)
 		log.Infof("Sending block %s to %s", block, env.Peer)
 	}
+	for _, c := range env.Message.Haves() {
+		msg.AddHave(c)
+	}
+	for _, c := range env.Message.DontHaves() {
+		msg.AddDontHave(c)
+	}
 
 	pm.sentHistogram.Observe(float64(msgSize))
 	err := pm.network.SendMessage(ctx, env.Peer, msg)
 	if err != nil {
 		log.Infof("sendblock error: %s", err)
 	}
+	return err
 }
 
 func (pm *WantManager) startPeerHandler(p peer.ID) *msgQueue {
 	mq, ok := pm.peers[p]
 	if ok {
 		mq.refcnt++
+		// the peer may have restarted and be reconnecting before we noticed
+		// it went away, so make sure it has our wants
+		if pm.allowed(p) {
+			mq.resendFullWantlist()
+		}
 		return nil
 	}
 
 	mq = pm.newMsgQueue(p)
 
-	// new peer, we will want to give them our full wantlist
-	fullwantlist := bsmsg.New(true)
-	for _, e := range pm.bcwl.Entries() {
-		for k := range e.SesTrk {
-			mq.wl.AddEntry(e, k)
+	// new peer, we will want to give them our full wantlist, unless we
+	// don't send wants to them at all
+	if pm.allowed(p) {
+		fullwantlist := bsmsg.New(true)
+		for _, e := range pm.bcwl.Entries() {
+			for k := range e.SesTrk {
+				mq.wl.AddEntry(e, k)
+			}
+			fullwantlist.AddEntryWithType(e.Cid, e.Priority, e.WantType, e.SendDontHave)
 		}
-		fullwantlist.AddEntry(e.Cid, e.Priority)
+		mq.out = fullwantlist
+		mq.work <- struct{}{}
 	}
-	mq.out = fullwantlist
-	mq.work <- struct{}{}
 
 	pm.peers[p] = mq
-	go mq.runQueue(pm.ctx)
+	pm.running.Add(1)
+	go func() {
+		defer pm.running.Done()
+		mq.runQueue(pm.ctx)
+	}()
 	return mq
 }
 
+// allowed returns true if the peer filter allows sending wants to the given
+// peer
+func (pm *WantManager) allowed(p peer.ID) bool {
+	return pm.peerFilter == nil || pm.peerFilter.AllowPeer(p)
+}
+
 func (pm *WantManager) stopPeerHandler(p peer.ID) {
 	pq, ok := pm.peers[p]
 	if !ok {
@@ -173,14 +305,66 @@ func (pm *WantManager) stopPeerHandler(p peer.ID) {
 
 	close(pq.done)
 	delete(pm.peers, p)
+	pm.haveSupport.forget(p)
+}
+
+const (
+	// canceledWantsSize is the number of canceled wants remembered, and
+	// cancelGracePeriod how long blocks for them are still expected
+	canceledWantsSize = 1024
+	cancelGracePeriod = 30 * time.Second
+)
+
+// recentlyCanceled returns whether the want for c left the wantlist within
+// the cancel grace period
+func (pm *WantManager) recentlyCanceled(c cid.Cid) bool {
+	at, ok := pm.canceled.Get(c)
+	return ok && pm.clock.Since(at.(time.Time)) < cancelGracePeriod
 }
 
+const (
+	// sendRetryMin and sendRetryMax bound the backoff between attempts to
+	// send to a peer after a failure
+	sendRetryMin = 100 * time.Millisecond
+	sendRetryMax = 30 * time.Second
+)
+
 func (mq *msgQueue) runQueue(ctx context.Context) {
+	var (
+		retry   <-chan time.Time
+		backoff time.Duration
+	)
+	send := func() {
+		if mq.doWork(ctx) {
+			retry, backoff = nil, 0
+			return
+		}
+		// hold on to what we couldn't send and try again later, backing off
+		// while the peer stays unreachable
+		if backoff == 0 {
+			backoff = sendRetryMin
+		} else if backoff *= 2; backoff > sendRetryMax {
+			backoff = sendRetryMax
+		}
+		log.Debugf("retrying send to peer %s in %s", mq.p, backoff)
+		retry = mq.clock.After(backoff)
+	}
+
 	for {
 		select {
 		case <-mq.work: // there is work to be done
-			mq.doWork(ctx)
+			// while backing off, the retry sends the new work too
+			if retry == nil {
+				send()
+			}
+		case <-retry:
+			send()
 		case <-mq.done:
+			// send out whatever is left, such as cancels on shutdown. There's
+			// no point in resending the wantlist to a peer that went away.
+			if !mq.needsFullWantlist() {
+				mq.doWork(ctx)
+			}
 			if mq.sender != nil {
 				mq.sender.Close()
 			}
@@ -194,13 +378,19 @@ func (mq *msgQueue) runQueue(ctx context.Context) {
 	}
 }
 
-func (mq *msgQueue) doWork(ctx context.Context) {
+// doWork sends the message waiting to be sent, and returns false if it
+// couldn't be. Once a send fails, the full wantlist is sent on the next stream
+// instead of what is queued up, as we can't tell what the peer received, or
+// whether it's still the same instance of the peer.
+func (mq *msgQueue) doWork(ctx context.Context) bool {
 	// grab outgoing message
 	mq.outlk.Lock()
 	wlm := mq.out
-	if wlm == nil || wlm.Empty() {
+	if mq.resendFull {
+		wlm = mq.fullWantlist()
+	} else if wlm == nil || wlm.Empty() {
 		mq.outlk.Unlock()
-		return
+		return true
 	}
 	mq.out = nil
 	mq.outlk.Unlock()
@@ -210,49 +400,99 @@ func (mq *msgQueue) doWork(ctx context.Context) {
 		err := mq.openSender(ctx)
 		if err != nil {
 			log.Infof("cant open message sender to peer %s: %s", mq.p, err)
-			// TODO: cant connect, what now?
-			return
+			mq.failed()
+			return false
 		}
 	}
 
-	// send wantlist updates
-	for { // try to send this message until we fail.
-		err := mq.sender.SendMsg(ctx, wlm)
-		if err == nil {
-			return
-		}
+	// peers that predate want-haves never answer them with HAVE or
+	// DONT_HAVE, so they're asked for the blocks instead
+	if !mq.haveSupport.supports(mq.p) {
+		wlm = withWantHavesAsBlocks(wlm)
+	}
 
+	err := mq.sender.SendMsg(ctx, wlm)
+	if err != nil {
 		log.Infof("bitswap send error: %s", err)
 		mq.sender.Reset()
 		mq.sender = nil
+		mq.failed()
+		return false
+	}
 
-		select {
-		case <-mq.done:
-			return
-		case <-ctx.Done():
-			return
-		case <-time.After(time.Millisecond * 100):
-			// wait 100ms in case disconnect notifications are still propogating
-			log.Warning("SendMsg errored but neither 'done' nor context.Done() were set")
-		}
+	if wlm.Full() {
+		mq.outlk.Lock()
+		mq.resendFull = false
+		mq.outlk.Unlock()
+	}
+	mq.traceSent(wlm)
+	return true
+}
 
-		err = mq.openSender(ctx)
-		if err != nil {
-			log.Infof("couldnt open sender again after SendMsg(%s) failed: %s", mq.p, err)
-			// TODO(why): what do we do now?
-			// I think the *right* answer is to probably put the message we're
-			// trying to send back, and then return to waiting for new work or
-			// a disconnect.
-			return
+// withWantHavesAsBlocks returns the wantlist message with its want-haves
+// turned into want-blocks
+func withWantHavesAsBlocks(m bsmsg.BitSwapMessage) bsmsg.BitSwapMessage {
+	out := bsmsg.New(m.Full())
+	for _, e := range m.Wantlist() {
+		switch {
+		case e.Cancel:
+			out.Cancel(e.Cid)
+		case e.WantType == pb.Message_Wantlist_Have:
+			out.AddEntryWithType(e.Cid, e.Priority, pb.Message_Wantlist_Block, false)
+		default:
+			out.AddEntryWithType(e.Cid, e.Priority, e.WantType, e.SendDontHave)
 		}
+	}
+	return out
+}
 
-		// TODO: Is this the same instance for the remote peer?
-		// If its not, we should resend our entire wantlist to them
-		/*
-			if mq.sender.InstanceID() != mq.lastSeenInstanceID {
-				wlm = mq.getFullWantlistMessage()
-			}
-		*/
+// failed makes the next send the full wantlist
+func (mq *msgQueue) failed() {
+	mq.outlk.Lock()
+	mq.resendFull = true
+	mq.outlk.Unlock()
+}
+
+func (mq *msgQueue) needsFullWantlist() bool {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	return mq.resendFull
+}
+
+// resendFullWantlist queues up the full wantlist to be sent to the peer
+func (mq *msgQueue) resendFullWantlist() {
+	mq.failed()
+	select {
+	case mq.work <- struct{}{}:
+	default:
+	}
+}
+
+// fullWantlist returns a message holding every want sent to the peer.
+// mq.outlk must be held.
+func (mq *msgQueue) fullWantlist() bsmsg.BitSwapMessage {
+	msg := bsmsg.New(true)
+	for _, e := range mq.wl.Entries() {
+		msg.AddEntryWithType(e.Cid, e.Priority, e.WantType, e.SendDontHave)
+	}
+	return msg
+}
+
+// traceSent emits an event for each want and cancel in a sent message
+func (mq *msgQueue) traceSent(m bsmsg.BitSwapMessage) {
+	if mq.tracer == nil {
+		return
+	}
+	for _, e := range m.Wantlist() {
+		ev := Event{Type: EventWantSent, Peer: mq.p, Cid: e.Cid}
+		if e.Cancel {
+			ev.Type = EventCancelSent
+		} else if e.WantType == pb.Message_Wantlist_Have {
+			ev.WantType = "have"
+		} else {
+			ev.WantType = "block"
+		}
+		traceEvent(mq.tracer, ev)
 	}
 }
 
@@ -272,14 +512,54 @@ func (mq *msgQueue) openSender(ctx context.Context) error {
 		return err
 	}
 
+	supportsHave := true
+	if hs, ok := nsender.(bsnet.HaveSupporter); ok {
+		supportsHave = hs.SupportsHave()
+	}
+	mq.haveSupport.set(mq.p, supportsHave)
+
 	mq.sender = nsender
 	return nil
 }
 
+// haveSupport tracks the peers that predate want-haves. It's shared by the
+// message queues, which learn which protocol a peer speaks when they open a
+// stream to it, and the sessions, which don't wait for DONT_HAVEs from them.
+type haveSupport struct {
+	lk  sync.RWMutex
+	old map[peer.ID]struct{}
+}
+
+func (hs *haveSupport) set(p peer.ID, supportsHave bool) {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+	if supportsHave {
+		delete(hs.old, p)
+	} else {
+		hs.old[p] = struct{}{}
+	}
+}
+
+// forget drops what we know of the peer, which may reconnect speaking
+// another protocol
+func (hs *haveSupport) forget(p peer.ID) {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+	delete(hs.old, p)
+}
+
+func (hs *haveSupport) supports(p peer.ID) bool {
+	hs.lk.RLock()
+	defer hs.lk.RUnlock()
+	_, old := hs.old[p]
+	return !old
+}
+
 func (pm *WantManager) Connected(p peer.ID) {
 	select {
 	case pm.connectEvent <- peerStatus{peer: p, connect: true}:
 	case <-pm.ctx.Done():
+	case <-pm.stopped:
 	}
 }
 
@@ -287,16 +567,38 @@ func (pm *WantManager) Disconnected(p peer.ID) {
 	select {
 	case pm.connectEvent <- peerStatus{peer: p, connect: false}:
 	case <-pm.ctx.Done():
+	case <-pm.stopped:
+	}
+}
+
+// Shutdown sends cancels for our whole wantlist to every peer, and stops the
+// Run loop and the message queues once they have sent out what they hold.
+// It returns once they have all exited, which cancelling the WantManager's
+// context speeds up by abandoning any sends in progress.
+func (pm *WantManager) Shutdown() {
+	select {
+	case pm.stopReq <- struct{}{}:
+	case <-pm.stopped:
 	}
+	pm.running.Wait()
 }
 
+// Run runs the WantManager's event loop until Shutdown. It must be called
+// exactly once.
 // TODO: use goprocess here once i trust it
 func (pm *WantManager) Run() {
+	defer pm.running.Done()
+	defer close(pm.stopped)
+
 	// NOTE: Do not open any streams or connections from anywhere in this
 	// event loop. Really, just don't do anything likely to block.
 	for {
 		select {
 		case ws := <-pm.incoming:
+			if ws.update {
+				pm.updatePriorities(ws.entries)
+				continue
+			}
 
 			// is this a broadcast or not?
 			brdc := len(ws.targets) == 0
@@ -310,6 +612,7 @@ func (pm *WantManager) Run() {
 
 					if pm.wl.Remove(e.Cid, ws.from) {
 						pm.wantlistGauge.Dec()
+						pm.canceled.Add(e.Cid, pm.clock.Now())
 					}
 				} else {
 					if brdc {
@@ -321,9 +624,14 @@ func (pm *WantManager) Run() {
 				}
 			}
 
-			// broadcast those wantlist changes
+			// broadcast those wantlist changes. Cancels go to everyone, in
+			// case the filter changed since we sent the wants
+			cancel := len(ws.entries) > 0 && ws.entries[0].Cancel
 			if len(ws.targets) == 0 {
 				for _, p := range pm.peers {
+					if !cancel && !pm.allowed(p.p) {
+						continue
+					}
 					p.addMessage(ws.entries, ws.from)
 				}
 			} else {
@@ -333,6 +641,10 @@ func (pm *WantManager) Run() {
 						log.Infof("tried sending wantlist change to non-partner peer: %s", t)
 						continue
 					}
+					if !cancel && !pm.allowed(t) {
+						log.Infof("not sending wants to filtered peer: %s", t)
+						continue
+					}
 					p.addMessage(ws.entries, ws.from)
 				}
 			}
@@ -349,20 +661,102 @@ func (pm *WantManager) Run() {
 				peers = append(peers, p)
 			}
 			req <- peers
+		case req := <-pm.pendingReqs:
+			var n int
+			for _, mq := range pm.peers {
+				if mq.pending() {
+					n++
+				}
+			}
+			req <- n
+		case <-pm.stopReq:
+			for _, mq := range pm.peers {
+				mq.cancelAll()
+				close(mq.done)
+			}
+			pm.peers = make(map[peer.ID]*msgQueue)
+			return
 		case <-pm.ctx.Done():
 			return
 		}
 	}
 }
 
+// updatePriorities applies priority changes to our wantlists, and sends them
+// to the peers that have the wants
+func (pm *WantManager) updatePriorities(entries []*bsmsg.Entry) {
+	for _, e := range entries {
+		pm.wl.SetPriority(e.Cid, e.Priority)
+		pm.bcwl.SetPriority(e.Cid, e.Priority)
+	}
+	for _, mq := range pm.peers {
+		if pm.allowed(mq.p) {
+			mq.updatePriorities(entries)
+		}
+	}
+}
+
 func (wm *WantManager) newMsgQueue(p peer.ID) *msgQueue {
 	return &msgQueue{
 		done:    make(chan struct{}),
 		work:    make(chan struct{}, 1),
 		wl:      wantlist.NewThreadSafe(),
 		network: wm.network,
+		tracer:  wm.tracer,
+		clock:   wm.clock,
 		p:       p,
 		refcnt:  1,
+
+		haveSupport: wm.haveSupport,
+	}
+}
+
+// pending returns true if there's a message waiting to be sent to the peer
+func (mq *msgQueue) pending() bool {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+	return mq.resendFull || (mq.out != nil && !mq.out.Empty())
+}
+
+// cancelAll queues up cancels for every want sent to the peer, in place of
+// any pending resend of the wantlist
+func (mq *msgQueue) cancelAll() {
+	mq.outlk.Lock()
+	defer mq.outlk.Unlock()
+
+	mq.resendFull = false
+
+	if mq.out == nil {
+		mq.out = bsmsg.New(false)
+	}
+	for _, e := range mq.wl.Entries() {
+		mq.out.Cancel(e.Cid)
+	}
+}
+
+// updatePriorities queues up the priority changes of the wants sent to the
+// peer
+func (mq *msgQueue) updatePriorities(entries []*bsmsg.Entry) {
+	var work bool
+	mq.outlk.Lock()
+	for _, e := range entries {
+		if !mq.wl.SetPriority(e.Cid, e.Priority) {
+			continue
+		}
+		we, _ := mq.wl.Contains(e.Cid)
+		if mq.out == nil {
+			mq.out = bsmsg.New(false)
+		}
+		mq.out.AddEntryWithType(e.Cid, e.Priority, we.WantType, we.SendDontHave)
+		work = true
+	}
+	mq.outlk.Unlock()
+
+	if work {
+		select {
+		case mq.work <- struct{}{}:
+		default:
+		}
 	}
 }
 
@@ -395,9 +789,9 @@ func (mq *msgQueue) addMessage(entries []*bsmsg.Entry, ses uint64) {
 				mq.out.Cancel(e.Cid)
 			}
 		} else {
-			if mq.wl.Add(e.Cid, e.Priority, ses) {
+			if mq.wl.AddTyped(e.Cid, e.Priority, e.WantType, ses) {
 				work = true
-				mq.out.AddEntry(e.Cid, e.Priority)
+				mq.out.AddEntryWithType(e.Cid, e.Priority, e.WantType, e.SendDontHave)
 			}
 		}
 	}
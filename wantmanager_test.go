@@ -0,0 +1,199 @@
+package bitswap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	clock "github.com/ipfs/go-bitswap/clock"
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	bsnet "github.com/ipfs/go-bitswap/network"
+
+	cid "github.com/ipfs/go-cid"
+	blocksutil "github.com/ipfs/go-ipfs-blocksutil"
+	peer "github.com/libp2p/go-libp2p-peer"
+	tu "github.com/libp2p/go-testutil"
+)
+
+// flakyNetwork records the messages sent over it, failing to open senders or
+// to send as told. It only implements what the message queues use.
+type flakyNetwork struct {
+	bsnet.BitSwapNetwork
+
+	lk        sync.Mutex
+	opens     int
+	failOpens int
+	failSends int
+	sent      []bsmsg.BitSwapMessage
+
+	// oldProtocol makes the peer predate want-haves
+	oldProtocol bool
+}
+
+func (fn *flakyNetwork) ConnectTo(context.Context, peer.ID) error {
+	return nil
+}
+
+func (fn *flakyNetwork) NewMessageSender(context.Context, peer.ID) (bsnet.MessageSender, error) {
+	fn.lk.Lock()
+	defer fn.lk.Unlock()
+	fn.opens++
+	if fn.failOpens > 0 {
+		fn.failOpens--
+		return nil, errors.New("can't open stream")
+	}
+	return &flakySender{fn}, nil
+}
+
+func (fn *flakyNetwork) status() (int, []bsmsg.BitSwapMessage) {
+	fn.lk.Lock()
+	defer fn.lk.Unlock()
+	return fn.opens, append([]bsmsg.BitSwapMessage(nil), fn.sent...)
+}
+
+type flakySender struct {
+	fn *flakyNetwork
+}
+
+func (fs *flakySender) SendMsg(_ context.Context, m bsmsg.BitSwapMessage) error {
+	fs.fn.lk.Lock()
+	defer fs.fn.lk.Unlock()
+	if fs.fn.failSends > 0 {
+		fs.fn.failSends--
+		return errors.New("stream reset")
+	}
+	fs.fn.sent = append(fs.fn.sent, m)
+	return nil
+}
+
+func (fs *flakySender) SupportsHave() bool { return !fs.fn.oldProtocol }
+
+func (fs *flakySender) Close() error { return nil }
+func (fs *flakySender) Reset() error { return nil }
+
+func assertFullWantlist(t *testing.T, m bsmsg.BitSwapMessage, ks []cid.Cid) {
+	t.Helper()
+	if !m.Full() || len(m.Wantlist()) != len(ks) {
+		t.Fatalf("expected a full wantlist of %d wants, got %d (full: %t)", len(ks), len(m.Wantlist()), m.Full())
+	}
+	want := make(map[cid.Cid]bool)
+	for _, k := range ks {
+		want[k] = true
+	}
+	for _, e := range m.Wantlist() {
+		if !want[e.Cid] || e.Cancel {
+			t.Fatal("unexpected entry in wantlist", e.Cid)
+		}
+	}
+}
+
+func TestWantlistResentAfterFailures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clk := clock.NewMock()
+	fn := &flakyNetwork{failOpens: 2}
+	wm := NewWantManager(ctx, fn)
+	wm.clock = clk
+	go wm.Run()
+	defer wm.Shutdown()
+
+	p := tu.RandPeerIDFatal(t)
+	wm.Connected(p)
+
+	bgen := blocksutil.NewBlockGenerator()
+	var ks []cid.Cid
+	for _, blk := range bgen.Blocks(3) {
+		ks = append(ks, blk.Cid())
+	}
+	wm.WantBlocks(ctx, ks[:2], nil, 1)
+
+	// the wants are held on to while the stream can't be opened, backing
+	// off between attempts
+	waitFor(t, func() bool { opens, _ := fn.status(); return opens == 1 && clk.Timers() == 1 })
+	if wm.PendingMessages() != 1 {
+		t.Fatal("expected the wants to be pending")
+	}
+	clk.Add(sendRetryMin)
+	waitFor(t, func() bool { opens, _ := fn.status(); return opens == 2 && clk.Timers() == 1 })
+	clk.Add(sendRetryMin)
+	if opens, _ := fn.status(); opens != 2 {
+		t.Fatal("expected the retry to back off")
+	}
+	clk.Add(sendRetryMin)
+	waitFor(t, func() bool { _, sent := fn.status(); return len(sent) == 1 })
+	_, sent := fn.status()
+	assertFullWantlist(t, sent[0], ks[:2])
+	if wm.PendingMessages() != 0 {
+		t.Fatal("expected nothing to be pending")
+	}
+
+	// a failed send is followed by the full wantlist on a new stream
+	fn.lk.Lock()
+	fn.failSends = 1
+	fn.lk.Unlock()
+	wm.WantBlocks(ctx, ks[2:], nil, 1)
+	waitFor(t, func() bool { return clk.Timers() == 1 })
+	clk.Add(sendRetryMin)
+	waitFor(t, func() bool { _, sent := fn.status(); return len(sent) == 2 })
+	opens, sent := fn.status()
+	if opens != 4 {
+		t.Fatal("expected a new stream to be opened, got", opens)
+	}
+	assertFullWantlist(t, sent[1], ks)
+
+	// the full wantlist is resent to a peer that reconnects
+	wm.Connected(p)
+	waitFor(t, func() bool { _, sent := fn.status(); return len(sent) == 3 })
+	_, sent = fn.status()
+	assertFullWantlist(t, sent[2], ks)
+}
+
+func TestWantHavesSentAsBlocksToOldPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fn := &flakyNetwork{oldProtocol: true}
+	wm := NewWantManager(ctx, fn)
+	go wm.Run()
+	defer wm.Shutdown()
+
+	p := tu.RandPeerIDFatal(t)
+	wm.Connected(p)
+	if !wm.SupportsHave(p) {
+		t.Fatal("expected the peer to be assumed to support want-haves")
+	}
+
+	bgen := blocksutil.NewBlockGenerator()
+	var ks []cid.Cid
+	for _, blk := range bgen.Blocks(3) {
+		ks = append(ks, blk.Cid())
+	}
+
+	// want-haves would never be answered, so the blocks are asked for
+	wm.WantHaves(ctx, ks[:2], nil, 1)
+	wm.WantBlocks(ctx, ks[2:], nil, 1)
+	waitFor(t, func() bool {
+		_, sent := fn.status()
+		var n int
+		for _, m := range sent {
+			n += len(m.Wantlist())
+		}
+		return n == 3
+	})
+	if wm.SupportsHave(p) {
+		t.Fatal("expected the peer to be known not to support want-haves")
+	}
+	_, sent := fn.status()
+	for _, m := range sent {
+		for _, e := range m.Wantlist() {
+			if e.WantType != pb.Message_Wantlist_Block || e.SendDontHave {
+				t.Fatal("expected only want-blocks to be sent, got", e)
+			}
+		}
+	}
+
+}
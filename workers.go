@@ -2,11 +2,14 @@ package bitswap
 
 import (
 	"context"
-	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	clock "github.com/ipfs/go-bitswap/clock"
+	engine "github.com/ipfs/go-bitswap/decision"
 	bsmsg "github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
 
 	cid "github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
@@ -15,18 +18,18 @@ import (
 	peer "github.com/libp2p/go-libp2p-peer"
 )
 
-var TaskWorkerCount = 8
-
 func (bs *Bitswap) startWorkers(px process.Process, ctx context.Context) {
 	// Start up a worker to handle block requests this node is making
 	px.Go(func(px process.Process) {
-		bs.providerQueryManager(ctx)
+		bs.findProvidersWorker(ctx)
 	})
 
 	// Start up workers to handle requests from other nodes for the data on this node
-	for i := 0; i < TaskWorkerCount; i++ {
+	for i := 0; i < bs.taskWorkerCount; i++ {
 		i := i
+		bs.taskWorkers.Add(1)
 		px.Go(func(px process.Process) {
+			defer bs.taskWorkers.Done()
 			bs.taskWorker(ctx, i)
 		})
 	}
@@ -36,15 +39,34 @@ func (bs *Bitswap) startWorkers(px process.Process, ctx context.Context) {
 		bs.rebroadcastWorker(ctx)
 	})
 
-	// Start up a worker to manage sending out provides messages
+	// Start up a worker to decay the scores of misbehaving peers
+	px.Go(func(px process.Process) {
+		bs.scoreWorker(ctx)
+	})
+
+	// Start up a worker to keep the metrics gauges up to date
 	px.Go(func(px process.Process) {
-		bs.provideCollector(ctx)
+		bs.metricsWorker(ctx)
 	})
 
-	// Spawn up multiple workers to handle incoming blocks
-	// consider increasing number if providing blocks bottlenecks
-	// file transfers
-	px.Go(bs.provideWorker)
+	if bs.provideEnabled {
+		// Start up a worker to manage sending out provides messages
+		px.Go(func(px process.Process) {
+			bs.provideCollector(ctx)
+		})
+
+		// Spawn up multiple workers to handle incoming blocks
+		// consider increasing number if providing blocks bottlenecks
+		// file transfers
+		px.Go(bs.provideWorker)
+
+		if bs.reprovider != nil {
+			// Start up a worker to provide everything again periodically
+			px.Go(func(px process.Process) {
+				bs.reprovideWorker(ctx)
+			})
+		}
+	}
 }
 
 func (bs *Bitswap) taskWorker(ctx context.Context, id int) {
@@ -53,15 +75,16 @@ func (bs *Bitswap) taskWorker(ctx context.Context, id int) {
 	for {
 		log.Event(ctx, "Bitswap.TaskWorker.Loop", idmap)
 		select {
-		case nextEnvelope := <-bs.engine.Outbox():
+		case nextEnvelope, ok := <-bs.engine.Outbox():
+			if !ok {
+				// the engine has been closed
+				return
+			}
 			select {
 			case envelope, ok := <-nextEnvelope:
 				if !ok {
 					continue
 				}
-				// update the BS ledger to reflect sent message
-				// TODO: Should only track *useful* messages in ledger
-				outgoing := bsmsg.New(false)
 				for _, block := range envelope.Message.Blocks() {
 					log.Event(ctx, "Bitswap.TaskWorker.Work", logging.LoggableF(func() map[string]interface{} {
 						return logging.LoggableMap{
@@ -70,17 +93,38 @@ func (bs *Bitswap) taskWorker(ctx context.Context, id int) {
 							"Block":  block.Cid().String(),
 						}
 					}))
-					outgoing.AddBlock(block)
 				}
-				bs.engine.MessageSent(envelope.Peer, outgoing)
 
-				bs.wm.SendBlocks(ctx, envelope)
-				bs.counterLk.Lock()
+				size := 0
 				for _, block := range envelope.Message.Blocks() {
-					bs.counters.blocksSent++
-					bs.counters.dataSent += uint64(len(block.RawData()))
+					size += len(block.RawData())
+				}
+				throttled, peerWait, err := bs.bwLimiter.throttle(ctx, envelope.Peer, size)
+				if err != nil {
+					envelope.Sent()
+					return
 				}
-				bs.counterLk.Unlock()
+				if peerWait > 0 {
+					// the peer is over its own limit. Rather than hold up
+					// this worker, and with it everyone else, hold back the
+					// peer's tasks and send this envelope once the limit
+					// allows.
+					bs.engine.HoldPeer(envelope.Peer, peerWait)
+					bs.taskWorkers.Add(1)
+					go func(envelope *engine.Envelope, throttled time.Duration) {
+						defer bs.taskWorkers.Done()
+						t := bs.clock.NewTimer(peerWait)
+						defer t.Stop()
+						select {
+						case <-t.C:
+							bs.sendEnvelope(ctx, envelope, throttled)
+						case <-ctx.Done():
+							envelope.Sent()
+						}
+					}(envelope, throttled+peerWait)
+					continue
+				}
+				bs.sendEnvelope(ctx, envelope, throttled)
 			case <-ctx.Done():
 				return
 			}
@@ -90,9 +134,77 @@ func (bs *Bitswap) taskWorker(ctx context.Context, id int) {
 	}
 }
 
+// sendEnvelope sends the blocks and block presences in the envelope, and
+// records them in the ledger once they're sent
+func (bs *Bitswap) sendEnvelope(ctx context.Context, envelope *engine.Envelope, throttled time.Duration) {
+	if err := bs.wm.SendBlocks(ctx, envelope); err != nil {
+		return
+	}
+
+	// update the BS ledger to reflect sent message
+	// TODO: Should only track *useful* messages in ledger
+	outgoing := bsmsg.New(false)
+	size := 0
+	for _, block := range envelope.Message.Blocks() {
+		outgoing.AddBlock(block)
+		size += len(block.RawData())
+	}
+	for _, c := range envelope.Message.Haves() {
+		outgoing.AddHave(c)
+	}
+	for _, c := range envelope.Message.DontHaves() {
+		outgoing.AddDontHave(c)
+	}
+	bs.engine.MessageSent(envelope.Peer, outgoing)
+
+	if size > 0 {
+		bs.metrics.forPeer(envelope.Peer).bytesSent.Add(float64(size))
+	}
+	for _, block := range envelope.Message.Blocks() {
+		traceEvent(bs.tracer, Event{
+			Type: EventBlockServed,
+			Peer: envelope.Peer,
+			Cid:  block.Cid(),
+			Size: len(block.RawData()),
+		})
+	}
+	bs.counterLk.Lock()
+	bs.counters.throttleTime += throttled
+	for _, block := range envelope.Message.Blocks() {
+		bs.counters.blocksSent++
+		bs.counters.dataSent += uint64(len(block.RawData()))
+	}
+	bs.counterLk.Unlock()
+}
+
 func (bs *Bitswap) provideWorker(px process.Process) {
 
-	limit := make(chan struct{}, provideWorkerMax)
+	limit := make(chan struct{}, bs.provideWorkerMax)
+
+	// provided records the outcome of providing the keys
+	provided := func(ks []cid.Cid, err error) {
+		for _, k := range ks {
+			bs.provideQueue.done(k, err == nil)
+		}
+		bs.counterLk.Lock()
+		if err != nil {
+			bs.counters.provideFailures += uint64(len(ks))
+		} else {
+			bs.counters.provided += uint64(len(ks))
+		}
+		bs.counterLk.Unlock()
+	}
+
+	provide := func(ctx context.Context, k cid.Cid) {
+		ctx, cancel := context.WithTimeout(ctx, provideTimeout) // timeout ctx
+		defer cancel()
+
+		err := bs.network.Provide(ctx, k)
+		if err != nil {
+			log.Warning(err)
+		}
+		provided([]cid.Cid{k}, err)
+	}
 
 	limitedGoProvide := func(k cid.Cid, wid int) {
 		defer func() {
@@ -104,16 +216,65 @@ func (bs *Bitswap) provideWorker(px process.Process) {
 		ctx := procctx.OnClosingContext(px) // derive ctx from px
 		defer log.EventBegin(ctx, "Bitswap.ProvideWorker.Work", ev, k).Done()
 
-		ctx, cancel := context.WithTimeout(ctx, provideTimeout) // timeout ctx
-		defer cancel()
+		provide(ctx, k)
+	}
 
-		if err := bs.network.Provide(ctx, k); err != nil {
-			log.Warning(err)
+	// keys are provided in batches if the network can, falling back to
+	// providing them one by one for good if the router turns out not to
+	manyProvider, batching := bs.network.(bsnet.ManyProvider)
+	batching = batching && bs.provideBatchSize > 1
+	var unsupported int32
+
+	limitedGoProvideMany := func(ks []cid.Cid, wid int) {
+		defer func() {
+			<-limit
+		}()
+		ev := logging.LoggableMap{"ID": wid, "Keys": len(ks)}
+
+		ctx := procctx.OnClosingContext(px)
+		defer log.EventBegin(ctx, "Bitswap.ProvideWorker.WorkMany", ev).Done()
+
+		bctx, cancel := context.WithTimeout(ctx, provideBatchTimeout)
+		err := manyProvider.ProvideMany(bctx, ks)
+		cancel()
+		if err == bsnet.ErrProvideManyUnsupported {
+			log.Info("router doesn't provide in batches, providing keys one by one")
+			atomic.StoreInt32(&unsupported, 1)
+			for _, k := range ks {
+				provide(ctx, k)
+			}
+			return
+		}
+		if err != nil {
+			log.Warningf("failed to provide %d keys: %s", len(ks), err)
 		}
+		provided(ks, err)
 	}
 
 	// worker spawner, reads from bs.provideKeys until it closes, spawning a
-	// _ratelimited_ number of workers to handle each key.
+	// _ratelimited_ number of workers to handle each key, or batch of keys.
+	// wait for the provides in progress to be cancelled before returning
+	defer func() {
+		for i := 0; i < cap(limit); i++ {
+			limit <- struct{}{}
+		}
+	}()
+
+	var batch []cid.Cid
+	var flushTimer *clock.Timer
+	var flush <-chan time.Time
+	defer func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+		// the keys of a batch still being collected are handed out too, so
+		// that they're marked done either way
+		if len(batch) > 0 {
+			limit <- struct{}{}
+			limitedGoProvideMany(batch, 1)
+		}
+	}()
+
 	for wid := 2; ; wid++ {
 		ev := logging.LoggableMap{"ID": 1}
 		log.Event(procctx.OnClosingContext(px), "Bitswap.ProvideWorker.Loop", ev)
@@ -126,43 +287,121 @@ func (bs *Bitswap) provideWorker(px process.Process) {
 				log.Debug("provideKeys channel closed")
 				return
 			}
-			select {
-			case <-px.Closing():
-				return
-			case limit <- struct{}{}:
-				go limitedGoProvide(k, wid)
+			if !batching || atomic.LoadInt32(&unsupported) != 0 {
+				select {
+				case <-px.Closing():
+					return
+				case limit <- struct{}{}:
+					go limitedGoProvide(k, wid)
+				}
+				continue
+			}
+
+			// collect keys until the batch is full, or the window since
+			// the first one has passed
+			batch = append(batch, k)
+			if len(batch) == 1 {
+				flushTimer = bs.clock.NewTimer(bs.provideBatchWindow)
+				flush = flushTimer.C
 			}
+			if len(batch) < bs.provideBatchSize {
+				continue
+			}
+			flushTimer.Stop()
+		case <-flush:
+		}
+
+		flush = nil
+		select {
+		case <-px.Closing():
+			return
+		case limit <- struct{}{}:
+			go limitedGoProvideMany(batch, wid)
+			batch = nil
 		}
 	}
 }
 
+// provideCollector queues up new blocks and feeds them to the provide
+// workers, followed by the keys being reprovided when there are no new blocks
+// left
 func (bs *Bitswap) provideCollector(ctx context.Context) {
 	defer close(bs.provideKeys)
-	var toProvide []cid.Cid
 	var nextKey cid.Cid
 	var keysOut chan cid.Cid
+	var fromQueue bool
+	var retryTimer *clock.Timer
+	defer func() {
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+	}()
 
 	for {
+		var reprovideKeys chan cid.Cid
+		var retry <-chan time.Time
+		if keysOut == nil {
+			if c, ok := bs.provideQueue.peek(); ok {
+				nextKey, keysOut, fromQueue = c, bs.provideKeys, true
+			} else {
+				reprovideKeys = bs.reprovideKeys
+				// wake up for the blocks that failed to be provided once
+				// they're due to be retried
+				if at, ok := bs.provideQueue.nextRetryAt(); ok {
+					retryTimer = bs.clock.NewTimer(bs.clock.Until(at))
+					retry = retryTimer.C
+				}
+			}
+		}
+
 		select {
 		case blkey, ok := <-bs.newBlocks:
 			if !ok {
 				log.Debug("newBlocks channel closed")
 				return
 			}
-
-			if keysOut == nil {
-				nextKey = blkey
-				keysOut = bs.provideKeys
-			} else {
-				toProvide = append(toProvide, blkey)
+			if err := bs.provideQueue.enqueue(blkey); err != nil {
+				log.Errorf("failed to queue %s to be provided: %s", blkey, err)
 			}
+		case c := <-reprovideKeys:
+			nextKey, keysOut, fromQueue = c, bs.provideKeys, false
 		case keysOut <- nextKey:
-			if len(toProvide) > 0 {
-				nextKey = toProvide[0]
-				toProvide = toProvide[1:]
-			} else {
-				keysOut = nil
+			if fromQueue {
+				bs.provideQueue.pop(nextKey)
 			}
+			keysOut = nil
+		case <-retry:
+		case <-bs.provideQueue.retried:
+		case <-ctx.Done():
+			return
+		}
+		if retryTimer != nil {
+			retryTimer.Stop()
+			retryTimer = nil
+		}
+	}
+}
+
+func (bs *Bitswap) scoreWorker(ctx context.Context) {
+	tick := bs.clock.NewTicker(scoreSweepInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			bs.scores.sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (bs *Bitswap) metricsWorker(ctx context.Context) {
+	tick := bs.clock.NewTicker(metricsSampleInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			bs.sampleMetrics()
 		case <-ctx.Done():
 			return
 		}
@@ -173,33 +412,33 @@ func (bs *Bitswap) rebroadcastWorker(parent context.Context) {
 	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 
-	broadcastSignal := time.NewTicker(rebroadcastDelay.Get())
+	broadcastSignal := bs.clock.NewTicker(bs.rebroadcast.interval)
 	defer broadcastSignal.Stop()
 
-	tick := time.NewTicker(10 * time.Second)
+	tick := bs.clock.NewTicker(10 * time.Second)
 	defer tick.Stop()
 
 	for {
 		log.Event(ctx, "Bitswap.Rebroadcast.idle")
 		select {
 		case <-tick.C:
-			n := bs.wm.wl.Len()
-			if n > 0 {
+			entries := bs.wm.wl.Entries()
+			if n := len(entries); n > 0 {
 				log.Debug(n, " keys in bitswap wantlist")
 			}
+			bs.rebroadcast.sync(entries)
 		case <-broadcastSignal.C: // resend unfulfilled wantlist keys
 			log.Event(ctx, "Bitswap.Rebroadcast.active")
-			entries := bs.wm.wl.Entries()
-			if len(entries) == 0 {
-				continue
-			}
-
-			// TODO: come up with a better strategy for determining when to search
-			// for new providers for blocks.
-			i := rand.Intn(len(entries))
-			bs.findKeys <- &blockRequest{
-				Cid: entries[i].Cid,
-				Ctx: ctx,
+			bs.rebroadcast.sync(bs.wm.wl.Entries())
+
+			// search for the providers of the wants that went unanswered
+			// the longest
+			for _, c := range bs.rebroadcast.due() {
+				select {
+				case bs.findKeys <- &blockRequest{Cid: c, Ctx: ctx}:
+				case <-parent.Done():
+					return
+				}
 			}
 		case <-parent.Done():
 			return
@@ -207,9 +446,12 @@ func (bs *Bitswap) rebroadcastWorker(parent context.Context) {
 	}
 }
 
-func (bs *Bitswap) providerQueryManager(ctx context.Context) {
-	var activeLk sync.Mutex
-	kset := cid.NewSet()
+// findProvidersWorker connects to the providers of the cids requested on
+// bs.findKeys
+func (bs *Bitswap) findProvidersWorker(ctx context.Context) {
+	// wait for the connections in progress to be cancelled before returning
+	var requests sync.WaitGroup
+	defer requests.Wait()
 
 	for {
 		select {
@@ -220,20 +462,22 @@ func (bs *Bitswap) providerQueryManager(ctx context.Context) {
 			default:
 			}
 
-			activeLk.Lock()
-			if kset.Has(e.Cid) {
-				activeLk.Unlock()
-				continue
-			}
-			kset.Add(e.Cid)
-			activeLk.Unlock()
-
+			requests.Add(1)
 			go func(e *blockRequest) {
-				child, cancel := context.WithTimeout(e.Ctx, providerRequestTimeout)
+				defer requests.Done()
+				// the request outliving bitswap shouldn't keep it going
+				child, cancel := context.WithCancel(e.Ctx)
 				defer cancel()
-				providers := bs.network.FindProvidersAsync(child, e.Cid, maxProvidersPerRequest)
+				go func() {
+					select {
+					case <-ctx.Done():
+						cancel()
+					case <-child.Done():
+					}
+				}()
+
 				wg := &sync.WaitGroup{}
-				for p := range providers {
+				for p := range bs.pqm.FindProvidersAsync(child, e.Cid, 0) {
 					wg.Add(1)
 					go func(p peer.ID) {
 						defer wg.Done()
@@ -244,9 +488,6 @@ func (bs *Bitswap) providerQueryManager(ctx context.Context) {
 					}(p)
 				}
 				wg.Wait()
-				activeLk.Lock()
-				kset.Remove(e.Cid)
-				activeLk.Unlock()
 			}(e)
 
 		case <-ctx.Done():